@@ -0,0 +1,23 @@
+package cloud
+
+import "time"
+
+// APIKeyHeader is the request header machine clients send their API key in,
+// instead of a bearer token.
+const APIKeyHeader = "X-API-Key"
+
+// APIKey lets a machine client, such as a scheduled job, call the API without
+// logging in as a user. A key can only perform the Actions in its Scopes. Only
+// the hash of the key is stored; Prefix is kept so that admins can tell keys
+// apart.
+type APIKey struct {
+	ID         string     `json:"id" db:"id"`
+	Name       string     `json:"name" db:"name"`
+	Prefix     string     `json:"prefix" db:"key_prefix"`
+	Hash       string     `json:"-" db:"key_hash"`
+	Scopes     []Action   `json:"scopes" db:"scopes"`
+	CreatedBy  string     `json:"createdBy" db:"created_by"`
+	CreatedAt  time.Time  `json:"createdAt" db:"created_at"`
+	LastUsedAt *time.Time `json:"lastUsedAt" db:"last_used_at"`
+	RevokedAt  *time.Time `json:"revokedAt" db:"revoked_at"`
+}
@@ -0,0 +1,126 @@
+package cloud
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// AuditOutcome is how an audited action turned out.
+type AuditOutcome string
+
+const (
+	AuditSucceeded AuditOutcome = "succeeded"
+	AuditFailed    AuditOutcome = "failed"
+)
+
+// The kinds of thing an audited action is performed on.
+const (
+	AuditTargetUser      = "user"
+	AuditTargetInvite    = "invite"
+	AuditTargetAPIKey    = "api_key"
+	AuditTargetGridBatch = "grid_batch"
+	AuditTargetCustomer  = "customer"
+	AuditTargetInvoices  = "invoices"
+	AuditTargetMeters    = "meters"
+)
+
+// AuditEntry records a single action that changed something: who performed
+// it, what it was performed on, what changed, and whether it succeeded. The
+// actor is the requesting user, or the API key for requests made with one.
+type AuditEntry struct {
+	ID             string                 `json:"id" db:"id"`
+	At             time.Time              `json:"at" db:"at"`
+	ActorID        string                 `json:"actorId" db:"actor_id"`
+	ImpersonatorID string                 `json:"impersonatorId,omitempty" db:"impersonator_id"`
+	APIKeyID       string                 `json:"apiKeyId,omitempty" db:"api_key_id"`
+	Action         Action                 `json:"action" db:"action"`
+	TargetType     string                 `json:"targetType" db:"target_type"`
+	TargetID       string                 `json:"targetId" db:"target_id"`
+	RequestID      string                 `json:"requestId" db:"request_id"`
+	Changes        map[string]AuditChange `json:"changes,omitempty" db:"changes"`
+	Outcome        AuditOutcome           `json:"outcome" db:"outcome"`
+	Error          string                 `json:"error,omitempty" db:"error"`
+}
+
+// AuditChange is the value of a single field before and after an action.
+type AuditChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// Auditor records audited actions. Recording must never fail the action
+// itself, so implementations deal with their own errors.
+type Auditor interface {
+	Record(ctx Context, e *AuditEntry)
+}
+
+// NewAuditEntry starts the entry for the requesting user, or API key,
+// performing the action on a target. It succeeds until Result says otherwise.
+func NewAuditEntry(ctx Context, act Action, targetType, targetID string) *AuditEntry {
+	return &AuditEntry{
+		ID:             uuid.New(),
+		At:             time.Now(),
+		ActorID:        ctx.UserKey,
+		ImpersonatorID: ctx.ImpersonatorKey,
+		APIKeyID:       ctx.APIKeyID,
+		Action:         act,
+		TargetType:     targetType,
+		TargetID:       targetID,
+		RequestID:      ctx.RequestID,
+		Outcome:        AuditSucceeded,
+	}
+}
+
+// Diff records the fields that differ between before and after, as they are
+// encoded to JSON. Either may be nil, for things that are created or deleted.
+// Fields that are never encoded, such as password hashes, are never recorded.
+func (e *AuditEntry) Diff(before, after interface{}) *AuditEntry {
+	b, a := auditFields(before), auditFields(after)
+	changes := make(map[string]AuditChange)
+	for k, v := range b {
+		if !reflect.DeepEqual(v, a[k]) {
+			changes[k] = AuditChange{Before: v, After: a[k]}
+		}
+	}
+	for k, v := range a {
+		if _, ok := b[k]; !ok {
+			changes[k] = AuditChange{After: v}
+		}
+	}
+	e.Changes = changes
+	return e
+}
+
+// Result records the outcome of the action from the error it failed with, if
+// any.
+func (e *AuditEntry) Result(err *Error) *AuditEntry {
+	if err == nil {
+		e.Outcome, e.Error = AuditSucceeded, ""
+		return e
+	}
+	e.Outcome, e.Error = AuditFailed, err.Message()
+	return e
+}
+
+// auditFields returns v's JSON encoding as a map of its fields. Values that
+// don't encode to an object are kept under "value".
+func auditFields(v interface{}) map[string]interface{} {
+	if v == nil {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(b, &decoded); err != nil || decoded == nil {
+		return nil
+	}
+	if m, ok := decoded.(map[string]interface{}); ok {
+		return m
+	}
+	return map[string]interface{}{"value": decoded}
+}
@@ -0,0 +1,45 @@
+package cloud_test
+
+import (
+	"testing"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/assert"
+)
+
+func TestAuditEntryDiff(t *testing.T) {
+	assert := assert.New(t)
+	before := &cloud.User{ID: "u1", FirstName: "Ann", PasswordHash: "old", Role: cloud.RoleViewer}
+	after := &cloud.User{ID: "u1", FirstName: "Anne", PasswordHash: "new", Role: cloud.RoleViewer}
+
+	e := cloud.NewAuditEntry(cloud.Context{UserKey: "admin", RequestID: "r1"}, cloud.ActionPutUser, cloud.AuditTargetUser, "u1").Diff(before, after)
+
+	assert.Equals(e.ActorID, "admin")
+	assert.Equals(e.RequestID, "r1")
+	assert.Equals(e.Changes, map[string]cloud.AuditChange{
+		"firstName": {Before: "Ann", After: "Anne"},
+	})
+}
+
+func TestAuditEntryDiffCreated(t *testing.T) {
+	e := cloud.NewAuditEntry(cloud.Context{}, cloud.ActionSetUserRole, cloud.AuditTargetUser, "u1").
+		Diff(nil, map[string]cloud.Role{"role": cloud.RoleAdmin})
+
+	assert.New(t).Equals(e.Changes, map[string]cloud.AuditChange{
+		"role": {After: "admin"},
+	})
+}
+
+func TestAuditEntryResult(t *testing.T) {
+	assert := assert.New(t)
+	e := cloud.NewAuditEntry(cloud.Context{}, cloud.ActionLogin, cloud.AuditTargetUser, "u1")
+	assert.Equals(e.Outcome, cloud.AuditSucceeded)
+
+	e.Result(cloud.NewError(cloud.ErrOpts{Kind: cloud.ErrKindForbidden, Message: "account is disabled"}))
+	assert.Equals(e.Outcome, cloud.AuditFailed)
+	assert.Equals(e.Error, "account is disabled")
+
+	e.Result(nil)
+	assert.Equals(e.Outcome, cloud.AuditSucceeded)
+	assert.Equals(e.Error, "")
+}
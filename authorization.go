@@ -2,14 +2,221 @@ package cloud
 
 const DefaultTokenLength = 32
 
+// Action identifies a single operation a caller can perform through the API.
+// Every route declares the Action it performs, and the AuthorizationService
+// decides whether the requesting user may perform it.
 type Action string
 
 const (
-// ActionAccessTideAPI Action = "tideapi.access"
+	// User actions that do not require an authenticated user.
+	ActionLogin                Action = "users.login"
+	ActionRequestPasswordReset Action = "users.requestpasswordreset"
+	ActionResetPassword        Action = "users.resetpassword"
+	ActionRefreshToken         Action = "users.refresh"
+	ActionLoginTOTP            Action = "users.login.totp"
+	ActionRequestMagicLink     Action = "users.magiclink"
+	ActionLoginMagicLink       Action = "users.login.magiclink"
+	ActionStartOIDC            Action = "users.oidc.start"
+	ActionOIDCCallback         Action = "users.oidc.callback"
+	ActionAcceptInvite         Action = "users.invites.accept"
+
+	// User actions.
+	ActionCreateUser      Action = "users.create"
+	ActionGetUser         Action = "users.get"
+	ActionPutUser         Action = "users.put"
+	ActionListUsers       Action = "users.list"
+	ActionSetUserRole     Action = "users.setrole"
+	ActionLogout          Action = "users.logout"
+	ActionUnlockUser      Action = "users.unlock"
+	ActionLockUser        Action = "users.lock"
+	ActionDisableUser     Action = "users.disable"
+	ActionEnableUser      Action = "users.enable"
+	ActionDeleteUser      Action = "users.delete"
+	ActionFindUser        Action = "users.find"
+	ActionImpersonateUser Action = "users.impersonate"
+	ActionEnrollTOTP      Action = "users.totp.enroll"
+	ActionConfirmTOTP     Action = "users.totp.confirm"
+	ActionChangeEmail     Action = "users.email.change"
+	ActionConfirmEmail    Action = "users.email.confirm"
+	ActionListInvites     Action = "users.invites.list"
+	ActionResendInvite    Action = "users.invites.resend"
+	ActionRevokeInvite    Action = "users.invites.revoke"
+	ActionImportUsers     Action = "users.import"
+	ActionExportUsers     Action = "users.export"
+
+	// ActionManageUsers is not bound to a route. It is checked by the user
+	// service when a caller reads or modifies a user other than themselves.
+	ActionManageUsers Action = "users.manage"
+
+	// API key actions.
+	ActionCreateAPIKey Action = "apikeys.create"
+	ActionListAPIKeys  Action = "apikeys.list"
+	ActionRevokeAPIKey Action = "apikeys.revoke"
+
+	// Audit log actions.
+	ActionListAuditLog Action = "audit.list"
+
+	// Grid data actions.
+	ActionImportGridData       Action = "data.grid.import"
+	ActionListGridBatches      Action = "data.grid.list"
+	ActionGetGridImportReport  Action = "data.grid.report"
+	ActionDeleteGridBatch      Action = "data.grid.delete"
+	ActionProcessGridBatch     Action = "data.grid.process"
+	ActionListBillingBatches   Action = "data.billing.list"
+	ActionGetBillingDataCSV    Action = "data.billing.csv"
+	ActionInitializeCustomers  Action = "data.customers.initialize"
+	ActionUpdateAllCustomers   Action = "data.customers.sync"
+	ActionListCustomers        Action = "data.customers.list"
+	ActionGetCustomerDetail    Action = "data.customers.get"
+	ActionUpdateCustomerDetail Action = "data.customers.update"
+	ActionInitializeInvoices   Action = "data.invoices.initialize"
+	ActionSyncInvoices         Action = "data.invoices.sync"
+	ActionListInvoices         Action = "data.invoices.list"
+	ActionGetInvoice           Action = "data.invoices.get"
+	ActionSyncMeterData        Action = "data.meters.sync"
+	ActionInitializeMeterData  Action = "data.meters.initialize"
 )
 
+// publicActions can be performed without an authenticated user.
+var publicActions = map[Action]bool{
+	ActionLogin:                true,
+	ActionRequestPasswordReset: true,
+	ActionResetPassword:        true,
+	ActionRefreshToken:         true,
+	ActionLoginTOTP:            true,
+	ActionRequestMagicLink:     true,
+	ActionLoginMagicLink:       true,
+	ActionStartOIDC:            true,
+	ActionOIDCCallback:         true,
+	ActionAcceptInvite:         true,
+}
+
+// Public reports whether the action can be performed without an authenticated
+// user.
+func (act Action) Public() bool {
+	return publicActions[act]
+}
+
+// viewerActions are the read-only actions every role is allowed to perform.
+var viewerActions = []Action{
+	ActionGetUser,
+	ActionPutUser,
+	ActionLogout,
+	ActionEnrollTOTP,
+	ActionConfirmTOTP,
+	ActionChangeEmail,
+	ActionConfirmEmail,
+	ActionListGridBatches,
+	ActionGetGridImportReport,
+	ActionListBillingBatches,
+	ActionGetBillingDataCSV,
+	ActionListCustomers,
+	ActionGetCustomerDetail,
+	ActionListInvoices,
+	ActionGetInvoice,
+}
+
+// operatorActions are the day-to-day data operations, in addition to the
+// viewer actions.
+var operatorActions = []Action{
+	ActionImportGridData,
+	ActionDeleteGridBatch,
+	ActionProcessGridBatch,
+	ActionUpdateAllCustomers,
+	ActionUpdateCustomerDetail,
+	ActionSyncInvoices,
+	ActionSyncMeterData,
+}
+
+// adminActions are user management and one-off initialization operations, in
+// addition to the operator actions.
+var adminActions = []Action{
+	ActionCreateUser,
+	ActionListUsers,
+	ActionSetUserRole,
+	ActionUnlockUser,
+	ActionLockUser,
+	ActionDisableUser,
+	ActionEnableUser,
+	ActionDeleteUser,
+	ActionFindUser,
+	ActionImpersonateUser,
+	ActionListInvites,
+	ActionResendInvite,
+	ActionRevokeInvite,
+	ActionImportUsers,
+	ActionExportUsers,
+	ActionManageUsers,
+	ActionCreateAPIKey,
+	ActionListAPIKeys,
+	ActionRevokeAPIKey,
+	ActionListAuditLog,
+	ActionInitializeCustomers,
+	ActionInitializeInvoices,
+	ActionInitializeMeterData,
+}
+
+var rolePermissions = map[Role]map[Action]bool{
+	RoleViewer:   permissions(viewerActions),
+	RoleOperator: permissions(viewerActions, operatorActions),
+	RoleAdmin:    permissions(viewerActions, operatorActions, adminActions),
+}
+
+func permissions(sets ...[]Action) map[Action]bool {
+	m := make(map[Action]bool)
+	for _, set := range sets {
+		for _, act := range set {
+			m[act] = true
+		}
+	}
+	return m
+}
+
+// Can reports whether a user with the role is allowed to perform the action.
+// Public actions are allowed for every role.
+func (r Role) Can(act Action) bool {
+	if act.Public() {
+		return true
+	}
+	return rolePermissions[r][act]
+}
+
+// keyActions are the actions an API key can be scoped to: the data operations
+// that scheduled jobs and other machine clients run. Keys are not tied to a
+// user, so they can't be scoped to the actions that manage users or keys.
+var keyActions = permissions([]Action{
+	ActionImportGridData,
+	ActionListGridBatches,
+	ActionGetGridImportReport,
+	ActionDeleteGridBatch,
+	ActionProcessGridBatch,
+	ActionListBillingBatches,
+	ActionGetBillingDataCSV,
+	ActionInitializeCustomers,
+	ActionUpdateAllCustomers,
+	ActionListCustomers,
+	ActionGetCustomerDetail,
+	ActionUpdateCustomerDetail,
+	ActionInitializeInvoices,
+	ActionSyncInvoices,
+	ActionListInvoices,
+	ActionGetInvoice,
+	ActionSyncMeterData,
+	ActionInitializeMeterData,
+})
+
+// Scopable reports whether an API key can be scoped to the action.
+func (act Action) Scopable() bool {
+	return keyActions[act]
+}
+
 type AuthorizationService interface {
 	Authorize(ctx Context, act Action) error
 }
 
 type AuthorizationFunc func(ctx Context, act Action) error
+
+// Authorize implements AuthorizationService.
+func (f AuthorizationFunc) Authorize(ctx Context, act Action) error {
+	return f(ctx, act)
+}
@@ -0,0 +1,28 @@
+package cloud_test
+
+import (
+	"testing"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/assert"
+)
+
+func TestActionScopable(t *testing.T) {
+	assert := assert.New(t)
+
+	for act, want := range map[cloud.Action]bool{
+		cloud.ActionSyncInvoices:    true,
+		cloud.ActionImportGridData:  true,
+		cloud.ActionListInvoices:    true,
+		cloud.ActionImpersonateUser: false,
+		cloud.ActionPutUser:         false,
+		cloud.ActionLogout:          false,
+		cloud.ActionEnrollTOTP:      false,
+		cloud.ActionChangeEmail:     false,
+		cloud.ActionCreateAPIKey:    false,
+		cloud.ActionListAuditLog:    false,
+		cloud.ActionLogin:           false,
+	} {
+		assert.Equals(act.Scopable(), want)
+	}
+}
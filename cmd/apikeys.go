@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/service"
+	"github.com/kmhebb/serverExample/web"
+)
+
+type APIKeyService interface {
+	Create(ctx cloud.Context, req service.CreateAPIKeyRequest) (*service.CreateAPIKeyResponse, *cloud.Error)
+	List(ctx cloud.Context) (*service.ListAPIKeysResponse, *cloud.Error)
+	Revoke(ctx cloud.Context, req service.APIKeyRequest) (interface{}, *cloud.Error)
+}
+
+func RegisterAPIKeyRoutes(srv *web.Server, svc service.APIKeyService, auth service.AuthService) {
+
+	routes := map[string]web.HandlerOpts{
+		"/apikeys/create": {
+			Action: cloud.ActionCreateAPIKey,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.CreateAPIKeyRequest
+				ctx.TokenRequired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode create api key request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.CreateAPIKeyRequest)
+				return svc.Create(ctx, req)
+			},
+		},
+		"/apikeys/list": {
+			Action: cloud.ActionListAPIKeys,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				ctx.TokenRequired = true
+				return nil, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				return svc.List(ctx)
+			},
+		},
+		"/apikeys/revoke": {
+			Action: cloud.ActionRevokeAPIKey,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.APIKeyRequest
+				ctx.TokenRequired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode revoke api key request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.APIKeyRequest)
+				return svc.Revoke(ctx, req)
+			},
+		},
+	}
+
+	for path, opts := range routes {
+		opts.Authorizer = auth
+		opts.Validator = auth
+		h := web.NewHandler(opts)
+		h.Use(web.LoggingMiddleware)
+		srv.Handle(path, h)
+	}
+}
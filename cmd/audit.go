@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/service"
+	"github.com/kmhebb/serverExample/web"
+)
+
+type AuditService interface {
+	List(ctx cloud.Context, req service.ListAuditLogRequest) (*service.ListAuditLogResponse, *cloud.Error)
+}
+
+func RegisterAuditRoutes(srv *web.Server, svc service.AuditService, auth service.AuthService) {
+
+	routes := map[string]web.HandlerOpts{
+		"/audit/list": {
+			Action: cloud.ActionListAuditLog,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.ListAuditLogRequest
+				ctx.TokenRequired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode list audit log request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.ListAuditLogRequest)
+				return svc.List(ctx, req)
+			},
+		},
+	}
+
+	for path, opts := range routes {
+		opts.Authorizer = auth
+		opts.Validator = auth
+		h := web.NewHandler(opts)
+		h.Use(web.LoggingMiddleware)
+		srv.Handle(path, h)
+	}
+}
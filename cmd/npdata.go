@@ -1,9 +1,7 @@
 package cmd
 
 import (
-	"encoding/csv"
 	"encoding/json"
-	"io"
 	"net/http"
 
 	cloud "github.com/kmhebb/serverExample"
@@ -15,6 +13,7 @@ type NPDataService interface {
 	// Methods implemented in API and in service:
 	ImportGridData(ctx cloud.Context, req service.ImportGridDataRequest) (interface{}, *cloud.Error)
 	DeleteBatchOfGridData(ctx cloud.Context, req service.ProcessBatchGridDataRequest) (interface{}, *cloud.Error)
+	GetGridImportReport(ctx cloud.Context, req service.GridImportReportRequest) (*service.GridImportReportResponse, *cloud.Error)
 	GetListOfGridBatches(ctx cloud.Context, req service.GridBatchListRequest) (interface{}, *cloud.Error)
 	GetBillingDataList(ctx cloud.Context, req service.GetBillingDataListRequest) (interface{}, *cloud.Error)
 	GetInvoiceDataForDisplay(ctx cloud.Context, req service.GetInvoiceDataRequest) (interface{}, *cloud.Error)
@@ -35,46 +34,69 @@ type NPDataService interface {
 	// Does not have an API implementation, either a package procedure or may be for some kind of automated chronjob operation.
 
 	SyncInvoiceDataFromUB(ctx cloud.Context) (interface{}, *cloud.Error)
-	ValidateUserAccess(ctx cloud.Context) *cloud.Error
 
 	// Unimplemented at this time
 	PullCustomerDataFromUB(ctx cloud.Context) (interface{}, *cloud.Error)
 }
 
-func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService) {
+// gridUploadRequest is an ImportGridDataRequest whose file is still in the
+// body of the request.
+type gridUploadRequest struct {
+	service.ImportGridDataRequest
+	r *http.Request
+}
+
+func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService, auth service.AuthService) {
 
 	routes := map[string]web.HandlerOpts{
 		// GRID ENDPOINTS
 		"/data/ImportGridData": {
+			Action: cloud.ActionImportGridData,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
-				var request service.ImportGridDataRequest
-				cr := csv.NewReader(r.Body)
-				for {
-					var gd service.GridData
-					var err error
-					gd, err = cr.Read()
-					if err == io.EOF {
-						break
-					}
-					if err != nil {
-						return nil, cloud.NewError(cloud.ErrOpts{
-							Kind:    cloud.ErrKindBadRequest,
-							Message: "failed to read csv data",
-							Cause:   err,
-						}) //fmt.Errorf("decode import request: %w", err)
-					}
-					request.GD = append(request.GD, gd)
+				// The body is left unread until the request is authorized.
+				return gridUploadRequest{
+					ImportGridDataRequest: service.ImportGridDataRequest{
+						Layout: r.URL.Query().Get("layout"),
+						Rule:   r.URL.Query().Get("rule"),
+						Mode:   r.URL.Query().Get("mode"),
+					},
+					r: r,
+				}, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(gridUploadRequest)
+				// The file is read by the import as it is streamed in, rather
+				// than decoded here in full.
+				f, name, e := web.UploadedFile(req.r, "file", svc.GridImport.UploadLimit())
+				if e != nil {
+					return nil, e
+				}
+				req.File, req.Filename = f, name
+				return svc.ImportGridData(ctx, req.ImportGridDataRequest)
+			},
+		},
+		"/data/GetGridImportReport": {
+			Action: cloud.ActionGetGridImportReport,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				ctx.TokenRequired = true
+				var request service.GridImportReportRequest
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode grid import report request",
+						Cause:   err,
+					})
 				}
-				//fmt.Printf("data from reader: %+v", request.GD)
 				return request, nil
 			},
 			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
-				req := request.(service.ImportGridDataRequest)
-				return svc.ImportGridData(ctx, req)
+				req := request.(service.GridImportReportRequest)
+				return svc.GetGridImportReport(ctx, req)
 			},
 		},
 		"/data/ListGridBatches": {
+			Action: cloud.ActionListGridBatches,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
 				var request service.GridBatchListRequest
@@ -93,6 +115,7 @@ func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService) {
 			},
 		},
 		"/data/DeleteGridBatch": {
+			Action: cloud.ActionDeleteGridBatch,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
 				var request service.ProcessBatchGridDataRequest
@@ -113,6 +136,7 @@ func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService) {
 
 		// CUSTOMER ENDPOINTS
 		"/data/InitializeCustomers": {
+			Action: cloud.ActionInitializeCustomers,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
 				var request service.UBRequest
@@ -127,6 +151,7 @@ func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService) {
 			},
 		},
 		"/data/UpdateAllCustomerData": {
+			Action: cloud.ActionUpdateAllCustomers,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
 				var request service.UBRequest
@@ -142,6 +167,7 @@ func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService) {
 			},
 		},
 		"/data/ListCustomers": {
+			Action: cloud.ActionListCustomers,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
 				var request service.UBRequest
@@ -156,6 +182,7 @@ func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService) {
 			},
 		},
 		"/data/GetCustomerDetail": {
+			Action: cloud.ActionGetCustomerDetail,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
 				var request service.InvoiceListRequest
@@ -174,6 +201,7 @@ func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService) {
 			},
 		},
 		"/data/UpdateCustomerDetail": {
+			Action: cloud.ActionUpdateCustomerDetail,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
 				var request service.UpdateCustomerDetailRequest
@@ -194,6 +222,7 @@ func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService) {
 
 		// INVOICE ENDPOINTS
 		"/data/InitializeInvoices": {
+			Action: cloud.ActionInitializeInvoices,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
 				var request service.InitializeUtilibillRequest
@@ -212,6 +241,7 @@ func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService) {
 			},
 		},
 		"/data/SyncInvoiceDataFromUB": {
+			Action: cloud.ActionSyncInvoices,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
 				var request service.UBRequest
@@ -226,6 +256,7 @@ func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService) {
 			},
 		},
 		"/data/listCustomerInvoices": {
+			Action: cloud.ActionListInvoices,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
 				var request service.InvoiceListRequest
@@ -244,6 +275,7 @@ func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService) {
 			},
 		},
 		"/data/invoice": {
+			Action: cloud.ActionGetInvoice,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
 				var request service.GetInvoiceDataRequest
@@ -264,6 +296,7 @@ func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService) {
 
 		// BILLING ENDPOINTS
 		"/data/ProcessGridBatchForBilling": {
+			Action: cloud.ActionProcessGridBatch,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
 				var request service.ProcessBatchGridDataRequest
@@ -282,6 +315,7 @@ func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService) {
 			},
 		},
 		"/data/ListBillingDataBatches": {
+			Action: cloud.ActionListBillingBatches,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
 				var request service.GetBillingDataListRequest
@@ -300,6 +334,7 @@ func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService) {
 			},
 		},
 		"/data/GetBillingDataCSV": {
+			Action: cloud.ActionGetBillingDataCSV,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
 				var request service.GetBillingDataRequest
@@ -318,6 +353,7 @@ func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService) {
 			},
 		},
 		"/data/SyncMeterData": {
+			Action: cloud.ActionSyncMeterData,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
 				var request service.UBRequest
@@ -333,6 +369,7 @@ func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService) {
 			},
 		},
 		"/data/InitMeterData": {
+			Action: cloud.ActionInitializeMeterData,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
 				var request service.InitializeMeterDataRequest
@@ -354,6 +391,9 @@ func RegisterDataServiceRoutes(srv *web.Server, svc service.NPDataService) {
 	}
 
 	for path, opts := range routes {
+		opts.Authorizer = auth
+		opts.Validator = auth
+		opts.KeyAuthenticator = auth
 		h := web.NewHandler(opts)
 		h.Use(web.LoggingMiddleware)
 		srv.Handle(path, h)
@@ -3,7 +3,6 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
@@ -17,10 +16,12 @@ import (
 	"github.com/kmhebb/serverExample/internal/service"
 	"github.com/kmhebb/serverExample/lib/email"
 	"github.com/kmhebb/serverExample/lib/email/slack"
+	"github.com/kmhebb/serverExample/lib/oidc"
 	"github.com/kmhebb/serverExample/lib/random"
 	"github.com/kmhebb/serverExample/lib/random/password"
 	"github.com/kmhebb/serverExample/lib/token"
 	"github.com/kmhebb/serverExample/log"
+	"github.com/kmhebb/serverExample/migrations"
 	"github.com/kmhebb/serverExample/pg"
 	"github.com/kmhebb/serverExample/web"
 )
@@ -32,7 +33,6 @@ func main() {
 	if err := cfg.Load(os.Args[1:]); err != nil {
 		panic(err)
 	}
-	fmt.Printf("config: %#+v\n", cfg)
 	if err := Run(cfg); err != nil {
 		panic(err)
 	}
@@ -75,24 +75,32 @@ func Run(cfg cloud.Config) error {
 	var emails email.Service
 	switch cfg.Environ {
 	case "local":
-		token.SetSigningKey(cfg.SigningKey)
+		if err := setSigningKeys(cfg); err != nil {
+			return err
+		}
 		password.Register(random.Passphrase)
-		emails = slack.New(cfg.SlackToken, logger)
+		emails = slack.New(cfg.SlackToken, cfg.AppURL, logger)
 		utilibill.SetCredentials(cfg.UBusername, cfg.UBpwd)
 	case "staging":
 		//logger.Log(ctx, log.Info, "Setting signing key")
-		token.SetSigningKey(cfg.SigningKey)
+		if err := setSigningKeys(cfg); err != nil {
+			return err
+		}
 		password.Register(random.Passphrase)
-		emails = slack.New(cfg.SlackToken, logger)
+		emails = slack.New(cfg.SlackToken, cfg.AppURL, logger)
 		utilibill.SetCredentials(cfg.UBusername, cfg.UBpwd)
 	case "production":
-		token.SetSigningKey(cfg.SigningKey)
+		if err := setSigningKeys(cfg); err != nil {
+			return err
+		}
 		password.Register(random.Passphrase)
-		emails = slack.New(cfg.SlackToken, logger)
+		emails = slack.New(cfg.SlackToken, cfg.AppURL, logger)
 		utilibill.SetCredentials(cfg.UBusername, cfg.UBpwd)
 
 		// //logger.Log(ctx, log.Info, "Setting signing key")
-		// token.SetSigningKey(cfg.SigningKey)
+		// if err := setSigningKeys(cfg); err != nil {
+		// 	return err
+		// }
 		// password.Register(random.Passphrase)
 		// emails = sendgrid.NewService(
 		// 	cfg.SendGridKey,
@@ -117,6 +125,15 @@ func Run(cfg cloud.Config) error {
 		}) //fmt.Errorf("Run: %w", err)
 	}
 
+	// We bring the schema up to date before any service touches it.
+	if err := db.Migrate(ctx, migrations.FS); err != nil {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "failed to migrate database",
+			Cause:   err,
+		})
+	}
+
 	// We add a circuit breaker that will cause the server to start serving 503s
 	// again if we lose connection to the database. The server state will also
 	// move to "live" so we pick it up on monitoring.
@@ -129,19 +146,78 @@ func Run(cfg cloud.Config) error {
 	// 	return emails.TestConnection()
 	// })
 
+	auth := service.AuthService{
+		DB: db,
+		L:  logger,
+	}
+
+	audits := service.AuditService{
+		DB: db,
+		L:  logger,
+	}
+	cmd.RegisterAuditRoutes(srv, audits, auth)
+
+	breached, err := loadBreachedPasswords(cfg.BreachedPasswords)
+	if err != nil {
+		return err
+	}
+
+	var provider *oidc.Provider
+	if cfg.OIDCIssuer != "" {
+		provider, err = oidc.Discover(ctx, oidc.Config{
+			Issuer:       cfg.OIDCIssuer,
+			ClientID:     cfg.OIDCClientID,
+			ClientSecret: cfg.OIDCClientSecret,
+			RedirectURL:  cfg.OIDCRedirectURL,
+		})
+		if err != nil {
+			return cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindExternal,
+				Message: "failed to discover oidc provider",
+				Cause:   err,
+			})
+		}
+	}
+
 	us := service.UserService{
 		DB: db,
 		L:  logger,
 		Em: emails,
+		Az: auth,
+		Lockout: service.LockoutPolicy{
+			Threshold:   cfg.LockoutThreshold,
+			Duration:    cfg.LockoutDuration,
+			MaxDuration: cfg.LockoutMaxDuration,
+		},
+		Password: service.PasswordPolicy{
+			MinLength: cfg.PasswordMinLength,
+			History:   cfg.PasswordHistory,
+			Breached:  breached,
+		},
+		OIDC: provider,
+		Au:   audits,
 	}
-	cmd.RegisterUserRoutes(srv, us)
+	cmd.RegisterUserRoutes(srv, us, auth)
 
 	ds := service.NPDataService{
 		DB: db,
 		L:  logger,
 		Em: emails,
+		GridImport: service.GridImportPolicy{
+			Rule:          cfg.GridImportRule,
+			MaxUploadSize: int64(cfg.GridUploadMaxSize),
+			UploadDir:     cfg.GridUploadDir,
+		},
+		Au: audits,
+	}
+	cmd.RegisterDataServiceRoutes(srv, ds, auth)
+
+	ks := service.APIKeyService{
+		DB: db,
+		L:  logger,
+		Au: audits,
 	}
-	cmd.RegisterDataServiceRoutes(srv, ds)
+	cmd.RegisterAPIKeyRoutes(srv, ks, auth)
 
 	// Finally we're ready to start accepting requests
 	log.Info("listening", log.Fields{
@@ -159,3 +235,90 @@ func Run(cfg cloud.Config) error {
 	// Finally we manually shut down our server before exiting
 	return srv.Stop()
 }
+
+// setSigningKeys builds the token keyring from the configuration. The
+// configured signing key signs new tokens, and retired keys keep verifying
+// tokens until the grace period after the last rotation has passed.
+func setSigningKeys(cfg cloud.Config) error {
+	kid := cfg.SigningKeyID
+	if kid == "" {
+		kid = token.DefaultKeyID
+	}
+	active, err := token.NewKey(kid, cfg.SigningKey)
+	if err != nil {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "failed to load signing key",
+			Cause:   err,
+		})
+	}
+	kr := token.NewKeyring(active)
+
+	retired, err := token.ParseKeys(cfg.RetiredSigningKeys)
+	if err != nil {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "failed to parse retired signing keys",
+			Cause:   err,
+		})
+	}
+
+	// The grace period runs from the rotation, not from each restart, so the
+	// rotation time is required as soon as there are retired keys.
+	if len(retired) == 0 {
+		token.SetKeyring(kr)
+		return nil
+	}
+	if cfg.SigningKeyRotatedAt == "" {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "signing key rotation time is required with retired signing keys",
+		})
+	}
+	rotatedAt, err := time.Parse(time.RFC3339, cfg.SigningKeyRotatedAt)
+	if err != nil {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "failed to parse signing key rotation time",
+			Cause:   err,
+		})
+	}
+	// By default retired keys are kept for as long as the longest lived token.
+	grace := cfg.SigningKeyGrace
+	if grace == 0 {
+		grace = token.OverrideExpiration
+	}
+	for _, k := range retired {
+		kr.Retire(k, rotatedAt.Add(grace))
+	}
+
+	token.SetKeyring(kr)
+	return nil
+}
+
+// loadBreachedPasswords reads the list of passwords users may not choose. No
+// file means no list.
+func loadBreachedPasswords(path string) (service.BreachedPasswords, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "failed to open breached passwords file",
+			Cause:   err,
+		})
+	}
+	defer f.Close()
+
+	b, err := service.LoadBreachedPasswords(f)
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "failed to load breached passwords",
+			Cause:   err,
+		})
+	}
+	return b, nil
+}
@@ -1,8 +1,10 @@
 package cmd
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 
 	cloud "github.com/kmhebb/serverExample"
@@ -19,29 +21,53 @@ type UserService interface {
 	Put(ctx cloud.Context, req service.PutUserRequest) *cloud.Error
 	RequestPasswordReset(ctx cloud.Context, req service.UserRequest) *cloud.Error
 	ResetPassword(ctx cloud.Context, req service.ResetPasswordRequest) *cloud.Error
-	ListUsers(ctx cloud.Context) ([]*cloud.User, *cloud.Error)
+	ListUsers(ctx cloud.Context, req service.ListUsersRequest) (interface{}, *cloud.Error)
+	SetUserRole(ctx cloud.Context, req service.SetUserRoleRequest) (interface{}, *cloud.Error)
+	Refresh(ctx cloud.Context, req service.RefreshTokenRequest) (service.LoginUserResponse, *cloud.Error)
+	Logout(ctx cloud.Context, req service.RefreshTokenRequest) (interface{}, *cloud.Error)
+	UnlockUser(ctx cloud.Context, req service.GetUserRequest) (interface{}, *cloud.Error)
+	LockUser(ctx cloud.Context, req service.GetUserRequest) (interface{}, *cloud.Error)
+	DisableUser(ctx cloud.Context, req service.GetUserRequest) (interface{}, *cloud.Error)
+	EnableUser(ctx cloud.Context, req service.GetUserRequest) (interface{}, *cloud.Error)
+	DeleteUser(ctx cloud.Context, req service.GetUserRequest) (interface{}, *cloud.Error)
+	Find(ctx cloud.Context, req service.UserRequest) (*service.GetUserResponse, *cloud.Error)
+	Impersonate(ctx cloud.Context, req service.GetUserRequest) (*service.ImpersonateResponse, *cloud.Error)
+	EnrollTOTP(ctx cloud.Context) (*service.EnrollTOTPResponse, *cloud.Error)
+	ConfirmTOTP(ctx cloud.Context, req service.ConfirmTOTPRequest) (*service.ConfirmTOTPResponse, *cloud.Error)
+	LoginTOTP(ctx cloud.Context, req service.LoginTOTPRequest) (service.LoginUserResponse, *cloud.Error)
+	ValidateEmail(ctx cloud.Context, req service.UserRequest) (interface{}, *cloud.Error)
+	ConfirmValidation(ctx cloud.Context, req service.ConfirmValidationRequest) (interface{}, *cloud.Error)
+	RequestMagicLink(ctx cloud.Context, req service.UserRequest) (interface{}, *cloud.Error)
+	LoginMagicLink(ctx cloud.Context) (service.LoginUserResponse, *cloud.Error)
+	StartOIDC(ctx cloud.Context) (*service.StartOIDCResponse, *cloud.Error)
+	OIDCCallback(ctx cloud.Context, req service.OIDCCallbackRequest) (service.LoginUserResponse, *cloud.Error)
+	AcceptInvite(ctx cloud.Context, req service.AcceptInviteRequest) (service.LoginUserResponse, *cloud.Error)
+	ListInvites(ctx cloud.Context) (*service.ListInvitesResponse, *cloud.Error)
+	ResendInvite(ctx cloud.Context, req service.InviteRequest) (interface{}, *cloud.Error)
+	RevokeInvite(ctx cloud.Context, req service.InviteRequest) (interface{}, *cloud.Error)
+	ImportUsers(ctx cloud.Context, req service.ImportUsersRequest) (*service.ImportUsersResponse, *cloud.Error)
+	ExportUsers(ctx cloud.Context, req service.ExportUsersRequest) ([][]string, *cloud.Error)
 
 	// Internal procedure implmented in the service.
 	UpdateLastActivity(ctx cloud.Context, req service.GetUserRequest) *cloud.Error
 	ValidateUserAuth(ctx cloud.Context) *cloud.Error
+}
 
-	// Procedures created but unimplemented in the external API.
-	ConfirmValidation(ctx cloud.Context, req service.ConfirmValidationRequest) (interface{}, *cloud.Error)
-	ValidateEmail(ctx cloud.Context, req service.UserRequest) (interface{}, *cloud.Error)
-
-	// Unimplemented procedures of the service, held for user management development
-	DisableUser(ctx cloud.Context, req service.UserRequest) *cloud.Error
-	EnableUser(ctx cloud.Context, req service.UserRequest) *cloud.Error
-	Find(ctx cloud.Context, req service.UserRequest) (*service.GetUserResponse, *cloud.Error)
+// userImportRequest is an ImportUsersRequest whose records are still in the
+// body of the request.
+type userImportRequest struct {
+	service.ImportUsersRequest
+	r *http.Request
 }
 
-func RegisterUserRoutes(srv *web.Server, svc service.UserService) {
+func RegisterUserRoutes(srv *web.Server, svc service.UserService, auth service.AuthService) {
 
 	routes := map[string]web.HandlerOpts{
 		"/users/create": {
+			Action: cloud.ActionCreateUser,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				var request service.CreateNewUserRequest
-				//ctx.TokenRequired = true
+				ctx.TokenRequired = true
 				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 					return nil, cloud.NewError(cloud.ErrOpts{
 						Kind:    cloud.ErrKindBadRequest,
@@ -57,6 +83,7 @@ func RegisterUserRoutes(srv *web.Server, svc service.UserService) {
 			},
 		},
 		"/users/get": {
+			Action: cloud.ActionGetUser,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				var request service.GetUserRequest
 				ctx.TokenRequired = true
@@ -76,6 +103,7 @@ func RegisterUserRoutes(srv *web.Server, svc service.UserService) {
 			},
 		},
 		"/users/login": {
+			Action: cloud.ActionLogin,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				var request service.LoginUserRequest
 				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -93,7 +121,298 @@ func RegisterUserRoutes(srv *web.Server, svc service.UserService) {
 				return svc.Login(ctx, req)
 			},
 		},
+		"/users/login/totp": {
+			Action: cloud.ActionLoginTOTP,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.LoginTOTPRequest
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode totp login request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.LoginTOTPRequest)
+				return svc.LoginTOTP(ctx, req)
+			},
+		},
+		"/users/magiclink": {
+			Action: cloud.ActionRequestMagicLink,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.UserRequest
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode magic link request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.UserRequest)
+				return svc.RequestMagicLink(ctx, req)
+			},
+		},
+		"/users/login/magiclink": {
+			Action: cloud.ActionLoginMagicLink,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				// The link carries its token in the conf query parameter.
+				ctx.ConfTokenReqired = true
+				return nil, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				return svc.LoginMagicLink(ctx)
+			},
+		},
+		"/users/oidc/start": {
+			Action: cloud.ActionStartOIDC,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				return nil, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				return svc.StartOIDC(ctx)
+			},
+		},
+		"/users/oidc/callback": {
+			Action: cloud.ActionOIDCCallback,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				// The provider sends the user back with the result in the query.
+				q := r.URL.Query()
+				return service.OIDCCallbackRequest{
+					Code:             q.Get("code"),
+					State:            q.Get("state"),
+					Error:            q.Get("error"),
+					ErrorDescription: q.Get("error_description"),
+				}, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.OIDCCallbackRequest)
+				return svc.OIDCCallback(ctx, req)
+			},
+		},
+		"/users/invites/accept": {
+			Action: cloud.ActionAcceptInvite,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				// The invite link carries its token in the conf query parameter.
+				var request service.AcceptInviteRequest
+				ctx.ConfTokenReqired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode accept invite request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.AcceptInviteRequest)
+				return svc.AcceptInvite(ctx, req)
+			},
+		},
+		"/users/invites/list": {
+			Action: cloud.ActionListInvites,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				ctx.TokenRequired = true
+				return nil, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				return svc.ListInvites(ctx)
+			},
+		},
+		"/users/invites/resend": {
+			Action: cloud.ActionResendInvite,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.InviteRequest
+				ctx.TokenRequired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode resend invite request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.InviteRequest)
+				return svc.ResendInvite(ctx, req)
+			},
+		},
+		"/users/invites/revoke": {
+			Action: cloud.ActionRevokeInvite,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.InviteRequest
+				ctx.TokenRequired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode revoke invite request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.InviteRequest)
+				return svc.RevokeInvite(ctx, req)
+			},
+		},
+		"/users/import": {
+			Action: cloud.ActionImportUsers,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				ctx.TokenRequired = true
+				// The body is left unread until the request is authorized.
+				return userImportRequest{
+					ImportUsersRequest: service.ImportUsersRequest{Mode: r.URL.Query().Get("mode")},
+					r:                  r,
+				}, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(userImportRequest)
+				records, e := importRecords(req.r)
+				if e != nil {
+					return nil, e
+				}
+				req.Records = records
+				return svc.ImportUsers(ctx, req.ImportUsersRequest)
+			},
+		},
+		"/users/export": {
+			Action: cloud.ActionExportUsers,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.ExportUsersRequest
+				ctx.TokenRequired = true
+				// The filters are optional, so an empty body exports every user.
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode export users request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.ExportUsersRequest)
+				records, e := svc.ExportUsers(ctx, req)
+				if e != nil {
+					return nil, e
+				}
+				return web.CSV{Filename: "users.csv", Records: records}, nil
+			},
+			Encoder: web.EncodeCSV,
+		},
+		"/users/totp/enroll": {
+			Action: cloud.ActionEnrollTOTP,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				ctx.TokenRequired = true
+				return nil, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				return svc.EnrollTOTP(ctx)
+			},
+		},
+		"/users/totp/confirm": {
+			Action: cloud.ActionConfirmTOTP,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.ConfirmTOTPRequest
+				ctx.TokenRequired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode confirm totp request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.ConfirmTOTPRequest)
+				return svc.ConfirmTOTP(ctx, req)
+			},
+		},
+		"/users/email/change": {
+			Action: cloud.ActionChangeEmail,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.UserRequest
+				ctx.TokenRequired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode change email request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.UserRequest)
+				return svc.ValidateEmail(ctx, req)
+			},
+		},
+		"/users/email/confirm": {
+			Action: cloud.ActionConfirmEmail,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.ConfirmValidationRequest
+				ctx.TokenRequired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode confirm email request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.ConfirmValidationRequest)
+				return svc.ConfirmValidation(ctx, req)
+			},
+		},
+		"/users/refresh": {
+			Action: cloud.ActionRefreshToken,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.RefreshTokenRequest
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode refresh token request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.RefreshTokenRequest)
+				return svc.Refresh(ctx, req)
+			},
+		},
+		"/users/logout": {
+			Action: cloud.ActionLogout,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.RefreshTokenRequest
+				ctx.TokenRequired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode logout request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.RefreshTokenRequest)
+				return svc.Logout(ctx, req)
+			},
+		},
 		"/users/put": {
+			Action: cloud.ActionPutUser,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				ctx.TokenRequired = true
 				var request service.PutUserRequest
@@ -112,6 +431,7 @@ func RegisterUserRoutes(srv *web.Server, svc service.UserService) {
 			},
 		},
 		"/users/requestpasswordreset": {
+			Action: cloud.ActionRequestPasswordReset,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				var request service.UserRequest
 				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -129,12 +449,27 @@ func RegisterUserRoutes(srv *web.Server, svc service.UserService) {
 			},
 		},
 		"/users/resetpassword": {
+			Action: cloud.ActionResetPassword,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				var request service.ResetPasswordRequest
 				ctx.ConfTokenReqired = true
-				// if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-				// 	return nil, fmt.Errorf("decode user password reset request: %w", err)
-				// }
+				// Following the link shows the form, which posts back here with the token in a hidden field.
+				if r.Method == http.MethodPost {
+					if err := r.ParseForm(); err != nil {
+						return nil, cloud.NewError(cloud.ErrOpts{
+							Kind:    cloud.ErrKindBadRequest,
+							Message: "failed to decode password reset form",
+							Cause:   err,
+						})
+					}
+					if conf := r.PostFormValue("conf"); conf != "" {
+						ctx.ConfirmationToken = conf
+					}
+					request.Password = r.PostFormValue("password")
+					request.Confirm = r.PostFormValue("confirm")
+					request.Submitted = true
+				}
+				request.Token = ctx.ConfirmationToken
 				return request, nil
 			},
 			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
@@ -145,9 +480,10 @@ func RegisterUserRoutes(srv *web.Server, svc service.UserService) {
 			ErrEncoder: web.EncodeErrorHTML,
 		},
 		"/users/listusers": {
+			Action: cloud.ActionListUsers,
 			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 				var request service.ListUsersRequest
-				//ctx.TokenRequired = true
+				ctx.TokenRequired = true
 				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 					return nil, cloud.NewError(cloud.ErrOpts{
 						Kind:    cloud.ErrKindBadRequest,
@@ -162,6 +498,158 @@ func RegisterUserRoutes(srv *web.Server, svc service.UserService) {
 				return svc.ListUsers(ctx, req)
 			},
 		},
+		"/users/setrole": {
+			Action: cloud.ActionSetUserRole,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.SetUserRoleRequest
+				ctx.TokenRequired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode set user role request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.SetUserRoleRequest)
+				return svc.SetUserRole(ctx, req)
+			},
+		},
+		"/users/unlock": {
+			Action: cloud.ActionUnlockUser,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.GetUserRequest
+				ctx.TokenRequired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode unlock user request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.GetUserRequest)
+				return svc.UnlockUser(ctx, req)
+			},
+		},
+		"/users/lock": {
+			Action: cloud.ActionLockUser,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.GetUserRequest
+				ctx.TokenRequired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode lock user request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.GetUserRequest)
+				return svc.LockUser(ctx, req)
+			},
+		},
+		"/users/disable": {
+			Action: cloud.ActionDisableUser,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.GetUserRequest
+				ctx.TokenRequired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode disable user request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.GetUserRequest)
+				return svc.DisableUser(ctx, req)
+			},
+		},
+		"/users/enable": {
+			Action: cloud.ActionEnableUser,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.GetUserRequest
+				ctx.TokenRequired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode enable user request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.GetUserRequest)
+				return svc.EnableUser(ctx, req)
+			},
+		},
+		"/users/delete": {
+			Action: cloud.ActionDeleteUser,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.GetUserRequest
+				ctx.TokenRequired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode delete user request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.GetUserRequest)
+				return svc.DeleteUser(ctx, req)
+			},
+		},
+		"/users/find": {
+			Action: cloud.ActionFindUser,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.UserRequest
+				ctx.TokenRequired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode find user request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.UserRequest)
+				return svc.Find(ctx, req)
+			},
+		},
+		"/users/impersonate": {
+			Action: cloud.ActionImpersonateUser,
+			Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+				var request service.GetUserRequest
+				ctx.TokenRequired = true
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+					return nil, cloud.NewError(cloud.ErrOpts{
+						Kind:    cloud.ErrKindBadRequest,
+						Message: "failed to decode impersonate user request",
+						Cause:   err,
+					})
+				}
+				return request, nil
+			},
+			Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				req := request.(service.GetUserRequest)
+				return svc.Impersonate(ctx, req)
+			},
+		},
 		// "/users/find": {
 		// 	Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
 		// 		var request service.UserRequest
@@ -182,8 +670,37 @@ func RegisterUserRoutes(srv *web.Server, svc service.UserService) {
 	}
 
 	for path, opts := range routes {
+		opts.Authorizer = auth
+		opts.Validator = auth
+		opts.KeyAuthenticator = auth
 		h := web.NewHandler(opts)
 		h.Use(web.LoggingMiddleware)
 		srv.Handle(path, h)
 	}
 }
+
+// importRecords reads the records of a user import from the body of r, which
+// can be at most service.MaxImportSize bytes. Reading stops once there are more
+// records than an import can create, which the service then rejects.
+func importRecords(r *http.Request) ([][]string, *cloud.Error) {
+	cr := csv.NewReader(http.MaxBytesReader(nil, r.Body, service.MaxImportSize))
+	// Rows are checked against the header by the service, which reports
+	// short rows along with the rest of their problems.
+	cr.FieldsPerRecord = -1
+	var records [][]string
+	for len(records) <= service.MaxImportUsers+1 {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindBadRequest,
+				Message: "failed to read csv data",
+				Cause:   err,
+			})
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
@@ -1,26 +1,46 @@
 package cloud
 
 import (
+	"time"
+
 	"github.com/kmhebb/serverExample/lib/flag"
 	"github.com/kmhebb/serverExample/lib/os"
 )
 
 type Config struct {
-	Environ         string
-	Addr            string
-	CLI             bool
-	DatabaseURL     string
-	DatabaseVersion int
-	Debug           bool
-	Shout           bool
-	SigningKey      string
-	SlackToken      string
-	SendGridKey     string
-	SendGridFrom    string
-	SendGridEmail   string
-	SendGridBaseUrl string
-	UBusername      string
-	UBpwd           string
+	Environ             string
+	Addr                string
+	CLI                 bool
+	DatabaseURL         string
+	DatabaseVersion     int
+	Debug               bool
+	Shout               bool
+	SigningKey          string
+	SigningKeyID        string
+	RetiredSigningKeys  string
+	SigningKeyRotatedAt string
+	SigningKeyGrace     time.Duration
+	LockoutThreshold    int
+	LockoutDuration     time.Duration
+	LockoutMaxDuration  time.Duration
+	PasswordMinLength   int
+	PasswordHistory     int
+	BreachedPasswords   string
+	OIDCIssuer          string
+	OIDCClientID        string
+	OIDCClientSecret    string
+	OIDCRedirectURL     string
+	GridImportRule      string
+	GridUploadMaxSize   int
+	GridUploadDir       string
+	SlackToken          string
+	AppURL              string
+	SendGridKey         string
+	SendGridFrom        string
+	SendGridEmail       string
+	SendGridBaseUrl     string
+	UBusername          string
+	UBpwd               string
 }
 
 func (cfg *Config) Load(args []string) error {
@@ -46,7 +66,126 @@ func (cfg *Config) Load(args []string) error {
 		"sk",
 		"cloud_SIGNING_KEY",
 		os.GetStringEnv("cloud_SIGNING_KEY"),
-		"The signing key",
+		"The signing key, or @path of a PEM encoded RSA or Ed25519 private key",
+	)
+	fs.StringVar(
+		&cfg.SigningKeyID,
+		"skid",
+		"cloud_SIGNING_KEY_ID",
+		os.GetStringEnv("cloud_SIGNING_KEY_ID"),
+		"The ID of the signing key, sent in the kid header of new tokens",
+	)
+	fs.StringVar(
+		&cfg.RetiredSigningKeys,
+		"",
+		"cloud_RETIRED_SIGNING_KEYS",
+		os.GetStringEnv("cloud_RETIRED_SIGNING_KEYS"),
+		"Retired signing keys still accepted during the grace period, as kid:secret,kid:@path",
+	)
+	fs.StringVar(
+		&cfg.SigningKeyRotatedAt,
+		"",
+		"cloud_SIGNING_KEY_ROTATED_AT",
+		os.GetStringEnv("cloud_SIGNING_KEY_ROTATED_AT"),
+		"When the signing key was last rotated, in RFC 3339 format. Required with retired signing keys",
+	)
+	fs.DurationVar(
+		&cfg.SigningKeyGrace,
+		"",
+		"cloud_SIGNING_KEY_GRACE",
+		os.GetDurationEnv("cloud_SIGNING_KEY_GRACE"),
+		"How long retired signing keys are accepted after rotation",
+	)
+	fs.IntVar(
+		&cfg.LockoutThreshold,
+		"",
+		"cloud_LOCKOUT_THRESHOLD",
+		os.GetIntEnv("cloud_LOCKOUT_THRESHOLD"),
+		"Failed logins in a row before a user is locked out",
+	)
+	fs.DurationVar(
+		&cfg.LockoutDuration,
+		"",
+		"cloud_LOCKOUT_DURATION",
+		os.GetDurationEnv("cloud_LOCKOUT_DURATION"),
+		"How long the first lockout lasts, doubling with every further failed login",
+	)
+	fs.DurationVar(
+		&cfg.LockoutMaxDuration,
+		"",
+		"cloud_LOCKOUT_MAX_DURATION",
+		os.GetDurationEnv("cloud_LOCKOUT_MAX_DURATION"),
+		"The longest a user can be locked out for",
+	)
+	fs.IntVar(
+		&cfg.PasswordMinLength,
+		"",
+		"cloud_PASSWORD_MIN_LENGTH",
+		os.GetIntEnv("cloud_PASSWORD_MIN_LENGTH"),
+		"The fewest characters a new password may have",
+	)
+	fs.IntVar(
+		&cfg.PasswordHistory,
+		"",
+		"cloud_PASSWORD_HISTORY",
+		os.GetIntEnv("cloud_PASSWORD_HISTORY"),
+		"How many recent passwords may not be reused, or -1 to allow reuse",
+	)
+	fs.StringVar(
+		&cfg.BreachedPasswords,
+		"",
+		"cloud_BREACHED_PASSWORDS_FILE",
+		os.GetStringEnv("cloud_BREACHED_PASSWORDS_FILE"),
+		"A file of breached or common passwords, one per line, that may not be used",
+	)
+	fs.StringVar(
+		&cfg.OIDCIssuer,
+		"",
+		"cloud_OIDC_ISSUER",
+		os.GetStringEnv("cloud_OIDC_ISSUER"),
+		"The issuer URL of the OpenID Connect provider. OIDC logins are off if empty",
+	)
+	fs.StringVar(
+		&cfg.OIDCClientID,
+		"",
+		"cloud_OIDC_CLIENT_ID",
+		os.GetStringEnv("cloud_OIDC_CLIENT_ID"),
+		"The client ID registered with the OpenID Connect provider",
+	)
+	fs.StringVar(
+		&cfg.OIDCClientSecret,
+		"",
+		"cloud_OIDC_CLIENT_SECRET",
+		os.GetStringEnv("cloud_OIDC_CLIENT_SECRET"),
+		"The client secret registered with the OpenID Connect provider, if any",
+	)
+	fs.StringVar(
+		&cfg.OIDCRedirectURL,
+		"",
+		"cloud_OIDC_REDIRECT_URL",
+		os.GetStringEnv("cloud_OIDC_REDIRECT_URL"),
+		"Where the OpenID Connect provider sends users back to after logging in",
+	)
+	fs.StringVar(
+		&cfg.GridImportRule,
+		"",
+		"cloud_GRID_IMPORT_RULE",
+		os.GetStringEnv("cloud_GRID_IMPORT_RULE"),
+		"What to do with grid data files that have rows with errors: reject the file, or quarantine the rows",
+	)
+	fs.IntVar(
+		&cfg.GridUploadMaxSize,
+		"",
+		"cloud_GRID_UPLOAD_MAX_SIZE",
+		os.GetIntEnv("cloud_GRID_UPLOAD_MAX_SIZE"),
+		"The largest grid data file, in bytes, that can be imported",
+	)
+	fs.StringVar(
+		&cfg.GridUploadDir,
+		"",
+		"cloud_GRID_UPLOAD_DIR",
+		os.GetStringEnv("cloud_GRID_UPLOAD_DIR"),
+		"The directory imported grid data files are kept in",
 	)
 	fs.StringVar(
 		&cfg.SlackToken,
@@ -55,6 +194,13 @@ func (cfg *Config) Load(args []string) error {
 		os.GetStringEnv("cloud_SLACK_BOT_TOKEN"),
 		"The token for slack-bot",
 	)
+	fs.StringVar(
+		&cfg.AppURL,
+		"",
+		"cloud_APP_URL",
+		os.GetStringEnv("cloud_APP_URL"),
+		"The URL of the app, which invite and magic links open",
+	)
 	fs.StringVar(
 		&cfg.UBusername,
 		"ubn",
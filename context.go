@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/pborman/uuid"
 )
@@ -36,9 +37,26 @@ type Context struct {
 	// UserKey is the user id of the requesting user.
 	UserKey string
 
+	// ImpersonatorKey is the user id of the admin acting as the requesting
+	// user, if the request was made with an impersonation token. Requests are
+	// authorized as UserKey.
+	ImpersonatorKey string
+
 	// Many requests will be accompanied by a token. We will include this in the context to make it easy to access.
 	Token string
 
+	// TokenID and TokenExpiry identify the bearer token once it has been
+	// authenticated, so that it can be revoked.
+	TokenID     string
+	TokenExpiry time.Time
+
+	// APIKey is sent by machine clients instead of a bearer token. Once the key
+	// has been authenticated, APIKeyID and APIKeyScopes identify it and the
+	// actions it may perform. UserKey is empty for requests made with a key.
+	APIKey       string
+	APIKeyID     string
+	APIKeyScopes []Action
+
 	// Many endpoints require a token. This variable will be set in the decode func so that the auth middleware can know.
 	TokenRequired bool
 
@@ -57,6 +75,7 @@ func NewContext(r *http.Request) Context {
 		Request:           r,
 		RequestID:         uuid.New(),
 		Token:             r.Header.Get("Authorization"),
+		APIKey:            r.Header.Get(APIKeyHeader),
 		TokenRequired:     false,
 		ConfirmationToken: r.URL.Query().Get("conf"),
 		ConfTokenReqired:  false,
@@ -16,7 +16,7 @@ type GridDataRecord struct {
 	VderEnergy       float64   `json:"vder_energy" db:"vder_energy" csv:"vder_energy"`
 	VderCap          float64   `json:"vder_cap" db:"vder_cap" csv:"vder_cap"`
 	VderEnv          float64   `json:"vder_env" db:"vder_env" csv:"vder_env"`
-	VderDrv          float64   `json:"vder_drv" db:"vdr_drv" csv:"vdr_drv"`
+	VderDrv          float64   `json:"vder_drv" db:"vder_drv" csv:"vder_drv"`
 	VderLsrv         float64   `json:"vder_lsrv" db:"vder_lsrv" csv:"vder_lsrv"`
 	VderMTC          float64   `json:"vder_mtc" db:"vder_mtc" csv:"vder_mtc"`
 	VderCc           float64   `json:"vder_cc" db:"vder_cc" csv:"vder_cc"`
@@ -34,6 +34,72 @@ type GridDataRecord struct {
 	BankedCarryOver  float64   `json:"banked_carry_over" db:"banked_carry_over" csv:"banked_carry_over"`
 }
 
+// GridImportReport is the outcome of importing a grid data file. Rows counts
+// the rows of the file after its header, each of which was either imported,
+// quarantined or skipped unless the whole file was rejected.
+type GridImportReport struct {
+	BatchID     string         `json:"batchId,omitempty"`
+	File        GridUpload     `json:"file"`
+	Layout      string         `json:"layout"`
+	Rule        string         `json:"rule"`
+	Mode        string         `json:"mode,omitempty"`
+	Rows        int            `json:"rows"`
+	Imported    int            `json:"imported"`
+	Quarantined int            `json:"quarantined"`
+	Skipped     int            `json:"skipped"`
+	Errors      []GridRowError `json:"errors"`
+
+	// MoreErrors is the number of errors left out of Errors, which is
+	// limited so that a file of bad rows can't make the report huge.
+	MoreErrors int `json:"moreErrors,omitempty"`
+
+	// DuplicateOf are the earlier batches imported from the same file.
+	DuplicateOf []string `json:"duplicateOf,omitempty"`
+
+	// Conflicts are the rows with the same host account, satellite account
+	// and bill period as a row already imported, limited as Errors is.
+	Conflicts     []GridConflict `json:"conflicts"`
+	MoreConflicts int            `json:"moreConflicts,omitempty"`
+
+	// Replaced are the batches whose conflicting rows were replaced by the
+	// import.
+	Replaced []string `json:"replaced,omitempty"`
+}
+
+// GridUpload is a grid data file as it was uploaded. Imported files are kept
+// at Path for traceability.
+type GridUpload struct {
+	Name string `json:"name"`
+	Path string `json:"-"`
+	Size int64  `json:"size"`
+
+	// Hash is the hex encoded SHA-256 of the file, by which re-uploads of it
+	// are found.
+	Hash string `json:"hash"`
+}
+
+// GridConflict is a row of a grid data file with the same host account,
+// satellite account and bill period as a row of an earlier batch.
+type GridConflict struct {
+	Row     int    `json:"row"`
+	BatchID string `json:"batchId"`
+}
+
+// GridRowError is a problem with a cell of a grid data file. Row is its line
+// in the file, counting the header as line 1.
+type GridRowError struct {
+	Row    int    `json:"row"`
+	Column string `json:"column"`
+	Error  string `json:"error"`
+}
+
+// GridQuarantinedRow is a row of a grid data file that was set aside instead
+// of imported, as it was read.
+type GridQuarantinedRow struct {
+	Row  int      `json:"row" db:"row_number"`
+	Data []string `json:"data" db:"data"`
+}
+
 type BatchData struct {
 	BatchID   uuid.UUID
 	BatchDate time.Time
@@ -35,6 +35,7 @@ type Error struct {
 	op   string
 	err  error
 	msg  string
+	det  interface{}
 }
 
 // ErrOpts are options for adding additional information to an Error. The zero
@@ -58,6 +59,11 @@ type ErrOpts struct {
 	// value affects the output of the Error's Message method. If not set, a
 	// default message based on the error kind is used.
 	Message string
+
+	// Details is client-safe, structured information about the error, such as
+	// every field that failed validation. It is encoded alongside the message
+	// so that clients can show all of it at once.
+	Details interface{}
 }
 
 // NewError constructs a new Error.
@@ -66,6 +72,7 @@ func NewError(opts ErrOpts) *Error {
 		kind: opts.Kind,    // If empty, the Kind method will handle the default.
 		err:  opts.Cause,   // Nil is a valid value.
 		msg:  opts.Message, // If empty, the Message method will handle the default.
+		det:  opts.Details, // Nil is a valid value.
 	}
 
 	// Add trace information if we can.
@@ -125,6 +132,12 @@ func (e Error) Message() string {
 	}
 }
 
+// Details returns the structured details of the error, or nil if there are
+// none.
+func (e Error) Details() interface{} {
+	return e.det
+}
+
 // Error implements error.
 func (e Error) Error() string {
 	// We can have up to 3 parts to our error.
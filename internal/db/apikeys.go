@@ -0,0 +1,105 @@
+package db
+
+import (
+	"fmt"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+const apiKeyColumns = `CAST(id AS varchar), name, key_prefix, key_hash, scopes, CAST(created_by AS varchar), created_at, last_used_at, revoked_at`
+
+func CreateAPIKey(ctx cloud.Context, tx pg.Tx, k *cloud.APIKey) error {
+	q := `INSERT INTO users.api_key (id, name, key_prefix, key_hash, scopes, created_by) VALUES ($1, $2, $3, $4, $5, $6)`
+	err := tx.Exec(ctx.Ctx, q, k.ID, k.Name, k.Prefix, k.Hash, scopeStrings(k.Scopes), k.CreatedBy)
+	if err != nil {
+		return fmt.Errorf("pg/Tx.CreateAPIKey: %w", err)
+	}
+	return nil
+}
+
+// FindAPIKey returns the API key with the given hash, or nil if there is none.
+func FindAPIKey(ctx cloud.Context, tx pg.Tx, hash string) (*cloud.APIKey, error) {
+	q := `SELECT ` + apiKeyColumns + ` FROM users.api_key WHERE key_hash = $1`
+
+	rows, err := tx.Query(ctx.Ctx, q, hash)
+	if err != nil {
+		return nil, fmt.Errorf("pg/Tx.FindAPIKeyQuery: %w", err)
+	}
+	defer rows.Close()
+
+	var k *cloud.APIKey
+	for rows.Next() {
+		if k, err = scanAPIKey(rows); err != nil {
+			return nil, fmt.Errorf("pg/Tx.FindAPIKeyAssignment: %w", err)
+		}
+	}
+	return k, rows.Err()
+}
+
+func ListAPIKeys(ctx cloud.Context, tx pg.Tx) ([]*cloud.APIKey, error) {
+	q := `SELECT ` + apiKeyColumns + ` FROM users.api_key ORDER BY created_at`
+
+	rows, err := tx.Query(ctx.Ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("pg/Tx.ListAPIKeysQuery: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []*cloud.APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("pg/Tx.ListAPIKeysAssignment: %w", err)
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func TouchAPIKey(ctx cloud.Context, tx pg.Tx, id string) error {
+	q := `UPDATE users.api_key SET last_used_at = NOW() WHERE id = $1`
+	if err := tx.Exec(ctx.Ctx, q, id); err != nil {
+		return fmt.Errorf("pg/Tx.TouchAPIKey: %w", err)
+	}
+	return nil
+}
+
+// RevokeAPIKey revokes the key. It returns false if there is no such key, or
+// it was already revoked.
+func RevokeAPIKey(ctx cloud.Context, tx pg.Tx, id string) (bool, error) {
+	q := `UPDATE users.api_key SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL RETURNING id`
+
+	rows, err := tx.Query(ctx.Ctx, q, id)
+	if err != nil {
+		return false, fmt.Errorf("pg/Tx.RevokeAPIKey: %w", err)
+	}
+	defer rows.Close()
+
+	revoked := rows.Next()
+	return revoked, rows.Err()
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAPIKey(row scanner) (*cloud.APIKey, error) {
+	var k cloud.APIKey
+	var scopes []string
+	if err := row.Scan(&k.ID, &k.Name, &k.Prefix, &k.Hash, &scopes, &k.CreatedBy, &k.CreatedAt, &k.LastUsedAt, &k.RevokedAt); err != nil {
+		return nil, err
+	}
+	for _, s := range scopes {
+		k.Scopes = append(k.Scopes, cloud.Action(s))
+	}
+	return &k, nil
+}
+
+func scopeStrings(scopes []cloud.Action) []string {
+	s := make([]string, len(scopes))
+	for i, act := range scopes {
+		s[i] = string(act)
+	}
+	return s
+}
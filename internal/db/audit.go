@@ -0,0 +1,136 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+const auditColumns = `CAST(id AS varchar), at, actor_id, impersonator_id, api_key_id, action, target_type, target_id, request_id, changes, outcome, error`
+
+func CreateAuditEntry(ctx cloud.Context, tx pg.Tx, e *cloud.AuditEntry) error {
+	var changes []byte
+	if len(e.Changes) > 0 {
+		var err error
+		if changes, err = json.Marshal(e.Changes); err != nil {
+			return fmt.Errorf("pg/Tx.CreateAuditEntryChanges: %w", err)
+		}
+	}
+
+	q := `INSERT INTO audit.entry (id, at, actor_id, impersonator_id, api_key_id, action, target_type, target_id, request_id, changes, outcome, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`
+	err := tx.Exec(ctx.Ctx, q, e.ID, e.At, e.ActorID, e.ImpersonatorID, e.APIKeyID, e.Action, e.TargetType, e.TargetID, e.RequestID, changes, e.Outcome, e.Error)
+	if err != nil {
+		return fmt.Errorf("pg/Tx.CreateAuditEntry: %w", err)
+	}
+	return nil
+}
+
+// AuditFilter selects the entries returned by ListAuditEntries. Entries are
+// listed newest first.
+type AuditFilter struct {
+	// ActorID matches entries performed by the user or API key.
+	ActorID string
+
+	// TargetType and TargetID match entries performed on the target. The ID
+	// is only matched along with the type.
+	TargetType string
+	TargetID   string
+
+	// From and To, if set, bound when the entries were recorded.
+	From *time.Time
+	To   *time.Time
+
+	// After, if set, is the position of the last entry on the previous page.
+	After *Position
+	Limit int
+}
+
+// conditions returns the WHERE conditions of the filter, leaving out its
+// position so that they also count the whole log.
+func (f AuditFilter) conditions(args *queryArgs) []string {
+	conds := []string{"TRUE"}
+	if f.ActorID != "" {
+		p := args.add(f.ActorID)
+		conds = append(conds, fmt.Sprintf("(actor_id = %[1]s OR api_key_id = %[1]s)", p))
+	}
+	if f.TargetType != "" {
+		conds = append(conds, "target_type = "+args.add(f.TargetType))
+		if f.TargetID != "" {
+			conds = append(conds, "target_id = "+args.add(f.TargetID))
+		}
+	}
+	if f.From != nil {
+		conds = append(conds, "at >= "+args.add(*f.From))
+	}
+	if f.To != nil {
+		conds = append(conds, "at < "+args.add(*f.To))
+	}
+	return conds
+}
+
+// ListAuditEntries returns a page of the entries matching the filter, and the
+// position to continue the log from, or nil if this is the last page.
+func ListAuditEntries(ctx cloud.Context, tx pg.Tx, f AuditFilter) ([]*cloud.AuditEntry, *Position, error) {
+	var args queryArgs
+	conds := f.conditions(&args)
+	if f.After != nil {
+		conds = append(conds, fmt.Sprintf("(at, id) < (CAST(%s AS timestamptz), CAST(%s AS uuid))", args.add(f.After.Value), args.add(f.After.ID)))
+	}
+	// One more entry than fits on the page is fetched to tell whether there is
+	// another page.
+	q := `SELECT ` + auditColumns + `, CAST(at AS text) FROM audit.entry` +
+		` WHERE ` + strings.Join(conds, " AND ") +
+		` ORDER BY at DESC, id DESC LIMIT ` + args.add(f.Limit+1)
+
+	rows, err := tx.Query(ctx.Ctx, q, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pg/Tx.ListAuditEntriesQuery: %w", err)
+	}
+	defer rows.Close()
+
+	entries := []*cloud.AuditEntry{}
+	var values []string
+	for rows.Next() {
+		var e cloud.AuditEntry
+		var changes []byte
+		var value string
+		if err := rows.Scan(&e.ID, &e.At, &e.ActorID, &e.ImpersonatorID, &e.APIKeyID, &e.Action, &e.TargetType, &e.TargetID, &e.RequestID, &changes, &e.Outcome, &e.Error, &value); err != nil {
+			return nil, nil, fmt.Errorf("pg/Tx.ListAuditEntriesAssignment: %w", err)
+		}
+		if changes != nil {
+			if err := json.Unmarshal(changes, &e.Changes); err != nil {
+				return nil, nil, fmt.Errorf("pg/Tx.ListAuditEntriesChanges: %w", err)
+			}
+		}
+		entries = append(entries, &e)
+		values = append(values, value)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("pg/Tx.ListAuditEntriesQuery: %w", err)
+	}
+
+	if len(entries) <= f.Limit {
+		return entries, nil, nil
+	}
+	entries = entries[:f.Limit]
+	last := len(entries) - 1
+	return entries, &Position{Value: values[last], ID: entries[last].ID}, nil
+}
+
+// CountAuditEntries returns the number of entries matching the filter, across
+// every page.
+func CountAuditEntries(ctx cloud.Context, tx pg.Tx, f AuditFilter) (int, error) {
+	var args queryArgs
+	q := `SELECT COUNT(*) FROM audit.entry WHERE ` + strings.Join(f.conditions(&args), " AND ")
+
+	var n int
+	if err := tx.QueryRow(ctx.Ctx, q, args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("pg/Tx.CountAuditEntries: %w", err)
+	}
+	return n, nil
+}
@@ -3,76 +3,246 @@ package db
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v4"
 	cloud "github.com/kmhebb/serverExample"
-	"github.com/kmhebb/serverExample/internal/log"
 	"github.com/kmhebb/serverExample/pg"
 	"github.com/pborman/uuid"
 )
 
-func ImportGridData(ctx cloud.Context, tx pg.Tx, data []cloud.GridDataRecord) error {
-	logger := log.NewLogger()
-	upload_id := uuid.NewUUID()
-	upload_date := time.Now()
-	var errCount int
-	for _, row := range data {
-		query := `INSERT INTO customer.utility_data (
-		host_acct,
-		sat_acct,
-		satellite_name,
-		sat_serv_class,
-		sat_vdl,
-		sat_status,
-		vder_energy,
-		vder_cap,
-		vder_env,
-		vder_drv,
-		vder_lsrv,
-		vder_mtc,
-		vder_total,
-		trans_kwh,
-		allocation,
-		host_bill_period,
-		transfer_date,
-		sat_bill_date,
-		banked_prior_month,
-		current_vder,
-		total_available,
-		sat_bill_amt,
-		applied,
-		banked_carry_over,
-		upload_id,
-		upload_date
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26);`
+// gridColumns are the columns of customer.utility_data that are imported from
+// a grid data file, in the order StageGridData copies them.
+var gridColumns = []string{
+	"host_acct", "sat_acct", "satellite_name", "sat_serv_class", "sat_vdl", "sat_status",
+	"vder_energy", "vder_cap", "vder_env", "vder_drv", "vder_lsrv", "vder_mtc", "vder_total",
+	"trans_kwh", "allocation", "host_bill_period", "transfer_date", "sat_bill_date",
+	"banked_prior_month", "current_vder", "total_available", "sat_bill_amt", "applied", "banked_carry_over",
+}
 
-		err := tx.Exec(ctx.Ctx, query,
+// StagedGridRow is a record of a grid data file, with its line in the file and
+// the row it was decoded from.
+type StagedGridRow struct {
+	Row    int
+	Data   []string
+	Record cloud.GridDataRecord
+}
+
+// CreateGridStaging creates grid_staging, a temporary table that is dropped
+// with the transaction, so that the rows of a file can be checked and imported
+// as a set.
+func CreateGridStaging(ctx cloud.Context, tx pg.Tx) error {
+	q := `CREATE TEMP TABLE grid_staging (
+		row_number integer PRIMARY KEY,
+		data text[] NOT NULL,
+		host_acct integer,
+		sat_acct integer,
+		satellite_name text,
+		sat_serv_class text,
+		sat_vdl integer,
+		sat_status text,
+		vder_energy double precision,
+		vder_cap double precision,
+		vder_env double precision,
+		vder_drv double precision,
+		vder_lsrv double precision,
+		vder_mtc double precision,
+		vder_total double precision,
+		trans_kwh double precision,
+		allocation double precision,
+		host_bill_period text,
+		transfer_date date,
+		sat_bill_date date,
+		banked_prior_month double precision,
+		current_vder double precision,
+		total_available double precision,
+		sat_bill_amt double precision,
+		applied double precision,
+		banked_carry_over double precision
+	) ON COMMIT DROP`
+	if err := tx.Exec(ctx.Ctx, q); err != nil {
+		return fmt.Errorf("pg/Tx.CreateGridStaging: %w", err)
+	}
+	return nil
+}
+
+// StageGridData copies the rows into grid_staging. It returns the number of
+// rows copied.
+func StageGridData(ctx cloud.Context, tx pg.Tx, rows []StagedGridRow) (int64, error) {
+	src := pgx.CopyFromSlice(len(rows), func(i int) ([]interface{}, error) {
+		row := rows[i].Record
+		return []interface{}{
+			rows[i].Row, rows[i].Data,
 			row.HostAcct, row.SatAcct, row.SatelliteName, row.SatServClass, row.SatVDL, row.SatStatus, row.VderEnergy, row.VderCap,
 			row.VderEnv, row.VderDrv, row.VderLsrv, row.VderMTC, row.VderTotal, row.TransKWH, row.Allocation, row.HostBillPeriod, row.TransferDate,
 			row.SatBillDate, row.BankedPriorMonth, row.CurrentVDER, row.TotalAvailable, row.SatBillAmt, row.Applied, row.BankedCarryOver,
-			upload_id, upload_date)
-		if err != nil {
-			logger.Debug(fmt.Sprintf("error saving to db: %+v", err))
-			errCount += 1
+		}, nil
+	})
+	n, err := tx.CopyFrom(ctx.Ctx, pgx.Identifier{"grid_staging"}, append([]string{"row_number", "data"}, gridColumns...), src)
+	if err != nil {
+		return 0, fmt.Errorf("pg/Tx.StageGridData: %w", err)
+	}
+	return n, nil
+}
+
+// CheckStagedGridData returns the problems with the staged rows that can only
+// be found across rows: those with the same host account, satellite account
+// and bill period as an earlier row of the file.
+func CheckStagedGridData(ctx cloud.Context, tx pg.Tx) ([]cloud.GridRowError, error) {
+	q := `SELECT s.row_number, MIN(d.row_number) FROM grid_staging s
+		JOIN grid_staging d ON (d.host_acct, d.sat_acct, d.host_bill_period) = (s.host_acct, s.sat_acct, s.host_bill_period)
+			AND d.row_number < s.row_number
+		GROUP BY s.row_number ORDER BY s.row_number`
+	rows, err := tx.Query(ctx.Ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("pg/Tx.CheckStagedGridDataQuery: %w", err)
+	}
+	defer rows.Close()
+
+	var problems []cloud.GridRowError
+	for rows.Next() {
+		var row, first int
+		if err := rows.Scan(&row, &first); err != nil {
+			return nil, fmt.Errorf("pg/Tx.CheckStagedGridDataAssignment: %w", err)
+		}
+		problems = append(problems, cloud.GridRowError{
+			Row:    row,
+			Column: "sat_acct",
+			Error:  fmt.Sprintf("Duplicates row %d for the same host account and bill period", first),
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("pg/Tx.CheckStagedGridDataQuery: %w", err)
+	}
+	return problems, nil
+}
+
+// QuarantineStagedGridRows moves staged rows, by their line in the file, from
+// grid_staging to the batch's quarantine, so that they are not imported.
+func QuarantineStagedGridRows(ctx cloud.Context, tx pg.Tx, batchID string, lines []int) error {
+	q := `INSERT INTO customer.grid_quarantine (upload_id, row_number, data)
+		SELECT $1, row_number, data FROM grid_staging WHERE row_number = ANY($2)`
+	if err := tx.Exec(ctx.Ctx, q, batchID, lines); err != nil {
+		return fmt.Errorf("pg/Tx.QuarantineStagedGridRows: %w", err)
+	}
+	q = `DELETE FROM grid_staging WHERE row_number = ANY($1)`
+	if err := tx.Exec(ctx.Ctx, q, lines); err != nil {
+		return fmt.Errorf("pg/Tx.QuarantineStagedGridRowsDelete: %w", err)
+	}
+	return nil
+}
+
+// gridKeyJoin joins grid_staging s to customer.utility_data d on the columns
+// that identify a record.
+const gridKeyJoin = `(d.host_acct, d.sat_acct, d.host_bill_period) = (s.host_acct, s.sat_acct, s.host_bill_period)`
+
+// CheckGridConflicts returns the first limit staged rows with the same host
+// account, satellite account and bill period as a row already imported, each
+// with the earliest batch holding it. It also returns how many staged rows
+// conflict in all.
+func CheckGridConflicts(ctx cloud.Context, tx pg.Tx, limit int) ([]cloud.GridConflict, int, error) {
+	q := `SELECT s.row_number, MIN(CAST(d.upload_id AS varchar)), COUNT(*) OVER () FROM grid_staging s
+		JOIN customer.utility_data d ON ` + gridKeyJoin + `
+		GROUP BY s.row_number ORDER BY s.row_number LIMIT $1`
+	rows, err := tx.Query(ctx.Ctx, q, limit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("pg/Tx.CheckGridConflictsQuery: %w", err)
+	}
+	defer rows.Close()
+
+	var conflicts []cloud.GridConflict
+	var total int
+	for rows.Next() {
+		var c cloud.GridConflict
+		if err := rows.Scan(&c.Row, &c.BatchID, &total); err != nil {
+			return nil, 0, fmt.Errorf("pg/Tx.CheckGridConflictsAssignment: %w", err)
 		}
+		conflicts = append(conflicts, c)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("pg/Tx.CheckGridConflictsQuery: %w", err)
+	}
+	return conflicts, total, nil
+}
 
-	if errCount > 0 {
-		// log the problem for debugging.
-		logger.Debug(fmt.Sprintf("failed to add %d records in upload: %s", errCount, upload_id))
-		return fmt.Errorf("there were %d insert errors in upload: %s", errCount, upload_id)
+// SkipConflictingGridRows removes the staged rows that conflict with a row
+// already imported from grid_staging, so that they are not imported.
+func SkipConflictingGridRows(ctx cloud.Context, tx pg.Tx) error {
+	q := `DELETE FROM grid_staging s USING customer.utility_data d WHERE ` + gridKeyJoin
+	if err := tx.Exec(ctx.Ctx, q); err != nil {
+		return fmt.Errorf("pg/Tx.SkipConflictingGridRows: %w", err)
+	}
+	return nil
+}
+
+// ReplaceConflictingGridRows deletes the imported rows that conflict with a
+// staged row, so that the staged rows take their place. It returns the batches
+// the rows were deleted from.
+func ReplaceConflictingGridRows(ctx cloud.Context, tx pg.Tx) ([]string, error) {
+	q := `WITH replaced AS (
+			DELETE FROM customer.utility_data d USING grid_staging s WHERE ` + gridKeyJoin + `
+			RETURNING d.upload_id
+		)
+		SELECT DISTINCT CAST(upload_id AS varchar) FROM replaced ORDER BY 1`
+	rows, err := tx.Query(ctx.Ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("pg/Tx.ReplaceConflictingGridRowsQuery: %w", err)
 	}
+	defer rows.Close()
 
+	var batches []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("pg/Tx.ReplaceConflictingGridRowsAssignment: %w", err)
+		}
+		batches = append(batches, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("pg/Tx.ReplaceConflictingGridRowsQuery: %w", err)
+	}
+	return batches, nil
+}
+
+// ImportStagedGridData inserts the staged rows into customer.utility_data as
+// the batch.
+func ImportStagedGridData(ctx cloud.Context, tx pg.Tx, batchID string) error {
+	cols := strings.Join(gridColumns, ", ")
+	q := `INSERT INTO customer.utility_data (` + cols + `, upload_id, upload_date)
+		SELECT ` + cols + `, $1, $2 FROM grid_staging ORDER BY row_number`
+	if err := tx.Exec(ctx.Ctx, q, batchID, time.Now()); err != nil {
+		return fmt.Errorf("pg/Tx.ImportStagedGridData: %w", err)
+	}
 	return nil
 }
 
-func DeleteGridData(ctx cloud.Context, tx pg.Tx, BatchID string) error {
+// DeleteGridData deletes a batch, along with its import report and the rows it
+// quarantined. It returns the path of the batch's kept upload, which is empty
+// for batches imported before uploads were kept.
+func DeleteGridData(ctx cloud.Context, tx pg.Tx, BatchID string) (string, error) {
 	q := `DELETE from customer.utility_data WHERE upload_id = $1`
 	err := tx.Exec(ctx.Ctx, q, BatchID)
 	if err != nil {
-		return fmt.Errorf("DeleteGridData failed to delete: %w", err)
+		return "", fmt.Errorf("DeleteGridData failed to delete: %w", err)
 	}
-	return nil
+	q = `DELETE from customer.grid_import WHERE upload_id = $1 RETURNING file_path`
+	rows, err := tx.Query(ctx.Ctx, q, BatchID)
+	if err != nil {
+		return "", fmt.Errorf("DeleteGridData failed to delete import report: %w", err)
+	}
+	defer rows.Close()
+
+	var path string
+	if rows.Next() {
+		if err := rows.Scan(&path); err != nil {
+			return "", fmt.Errorf("DeleteGridData import report assignment failed: %w", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("DeleteGridData failed to delete import report: %w", err)
+	}
+	return path, nil
 }
 
 func GetGridBatchList(ctx cloud.Context, tx pg.Tx, ListType string) ([]cloud.BatchData, error) {
@@ -182,24 +352,6 @@ func GetInvoiceData(ctx cloud.Context, tx pg.Tx, customerID int, statementID int
 	return data, nil
 }
 
-func UserAccess(ctx cloud.Context, tx pg.Tx) error {
-	query := `SELECT CAST(id AS varchar), firstname, lastname, email, passhash, mustchange, lastactivity, datecreated, datemodified FROM users.profile WHERE id = $1;`
-	var u cloud.User
-
-	rows, err := tx.Query(ctx.Ctx, query, ctx.UserKey)
-	if err != nil {
-		return fmt.Errorf("pg/Tx.UserFindByIDQuery: %w", err)
-	}
-
-	for rows.Next() {
-		if err = rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.PasswordHash, &u.MustChange, &u.LastActivity, &u.DateModified, &u.DateCreated); err != nil {
-			return fmt.Errorf("pg/Tx.UserFindByIDAssignment: %w", err)
-		}
-	}
-
-	return nil
-}
-
 func SynchronizeUtilibillCustomerData(ctx cloud.Context, tx pg.Tx, data cloud.UBCustomerDetail) error {
 	query := `INSERT INTO customer.customers (
 		customer_number, 
@@ -0,0 +1,83 @@
+package db
+
+import (
+	"fmt"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+// SaveEmailChange stores the user's pending email change, replacing any they
+// already had. Expired changes are cleared out at the same time.
+func SaveEmailChange(ctx cloud.Context, tx pg.Tx, ch *cloud.EmailChange) error {
+	q := `DELETE FROM users.email_change WHERE expires_at < NOW()`
+	if err := tx.Exec(ctx.Ctx, q); err != nil {
+		return fmt.Errorf("pg/Tx.SaveEmailChangeClear: %w", err)
+	}
+
+	q = `INSERT INTO users.email_change (user_id, new_email, code_hash, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE SET new_email = EXCLUDED.new_email, code_hash = EXCLUDED.code_hash, attempts = 0, created_at = NOW(), expires_at = EXCLUDED.expires_at`
+	if err := tx.Exec(ctx.Ctx, q, ch.UserID, ch.Email, ch.Hash, ch.ExpiresAt); err != nil {
+		return fmt.Errorf("pg/Tx.SaveEmailChange: %w", err)
+	}
+	return nil
+}
+
+// FindEmailChange returns the user's pending email change, or nil if there is
+// none.
+func FindEmailChange(ctx cloud.Context, tx pg.Tx, uid string) (*cloud.EmailChange, error) {
+	q := `SELECT CAST(user_id AS varchar), new_email, code_hash, attempts, created_at, expires_at FROM users.email_change WHERE user_id = $1`
+
+	rows, err := tx.Query(ctx.Ctx, q, uid)
+	if err != nil {
+		return nil, fmt.Errorf("pg/Tx.FindEmailChangeQuery: %w", err)
+	}
+	defer rows.Close()
+
+	var ch *cloud.EmailChange
+	for rows.Next() {
+		ch = &cloud.EmailChange{}
+		if err := rows.Scan(&ch.UserID, &ch.Email, &ch.Hash, &ch.Attempts, &ch.CreatedAt, &ch.ExpiresAt); err != nil {
+			return nil, fmt.Errorf("pg/Tx.FindEmailChangeAssignment: %w", err)
+		}
+	}
+	return ch, rows.Err()
+}
+
+// RecordEmailChangeAttempt counts a wrong code entered for the user's pending
+// email change.
+func RecordEmailChangeAttempt(ctx cloud.Context, tx pg.Tx, uid string) error {
+	q := `UPDATE users.email_change SET attempts = attempts + 1 WHERE user_id = $1`
+	if err := tx.Exec(ctx.Ctx, q, uid); err != nil {
+		return fmt.Errorf("pg/Tx.RecordEmailChangeAttempt: %w", err)
+	}
+	return nil
+}
+
+func DeleteEmailChange(ctx cloud.Context, tx pg.Tx, uid string) error {
+	q := `DELETE FROM users.email_change WHERE user_id = $1`
+	if err := tx.Exec(ctx.Ctx, q, uid); err != nil {
+		return fmt.Errorf("pg/Tx.DeleteEmailChange: %w", err)
+	}
+	return nil
+}
+
+// UpdateUserEmail changes the user's email. It is only called once the new
+// address has been confirmed.
+func UpdateUserEmail(ctx cloud.Context, tx pg.Tx, uid, email string) error {
+	q := `UPDATE users.profile SET email = $2, datemodified = NOW() WHERE id = $1`
+	if err := tx.Exec(ctx.Ctx, q, uid, email); err != nil {
+		return fmt.Errorf("pg/Tx.UpdateUserEmail: %w", err)
+	}
+	return nil
+}
+
+// EmailInUse reports whether a user other than uid has the email.
+func EmailInUse(ctx cloud.Context, tx pg.Tx, email, uid string) (bool, error) {
+	q := `SELECT EXISTS (SELECT 1 FROM users.profile WHERE email = $1 AND CAST(id AS varchar) <> $2)`
+	var inUse bool
+	if err := tx.QueryRow(ctx.Ctx, q, email, uid).Scan(&inUse); err != nil {
+		return false, fmt.Errorf("pg/Tx.EmailInUse: %w", err)
+	}
+	return inUse, nil
+}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+// CreateGridImport starts the record of an import, under the batch ID of the
+// report, so that rows can be quarantined with it as the file is read.
+// UpdateGridImport stores the finished report.
+func CreateGridImport(ctx cloud.Context, tx pg.Tx, r *cloud.GridImportReport, header []string) error {
+	report, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("pg/Tx.CreateGridImportReport: %w", err)
+	}
+
+	q := `INSERT INTO customer.grid_import (upload_id, layout, rule, header, report, file_name, file_path)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	if err := tx.Exec(ctx.Ctx, q, r.BatchID, r.Layout, r.Rule, header, report, r.File.Name, r.File.Path); err != nil {
+		return fmt.Errorf("pg/Tx.CreateGridImport: %w", err)
+	}
+	return nil
+}
+
+// UpdateGridImport stores the report of an import with its batch.
+func UpdateGridImport(ctx cloud.Context, tx pg.Tx, r *cloud.GridImportReport) error {
+	report, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("pg/Tx.UpdateGridImportReport: %w", err)
+	}
+
+	q := `UPDATE customer.grid_import SET report = $2, file_size = $3, file_hash = $4 WHERE upload_id = $1`
+	if err := tx.Exec(ctx.Ctx, q, r.BatchID, report, r.File.Size, r.File.Hash); err != nil {
+		return fmt.Errorf("pg/Tx.UpdateGridImport: %w", err)
+	}
+	return nil
+}
+
+// QuarantineGridRows sets rows of a file aside with its batch.
+func QuarantineGridRows(ctx cloud.Context, tx pg.Tx, batchID string, rows []cloud.GridQuarantinedRow) error {
+	src := pgx.CopyFromSlice(len(rows), func(i int) ([]interface{}, error) {
+		return []interface{}{batchID, rows[i].Row, rows[i].Data}, nil
+	})
+	_, err := tx.CopyFrom(ctx.Ctx, pgx.Identifier{"customer", "grid_quarantine"}, []string{"upload_id", "row_number", "data"}, src)
+	if err != nil {
+		return fmt.Errorf("pg/Tx.QuarantineGridRows: %w", err)
+	}
+	return nil
+}
+
+// ListGridImportsByHash returns the batches imported from a file with the hash,
+// other than the batch given, oldest first.
+func ListGridImportsByHash(ctx cloud.Context, tx pg.Tx, hash string, batchID string) ([]string, error) {
+	q := `SELECT CAST(upload_id AS varchar) FROM customer.grid_import
+		WHERE file_hash = $1 AND upload_id <> $2 ORDER BY upload_date`
+	rows, err := tx.Query(ctx.Ctx, q, hash, batchID)
+	if err != nil {
+		return nil, fmt.Errorf("pg/Tx.ListGridImportsByHashQuery: %w", err)
+	}
+	defer rows.Close()
+
+	var batches []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("pg/Tx.ListGridImportsByHashAssignment: %w", err)
+		}
+		batches = append(batches, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("pg/Tx.ListGridImportsByHashQuery: %w", err)
+	}
+	return batches, nil
+}
+
+// GetGridImport returns the report of the batch's import and the header of its
+// file. Batches imported before reports were kept have none, and return a nil
+// report.
+func GetGridImport(ctx cloud.Context, tx pg.Tx, batchID string) (*cloud.GridImportReport, []string, error) {
+	q := `SELECT report, header, file_path FROM customer.grid_import WHERE upload_id = $1`
+	rows, err := tx.Query(ctx.Ctx, q, batchID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pg/Tx.GetGridImportQuery: %w", err)
+	}
+	defer rows.Close()
+
+	var report []byte
+	var header []string
+	var path string
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, nil, fmt.Errorf("pg/Tx.GetGridImportQuery: %w", err)
+		}
+		return nil, nil, nil
+	}
+	if err := rows.Scan(&report, &header, &path); err != nil {
+		return nil, nil, fmt.Errorf("pg/Tx.GetGridImportAssignment: %w", err)
+	}
+
+	var r cloud.GridImportReport
+	if err := json.Unmarshal(report, &r); err != nil {
+		return nil, nil, fmt.Errorf("pg/Tx.GetGridImportReport: %w", err)
+	}
+	r.File.Path = path
+	return &r, header, nil
+}
+
+// ListGridQuarantine returns the rows the batch's import quarantined, in the
+// order of the file.
+func ListGridQuarantine(ctx cloud.Context, tx pg.Tx, batchID string) ([]cloud.GridQuarantinedRow, error) {
+	q := `SELECT row_number, data FROM customer.grid_quarantine WHERE upload_id = $1 ORDER BY row_number`
+	rows, err := tx.Query(ctx.Ctx, q, batchID)
+	if err != nil {
+		return nil, fmt.Errorf("pg/Tx.ListGridQuarantineQuery: %w", err)
+	}
+	defer rows.Close()
+
+	quarantined := []cloud.GridQuarantinedRow{}
+	for rows.Next() {
+		var row cloud.GridQuarantinedRow
+		if err := rows.Scan(&row.Row, &row.Data); err != nil {
+			return nil, fmt.Errorf("pg/Tx.ListGridQuarantineAssignment: %w", err)
+		}
+		quarantined = append(quarantined, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("pg/Tx.ListGridQuarantineQuery: %w", err)
+	}
+	return quarantined, nil
+}
@@ -0,0 +1,111 @@
+package db
+
+import (
+	"fmt"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+const inviteColumns = `CAST(i.id AS varchar), CAST(i.user_id AS varchar), p.email, i.token_hash, COALESCE(CAST(i.invited_by AS varchar), ''), i.created_at, i.expires_at, i.accepted_at, i.revoked_at`
+
+func CreateInvite(ctx cloud.Context, tx pg.Tx, inv *cloud.Invite) error {
+	q := `INSERT INTO users.invite (id, user_id, token_hash, invited_by, expires_at) VALUES ($1, $2, $3, CAST(NULLIF($4, '') AS uuid), $5)`
+	err := tx.Exec(ctx.Ctx, q, inv.ID, inv.UserID, inv.Hash, inv.InvitedBy, inv.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("pg/Tx.CreateInvite: %w", err)
+	}
+	return nil
+}
+
+// FindInvite returns the invite with the ID, or nil if there is none.
+func FindInvite(ctx cloud.Context, tx pg.Tx, id string) (*cloud.Invite, error) {
+	q := `SELECT ` + inviteColumns + ` FROM users.invite i JOIN users.profile p ON p.id = i.user_id WHERE i.id = $1`
+	return findInvite(ctx, tx, "FindInvite", q, id)
+}
+
+// FindInviteByHash returns the invite with the token hash, or nil if there is
+// none.
+func FindInviteByHash(ctx cloud.Context, tx pg.Tx, hash string) (*cloud.Invite, error) {
+	q := `SELECT ` + inviteColumns + ` FROM users.invite i JOIN users.profile p ON p.id = i.user_id WHERE i.token_hash = $1`
+	return findInvite(ctx, tx, "FindInviteByHash", q, hash)
+}
+
+func findInvite(ctx cloud.Context, tx pg.Tx, op, q string, arg string) (*cloud.Invite, error) {
+	rows, err := tx.Query(ctx.Ctx, q, arg)
+	if err != nil {
+		return nil, fmt.Errorf("pg/Tx.%sQuery: %w", op, err)
+	}
+	defer rows.Close()
+
+	var inv *cloud.Invite
+	for rows.Next() {
+		if inv, err = scanInvite(rows); err != nil {
+			return nil, fmt.Errorf("pg/Tx.%sAssignment: %w", op, err)
+		}
+	}
+	return inv, rows.Err()
+}
+
+// ListPendingInvites returns the invites that have been neither accepted nor
+// revoked, including expired ones that may need resending.
+func ListPendingInvites(ctx cloud.Context, tx pg.Tx) ([]*cloud.Invite, error) {
+	q := `SELECT ` + inviteColumns + ` FROM users.invite i JOIN users.profile p ON p.id = i.user_id WHERE i.accepted_at IS NULL AND i.revoked_at IS NULL ORDER BY i.created_at`
+
+	rows, err := tx.Query(ctx.Ctx, q)
+	if err != nil {
+		return nil, fmt.Errorf("pg/Tx.ListPendingInvitesQuery: %w", err)
+	}
+	defer rows.Close()
+
+	invites := []*cloud.Invite{}
+	for rows.Next() {
+		inv, err := scanInvite(rows)
+		if err != nil {
+			return nil, fmt.Errorf("pg/Tx.ListPendingInvitesAssignment: %w", err)
+		}
+		invites = append(invites, inv)
+	}
+	return invites, rows.Err()
+}
+
+// AcceptInvite marks the invite accepted. It returns false if the invite was
+// no longer pending, in which case nothing is changed.
+func AcceptInvite(ctx cloud.Context, tx pg.Tx, id string) (bool, error) {
+	q := `UPDATE users.invite SET accepted_at = NOW() WHERE id = $1 AND accepted_at IS NULL AND revoked_at IS NULL AND expires_at > NOW() RETURNING id`
+
+	rows, err := tx.Query(ctx.Ctx, q, id)
+	if err != nil {
+		return false, fmt.Errorf("pg/Tx.AcceptInvite: %w", err)
+	}
+	defer rows.Close()
+
+	accepted := rows.Next()
+	return accepted, rows.Err()
+}
+
+func RevokeInvite(ctx cloud.Context, tx pg.Tx, id string) error {
+	q := `UPDATE users.invite SET revoked_at = NOW() WHERE id = $1 AND accepted_at IS NULL AND revoked_at IS NULL`
+	if err := tx.Exec(ctx.Ctx, q, id); err != nil {
+		return fmt.Errorf("pg/Tx.RevokeInvite: %w", err)
+	}
+	return nil
+}
+
+// RevokeUserInvites revokes every pending invite for the user.
+func RevokeUserInvites(ctx cloud.Context, tx pg.Tx, uid string) error {
+	q := `UPDATE users.invite SET revoked_at = NOW() WHERE user_id = $1 AND accepted_at IS NULL AND revoked_at IS NULL`
+	if err := tx.Exec(ctx.Ctx, q, uid); err != nil {
+		return fmt.Errorf("pg/Tx.RevokeUserInvites: %w", err)
+	}
+	return nil
+}
+
+func scanInvite(row scanner) (*cloud.Invite, error) {
+	var inv cloud.Invite
+	err := row.Scan(&inv.ID, &inv.UserID, &inv.Email, &inv.Hash, &inv.InvitedBy, &inv.CreatedAt, &inv.ExpiresAt, &inv.AcceptedAt, &inv.RevokedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
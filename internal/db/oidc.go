@@ -0,0 +1,44 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+// SaveOIDCState stores the nonce and PKCE verifier of a login that is being
+// sent to the OpenID Connect provider. Expired states are cleared out at the
+// same time.
+func SaveOIDCState(ctx cloud.Context, tx pg.Tx, state, nonce, verifier string, expiresAt time.Time) error {
+	q := `DELETE FROM users.oidc_state WHERE expires_at < NOW()`
+	if err := tx.Exec(ctx.Ctx, q); err != nil {
+		return fmt.Errorf("pg/Tx.SaveOIDCStateClear: %w", err)
+	}
+
+	q = `INSERT INTO users.oidc_state (state, nonce, verifier, expires_at) VALUES ($1, $2, $3, $4)`
+	if err := tx.Exec(ctx.Ctx, q, state, nonce, verifier, expiresAt); err != nil {
+		return fmt.Errorf("pg/Tx.SaveOIDCState: %w", err)
+	}
+	return nil
+}
+
+// UseOIDCState removes the state and returns the nonce and verifier stored
+// with it. ok is false if the state is unknown, used or expired.
+func UseOIDCState(ctx cloud.Context, tx pg.Tx, state string) (nonce string, verifier string, ok bool, err error) {
+	q := `DELETE FROM users.oidc_state WHERE state = $1 RETURNING nonce, verifier, expires_at > NOW()`
+
+	rows, err := tx.Query(ctx.Ctx, q, state)
+	if err != nil {
+		return "", "", false, fmt.Errorf("pg/Tx.UseOIDCState: %w", err)
+	}
+	defer rows.Close()
+
+	if rows.Next() {
+		if err := rows.Scan(&nonce, &verifier, &ok); err != nil {
+			return "", "", false, fmt.Errorf("pg/Tx.UseOIDCStateScan: %w", err)
+		}
+	}
+	return nonce, verifier, ok, rows.Err()
+}
@@ -0,0 +1,47 @@
+package db
+
+import (
+	"fmt"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+// PasswordHistory returns the hashes of up to n of the user's earlier
+// passwords, newest first.
+func PasswordHistory(ctx cloud.Context, tx pg.Tx, uid string, n int) ([]string, error) {
+	q := `SELECT passhash FROM users.password_history WHERE user_id = $1 ORDER BY id DESC LIMIT $2`
+
+	rows, err := tx.Query(ctx.Ctx, q, uid, n)
+	if err != nil {
+		return nil, fmt.Errorf("pg/Tx.PasswordHistory: %w", err)
+	}
+	defer rows.Close()
+
+	var hashes []string
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			return nil, fmt.Errorf("pg/Tx.PasswordHistoryScan: %w", err)
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, rows.Err()
+}
+
+// AddPasswordHistory records a password hash the user no longer uses, and
+// forgets all but the keep most recent ones.
+func AddPasswordHistory(ctx cloud.Context, tx pg.Tx, uid, hash string, keep int) error {
+	q := `INSERT INTO users.password_history (user_id, passhash) VALUES ($1, $2)`
+	if err := tx.Exec(ctx.Ctx, q, uid, hash); err != nil {
+		return fmt.Errorf("pg/Tx.AddPasswordHistory: %w", err)
+	}
+
+	q = `DELETE FROM users.password_history WHERE user_id = $1 AND id NOT IN (
+		SELECT id FROM users.password_history WHERE user_id = $1 ORDER BY id DESC LIMIT $2
+	)`
+	if err := tx.Exec(ctx.Ctx, q, uid, keep); err != nil {
+		return fmt.Errorf("pg/Tx.AddPasswordHistoryPrune: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+// CreatePasswordReset stores the hash of a new reset token for the user, and
+// forgets any unused ones, so that only the latest link works.
+func CreatePasswordReset(ctx cloud.Context, tx pg.Tx, uid, hash string, expiresAt time.Time) error {
+	q := `DELETE FROM users.password_reset WHERE user_id = $1 AND used_at IS NULL`
+	if err := tx.Exec(ctx.Ctx, q, uid); err != nil {
+		return fmt.Errorf("pg/Tx.CreatePasswordResetClear: %w", err)
+	}
+
+	q = `INSERT INTO users.password_reset (token_hash, user_id, expires_at) VALUES ($1, $2, $3)`
+	if err := tx.Exec(ctx.Ctx, q, hash, uid, expiresAt); err != nil {
+		return fmt.Errorf("pg/Tx.CreatePasswordReset: %w", err)
+	}
+	return nil
+}
+
+// FindPasswordReset returns the ID of the user the reset token was issued to,
+// or an empty string if the token is unknown, used or expired.
+func FindPasswordReset(ctx cloud.Context, tx pg.Tx, hash string) (string, error) {
+	q := `SELECT CAST(user_id AS varchar) FROM users.password_reset WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()`
+	return queryResetUser(ctx, tx, "FindPasswordReset", q, hash)
+}
+
+// UsePasswordReset marks the reset token used and returns the ID of the user
+// it was issued to. As with FindPasswordReset, the ID is empty if the token
+// can't be used, including when it was just used by someone else.
+func UsePasswordReset(ctx cloud.Context, tx pg.Tx, hash string) (string, error) {
+	q := `UPDATE users.password_reset SET used_at = NOW() WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW() RETURNING CAST(user_id AS varchar)`
+	return queryResetUser(ctx, tx, "UsePasswordReset", q, hash)
+}
+
+func queryResetUser(ctx cloud.Context, tx pg.Tx, op, q, hash string) (string, error) {
+	rows, err := tx.Query(ctx.Ctx, q, hash)
+	if err != nil {
+		return "", fmt.Errorf("pg/Tx.%s: %w", op, err)
+	}
+	defer rows.Close()
+
+	var uid string
+	if rows.Next() {
+		if err := rows.Scan(&uid); err != nil {
+			return "", fmt.Errorf("pg/Tx.%sScan: %w", op, err)
+		}
+	}
+	return uid, rows.Err()
+}
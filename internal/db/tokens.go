@@ -0,0 +1,107 @@
+package db
+
+import (
+	"fmt"
+	"time"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+func SaveRefreshToken(ctx cloud.Context, tx pg.Tx, rt *cloud.RefreshToken) error {
+	q := `INSERT INTO users.refresh_token (id, user_id, token_hash, family_id, expires_at) VALUES ($1, $2, $3, $4, $5)`
+	err := tx.Exec(ctx.Ctx, q, rt.ID, rt.UserID, rt.Hash, rt.FamilyID, rt.ExpiresAt)
+	if err != nil {
+		return fmt.Errorf("pg/Tx.SaveRefreshToken: %w", err)
+	}
+	return nil
+}
+
+// FindRefreshToken returns the refresh token with the given hash, or nil if
+// there is none.
+func FindRefreshToken(ctx cloud.Context, tx pg.Tx, hash string) (*cloud.RefreshToken, error) {
+	q := `SELECT CAST(id AS varchar), CAST(user_id AS varchar), token_hash, CAST(family_id AS varchar), expires_at, created_at, used_at, revoked_at FROM users.refresh_token WHERE token_hash = $1`
+
+	rows, err := tx.Query(ctx.Ctx, q, hash)
+	if err != nil {
+		return nil, fmt.Errorf("pg/Tx.FindRefreshTokenQuery: %w", err)
+	}
+	defer rows.Close()
+
+	var rt *cloud.RefreshToken
+	for rows.Next() {
+		rt = &cloud.RefreshToken{}
+		if err = rows.Scan(&rt.ID, &rt.UserID, &rt.Hash, &rt.FamilyID, &rt.ExpiresAt, &rt.CreatedAt, &rt.UsedAt, &rt.RevokedAt); err != nil {
+			return nil, fmt.Errorf("pg/Tx.FindRefreshTokenAssignment: %w", err)
+		}
+	}
+	return rt, rows.Err()
+}
+
+func MarkRefreshTokenUsed(ctx cloud.Context, tx pg.Tx, id string) error {
+	q := `UPDATE users.refresh_token SET used_at = NOW() WHERE id = $1`
+	if err := tx.Exec(ctx.Ctx, q, id); err != nil {
+		return fmt.Errorf("pg/Tx.MarkRefreshTokenUsed: %w", err)
+	}
+	return nil
+}
+
+func RevokeRefreshTokenFamily(ctx cloud.Context, tx pg.Tx, familyID string) error {
+	q := `UPDATE users.refresh_token SET revoked_at = NOW() WHERE family_id = $1 AND revoked_at IS NULL`
+	if err := tx.Exec(ctx.Ctx, q, familyID); err != nil {
+		return fmt.Errorf("pg/Tx.RevokeRefreshTokenFamily: %w", err)
+	}
+	return nil
+}
+
+func RevokeUserRefreshTokens(ctx cloud.Context, tx pg.Tx, uid string) error {
+	q := `UPDATE users.refresh_token SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL`
+	if err := tx.Exec(ctx.Ctx, q, uid); err != nil {
+		return fmt.Errorf("pg/Tx.RevokeUserRefreshTokens: %w", err)
+	}
+	return nil
+}
+
+// RevokeAllTokens invalidates every access and refresh token issued to the
+// user so far.
+func RevokeAllTokens(ctx cloud.Context, tx pg.Tx, uid string) error {
+	q := `UPDATE users.profile SET token_generation = token_generation + 1 WHERE id = $1`
+	if err := tx.Exec(ctx.Ctx, q, uid); err != nil {
+		return fmt.Errorf("pg/Tx.RevokeAllTokens: %w", err)
+	}
+	return RevokeUserRefreshTokens(ctx, tx, uid)
+}
+
+func RevokeAccessToken(ctx cloud.Context, tx pg.Tx, jti string, uid string, expires time.Time) error {
+	q := `INSERT INTO users.revoked_token (jti, user_id, expires_at) VALUES ($1, $2, $3) ON CONFLICT (jti) DO NOTHING`
+	if err := tx.Exec(ctx.Ctx, q, jti, uid, expires); err != nil {
+		return fmt.Errorf("pg/Tx.RevokeAccessToken: %w", err)
+	}
+	return nil
+}
+
+// ConsumeToken revokes a single-use token and reports whether it was still
+// unused, so that only the first of any concurrent uses succeeds.
+func ConsumeToken(ctx cloud.Context, tx pg.Tx, jti string, uid string, expires time.Time) (bool, error) {
+	q := `INSERT INTO users.revoked_token (jti, user_id, expires_at) VALUES ($1, $2, $3) ON CONFLICT (jti) DO NOTHING RETURNING jti`
+	rows, err := tx.Query(ctx.Ctx, q, jti, uid, expires)
+	if err != nil {
+		return false, fmt.Errorf("pg/Tx.ConsumeToken: %w", err)
+	}
+	defer rows.Close()
+
+	consumed := rows.Next()
+	return consumed, rows.Err()
+}
+
+func IsAccessTokenRevoked(ctx cloud.Context, tx pg.Tx, jti string) (bool, error) {
+	q := `SELECT jti FROM users.revoked_token WHERE jti = $1`
+	rows, err := tx.Query(ctx.Ctx, q, jti)
+	if err != nil {
+		return false, fmt.Errorf("pg/Tx.IsAccessTokenRevoked: %w", err)
+	}
+	defer rows.Close()
+
+	revoked := rows.Next()
+	return revoked, rows.Err()
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"fmt"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+// SetTOTPSecret stores a new secret for the user. TOTP stays disabled until
+// the user confirms it with a code.
+func SetTOTPSecret(ctx cloud.Context, tx pg.Tx, uid string, secret string) error {
+	q := `UPDATE users.profile SET totp_secret = $2, totp_enabled = false, totp_last_step = 0 WHERE id = $1`
+	if err := tx.Exec(ctx.Ctx, q, uid, secret); err != nil {
+		return fmt.Errorf("pg/Tx.SetTOTPSecret: %w", err)
+	}
+	return nil
+}
+
+func EnableTOTP(ctx cloud.Context, tx pg.Tx, uid string, step int64) error {
+	q := `UPDATE users.profile SET totp_enabled = true, totp_last_step = $2 WHERE id = $1`
+	if err := tx.Exec(ctx.Ctx, q, uid, step); err != nil {
+		return fmt.Errorf("pg/Tx.EnableTOTP: %w", err)
+	}
+	return nil
+}
+
+// UseTOTPStep records that a code from the time step was accepted. It returns
+// false if a code from the same or a later step was accepted before, in which
+// case the code must be rejected.
+func UseTOTPStep(ctx cloud.Context, tx pg.Tx, uid string, step int64) (bool, error) {
+	q := `UPDATE users.profile SET totp_last_step = $2 WHERE id = $1 AND totp_last_step < $2 RETURNING id`
+
+	rows, err := tx.Query(ctx.Ctx, q, uid, step)
+	if err != nil {
+		return false, fmt.Errorf("pg/Tx.UseTOTPStep: %w", err)
+	}
+	defer rows.Close()
+
+	used := rows.Next()
+	return used, rows.Err()
+}
+
+// ReplaceRecoveryCodes discards the user's recovery codes and stores new ones.
+func ReplaceRecoveryCodes(ctx cloud.Context, tx pg.Tx, uid string, hashes []string) error {
+	if err := tx.Exec(ctx.Ctx, `DELETE FROM users.recovery_code WHERE user_id = $1`, uid); err != nil {
+		return fmt.Errorf("pg/Tx.ReplaceRecoveryCodesDelete: %w", err)
+	}
+	for _, h := range hashes {
+		q := `INSERT INTO users.recovery_code (user_id, code_hash) VALUES ($1, $2)`
+		if err := tx.Exec(ctx.Ctx, q, uid, h); err != nil {
+			return fmt.Errorf("pg/Tx.ReplaceRecoveryCodesInsert: %w", err)
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode marks the recovery code used. It returns false if the user
+// has no unused code with the hash.
+func UseRecoveryCode(ctx cloud.Context, tx pg.Tx, uid string, hash string) (bool, error) {
+	q := `UPDATE users.recovery_code SET used_at = NOW() WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL RETURNING user_id`
+
+	rows, err := tx.Query(ctx.Ctx, q, uid, hash)
+	if err != nil {
+		return false, fmt.Errorf("pg/Tx.UseRecoveryCode: %w", err)
+	}
+	defer rows.Close()
+
+	used := rows.Next()
+	return used, rows.Err()
+}
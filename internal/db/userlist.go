@@ -0,0 +1,168 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+// lastActivityAt is the user's last activity, with users who have never been
+// active sorting as the oldest. It matches profile_lastactivity_idx.
+const lastActivityAt = `COALESCE(lastactivity, 'epoch')`
+
+type userSort struct {
+	// expr is the expression the users are sorted on, and cast is the type a
+	// position's value is cast back to when a list continues after it.
+	expr string
+	cast string
+}
+
+// userSorts are the keys users can be sorted on. Ties are broken by ID, so
+// that every user has a unique position in the list.
+var userSorts = map[string]userSort{
+	"name":         {expr: `lower(lastname || ' ' || firstname)`, cast: "text"},
+	"email":        {expr: `email`, cast: "text"},
+	"lastActivity": {expr: lastActivityAt, cast: "timestamptz"},
+}
+
+// IsUserSort reports whether GetUserList can sort users on the key.
+func IsUserSort(key string) bool {
+	_, ok := userSorts[key]
+	return ok
+}
+
+// Position is where a page of a list ends: the sort value and ID of its last
+// item.
+type Position struct {
+	Value string
+	ID    string
+}
+
+// UserFilter selects and orders the users returned by GetUserList.
+type UserFilter struct {
+	// Search matches users whose name or email contains it, ignoring case.
+	Search string
+
+	// Status matches users with the status. Deleted users only match when
+	// they are asked for.
+	Status cloud.UserStatus
+
+	// ActiveAfter and ActiveBefore, if set, bound the users' last activity.
+	ActiveAfter  *time.Time
+	ActiveBefore *time.Time
+
+	// Sort is one of the keys of userSorts, and Desc reverses the order.
+	Sort string
+	Desc bool
+
+	// After, if set, is the position of the last user on the previous page.
+	After *Position
+	Limit int
+}
+
+// queryArgs collects the arguments of a query that is built up in pieces.
+type queryArgs []interface{}
+
+// add appends the argument and returns its placeholder.
+func (a *queryArgs) add(v interface{}) string {
+	*a = append(*a, v)
+	return "$" + strconv.Itoa(len(*a))
+}
+
+// conditions returns the WHERE conditions of the filter, leaving out its
+// position so that they also count the whole list.
+func (f UserFilter) conditions(args *queryArgs) []string {
+	var conds []string
+	if f.Status != "" {
+		conds = append(conds, "status = "+args.add(f.Status))
+	} else {
+		conds = append(conds, "status <> "+args.add(cloud.StatusDeleted))
+	}
+	if f.Search != "" {
+		p := args.add("%" + escapeLike(f.Search) + "%")
+		conds = append(conds, fmt.Sprintf("((firstname || ' ' || lastname) ILIKE %[1]s OR email ILIKE %[1]s)", p))
+	}
+	if f.ActiveAfter != nil {
+		conds = append(conds, lastActivityAt+" >= "+args.add(*f.ActiveAfter))
+	}
+	if f.ActiveBefore != nil {
+		conds = append(conds, lastActivityAt+" < "+args.add(*f.ActiveBefore))
+	}
+	return conds
+}
+
+// escapeLike escapes the characters LIKE patterns treat specially, so that s
+// is matched as it is.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// GetUserList returns a page of the users matching the filter, and the
+// position to continue the list from, or nil if this is the last page.
+func GetUserList(ctx cloud.Context, tx pg.Tx, f UserFilter) ([]cloud.User, *Position, error) {
+	sort, ok := userSorts[f.Sort]
+	if !ok {
+		return nil, nil, fmt.Errorf("pg/Tx.GetUserList: unknown sort %q", f.Sort)
+	}
+
+	var args queryArgs
+	conds := f.conditions(&args)
+	dir, cmp := "ASC", ">"
+	if f.Desc {
+		dir, cmp = "DESC", "<"
+	}
+	if f.After != nil {
+		conds = append(conds, fmt.Sprintf("(%s, id) %s (CAST(%s AS %s), CAST(%s AS uuid))", sort.expr, cmp, args.add(f.After.Value), sort.cast, args.add(f.After.ID)))
+	}
+	// One more user than fits on the page is fetched to tell whether there is
+	// another page.
+	query := `SELECT CAST(id AS varchar), email, firstname, lastname, mustchange, role, status, datecreated, datemodified, lastactivity, CAST(` + sort.expr + ` AS text) FROM users.profile` +
+		` WHERE ` + strings.Join(conds, " AND ") +
+		` ORDER BY ` + sort.expr + ` ` + dir + `, id ` + dir +
+		` LIMIT ` + args.add(f.Limit+1)
+
+	rows, err := tx.Query(ctx.Ctx, query, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pg/Tx.GetUserList query failed: %w", err)
+	}
+	defer rows.Close()
+
+	users := []cloud.User{}
+	var values []string
+	for rows.Next() {
+		var user cloud.User
+		var value string
+		if err = rows.Scan(&user.ID, &user.Email, &user.FirstName, &user.LastName, &user.MustChange, &user.Role, &user.Status, &user.DateCreated, &user.DateModified, &user.LastActivity, &value); err != nil {
+			return nil, nil, fmt.Errorf("pg/Tx.GetUserList Assignment: %w", err)
+		}
+		users = append(users, user)
+		values = append(values, value)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("pg/Tx.GetUserList query failed: %w", err)
+	}
+
+	if len(users) <= f.Limit {
+		return users, nil, nil
+	}
+	users = users[:f.Limit]
+	last := len(users) - 1
+	return users, &Position{Value: values[last], ID: users[last].ID}, nil
+}
+
+// CountUsers returns the number of users matching the filter, across every
+// page.
+func CountUsers(ctx cloud.Context, tx pg.Tx, f UserFilter) (int, error) {
+	var args queryArgs
+	query := `SELECT COUNT(*) FROM users.profile WHERE ` + strings.Join(f.conditions(&args), " AND ")
+
+	var n int
+	if err := tx.QueryRow(ctx.Ctx, query, args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("pg/Tx.CountUsers: %w", err)
+	}
+	return n, nil
+}
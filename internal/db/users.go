@@ -8,12 +8,12 @@ import (
 	"github.com/kmhebb/serverExample/pg"
 )
 
-var now string = string(time.Now().Format("1/2/2006 15:04"))
-
+// CreateUser inserts the user, and sets their creation and modification times
+// from the database's clock. New users have not been active yet.
 func CreateUser(ctx cloud.Context, tx pg.Tx, u *cloud.User) error {
-	query := `INSERT INTO users.profile (id, firstname, lastname, email, passhash, mustchange, datecreated, datemodified, lastactivity) VALUES ($1, $2, $3, $4, $5, $6, $7, $7, $7);`
+	query := `INSERT INTO users.profile (id, firstname, lastname, email, passhash, mustchange, role, datecreated, datemodified, status) VALUES ($1, $2, $3, $4, $5, $6, $7, NOW(), NOW(), $8) RETURNING datecreated, datemodified;`
 
-	err := tx.Exec(ctx.Ctx, query, u.ID, u.FirstName, u.LastName, u.Email, u.PasswordHash, u.MustChange, now)
+	err := tx.QueryRow(ctx.Ctx, query, u.ID, u.FirstName, u.LastName, u.Email, u.PasswordHash, u.MustChange, u.Role, u.Status).Scan(&u.DateCreated, &u.DateModified)
 	if err != nil {
 		return fmt.Errorf("failed to insert user: %w", err)
 	}
@@ -21,7 +21,7 @@ func CreateUser(ctx cloud.Context, tx pg.Tx, u *cloud.User) error {
 }
 
 func FindByEmail(ctx cloud.Context, tx pg.Tx, email string) (*cloud.User, error) {
-	query := `SELECT CAST(id AS varchar), firstname, lastname, email, passhash, mustchange, lastactivity, datecreated, datemodified FROM users.profile WHERE email = $1;`
+	query := `SELECT CAST(id AS varchar), firstname, lastname, email, passhash, mustchange, role, token_generation, failed_logins, locked_until, totp_secret, totp_enabled, totp_last_step, magic_link_enabled, status, lastactivity, datecreated, datemodified FROM users.profile WHERE email = $1;`
 	var u cloud.User
 
 	rows, err := tx.Query(ctx.Ctx, query, email)
@@ -30,7 +30,7 @@ func FindByEmail(ctx cloud.Context, tx pg.Tx, email string) (*cloud.User, error)
 	}
 
 	for rows.Next() {
-		if err = rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.PasswordHash, &u.MustChange, &u.LastActivity, &u.DateModified, &u.DateCreated); err != nil {
+		if err = rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.PasswordHash, &u.MustChange, &u.Role, &u.TokenGeneration, &u.FailedLogins, &u.LockedUntil, &u.TOTPSecret, &u.TOTPEnabled, &u.TOTPLastStep, &u.MagicLinkEnabled, &u.Status, &u.LastActivity, &u.DateCreated, &u.DateModified); err != nil {
 			return nil, fmt.Errorf("pg/Tx.UserFindByEmailAssignment: %w", err)
 		}
 	}
@@ -49,7 +49,7 @@ func FindByEmail(ctx cloud.Context, tx pg.Tx, email string) (*cloud.User, error)
 
 func FindByID(ctx cloud.Context, tx pg.Tx, id string) (*cloud.User, error) {
 
-	query := `SELECT CAST(id AS varchar), firstname, lastname, email, passhash, mustchange, lastactivity, datecreated, datemodified FROM users.profile WHERE id = $1;`
+	query := `SELECT CAST(id AS varchar), firstname, lastname, email, passhash, mustchange, role, token_generation, failed_logins, locked_until, totp_secret, totp_enabled, totp_last_step, magic_link_enabled, status, lastactivity, datecreated, datemodified FROM users.profile WHERE id = $1;`
 	var u cloud.User
 
 	rows, err := tx.Query(ctx.Ctx, query, id)
@@ -58,7 +58,7 @@ func FindByID(ctx cloud.Context, tx pg.Tx, id string) (*cloud.User, error) {
 	}
 
 	for rows.Next() {
-		if err = rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.PasswordHash, &u.MustChange, &u.LastActivity, &u.DateModified, &u.DateCreated); err != nil {
+		if err = rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.PasswordHash, &u.MustChange, &u.Role, &u.TokenGeneration, &u.FailedLogins, &u.LockedUntil, &u.TOTPSecret, &u.TOTPEnabled, &u.TOTPLastStep, &u.MagicLinkEnabled, &u.Status, &u.LastActivity, &u.DateCreated, &u.DateModified); err != nil {
 			return nil, fmt.Errorf("pg/Tx.UserFindByIDAssignment: %w", err)
 		}
 	}
@@ -72,9 +72,9 @@ func FindByID(ctx cloud.Context, tx pg.Tx, id string) (*cloud.User, error) {
 }
 
 func UpdateUserRecord(ctx cloud.Context, tx pg.Tx, u *cloud.User) error {
-	query := `UPDATE users.profile SET firstname = $2, lastname = $3, email = $4, passhash = $5, mustchange = $6, resettoken = $7, resettokenexpiration = $8, datemodified = $9 WHERE id = $1;`
+	query := `UPDATE users.profile SET firstname = $2, lastname = $3, email = $4, passhash = $5, mustchange = $6, datemodified = NOW(), magic_link_enabled = $7 WHERE id = $1;`
 
-	err := tx.Exec(ctx.Ctx, query, u.ID, u.FirstName, u.LastName, u.Email, u.PasswordHash, u.MustChange, u.ResetToken, u.ResetTokenExpiration, now)
+	err := tx.Exec(ctx.Ctx, query, u.ID, u.FirstName, u.LastName, u.Email, u.PasswordHash, u.MustChange, u.MagicLinkEnabled)
 	if err != nil {
 		return fmt.Errorf("pg/Tx.UpdateUserRecord: %w", err)
 	}
@@ -86,98 +86,95 @@ func UpdateUserRecord(ctx cloud.Context, tx pg.Tx, u *cloud.User) error {
 	return nil
 }
 
-func UpdateLastActivity(ctx cloud.Context, tx pg.Tx, uid string) error {
-	q := `UPDATE users.profile SET lastactivity = $2 WHERE id = $1`
-	err := tx.Exec(ctx.Ctx, q, uid, now)
+func UpdateUserRole(ctx cloud.Context, tx pg.Tx, uid string, role cloud.Role) error {
+	q := `UPDATE users.profile SET role = $2, datemodified = NOW() WHERE id = $1`
+	err := tx.Exec(ctx.Ctx, q, uid, role)
 	if err != nil {
-		return err
+		return fmt.Errorf("pg/Tx.UpdateUserRole: %w", err)
 	}
-
 	return nil
 }
 
-func FindByToken(ctx cloud.Context, tx pg.Tx, token string) (*cloud.User, error) {
-
-	query := `SELECT CAST(id AS varchar), firstname, lastname, email, passhash, mustchange, lastactivity, datecreated, datemodified, resettoken, resettokenexpiration FROM users.profile WHERE resettoken = $1;`
-	var u cloud.User
-
-	rows, err := tx.Query(ctx.Ctx, query, token)
+func UpdateLastActivity(ctx cloud.Context, tx pg.Tx, uid string) error {
+	q := `UPDATE users.profile SET lastactivity = NOW() WHERE id = $1`
+	err := tx.Exec(ctx.Ctx, q, uid)
 	if err != nil {
-		return nil, fmt.Errorf("pg/Tx.UserFindByTokenQuery: %w", err)
+		return err
 	}
 
-	for rows.Next() {
-		if err = rows.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.PasswordHash, &u.MustChange, &u.LastActivity, &u.DateCreated, &u.DateModified, &u.ResetToken, &u.ResetTokenExpiration); err != nil {
-			return nil, fmt.Errorf("pg/Tx.UserFindByTokenAssignment: %w", err)
-		}
-	}
+	return nil
+}
 
-	if err = UpdateLastActivity(ctx, tx, u.ID); err != nil {
-		// This reports an error in the procedure. Does not interrupt the calling procedure.
-		fmt.Println("error updating activity")
+// RecordFailedLogin counts a failed login attempt and returns the number of
+// attempts that have failed since the last successful login.
+func RecordFailedLogin(ctx cloud.Context, tx pg.Tx, uid string) (int, error) {
+	q := `UPDATE users.profile SET failed_logins = failed_logins + 1, last_failed_login = NOW() WHERE id = $1 RETURNING failed_logins`
+	var n int
+	if err := tx.QueryRow(ctx.Ctx, q, uid).Scan(&n); err != nil {
+		return 0, fmt.Errorf("pg/Tx.RecordFailedLogin: %w", err)
 	}
-
-	return &u, nil
+	return n, nil
 }
 
-func SaveValidationCode(ctx cloud.Context, tx pg.Tx, email string, code string) error {
-	q := `INSERT INTO cache.validation (code, email, datecreated) VALUES ($1, $2, NOW())`
-	err := tx.Exec(ctx.Ctx, q, code, email)
-	if err != nil {
-		return fmt.Errorf("pg/Tx.SaveValidationCode: %w", err)
+func LockUser(ctx cloud.Context, tx pg.Tx, uid string, until time.Time) error {
+	q := `UPDATE users.profile SET locked_until = $2 WHERE id = $1`
+	if err := tx.Exec(ctx.Ctx, q, uid, until); err != nil {
+		return fmt.Errorf("pg/Tx.LockUser: %w", err)
 	}
+	return nil
+}
 
+// ResetFailedLogins clears the failed login count and any lock on the user.
+func ResetFailedLogins(ctx cloud.Context, tx pg.Tx, uid string) error {
+	q := `UPDATE users.profile SET failed_logins = 0, locked_until = NULL WHERE id = $1`
+	if err := tx.Exec(ctx.Ctx, q, uid); err != nil {
+		return fmt.Errorf("pg/Tx.ResetFailedLogins: %w", err)
+	}
 	return nil
 }
 
-func GetValidationCode(ctx cloud.Context, tx pg.Tx, email string) (string, error) {
-	var code string
+// UpdateUserStatus moves the user from one status to another. It returns false
+// if the user no longer had the from status, in which case nothing is changed.
+func UpdateUserStatus(ctx cloud.Context, tx pg.Tx, uid string, from, to cloud.UserStatus) (bool, error) {
+	q := `UPDATE users.profile SET status = $3, datemodified = NOW() WHERE id = $1 AND status = $2 RETURNING id`
 
-	q := `SELECT code FROM cache.validation WHERE email=$1`
-	rows, err := tx.Query(ctx.Ctx, q, email)
+	rows, err := tx.Query(ctx.Ctx, q, uid, from, to)
 	if err != nil {
-		return code, fmt.Errorf("pg/Tx.GetValidationCode: %w", err)
+		return false, fmt.Errorf("pg/Tx.UpdateUserStatus: %w", err)
 	}
+	defer rows.Close()
 
-	for rows.Next() {
-		if err = rows.Scan(&code); err != nil {
-			return code, fmt.Errorf("pg/Tx.GetValidationCodeAssignment: %w", err)
-		}
-	}
-
-	return code, nil
+	updated := rows.Next()
+	return updated, rows.Err()
 }
 
-func DeleteValidationCode(ctx cloud.Context, tx pg.Tx, email string) error {
-	q := `DELETE FROM cache.validation WHERE email=$1`
-	err := tx.Exec(ctx.Ctx, q, email)
-	if err != nil {
-		return fmt.Errorf("pg/Tx.DeleteValidationCode: %w", err)
+// UpdatePasswordHash replaces the user's password hash, without otherwise
+// touching the profile. It is used to move users onto a new hasher.
+func UpdatePasswordHash(ctx cloud.Context, tx pg.Tx, uid, hash string) error {
+	q := `UPDATE users.profile SET passhash = $2 WHERE id = $1`
+	if err := tx.Exec(ctx.Ctx, q, uid, hash); err != nil {
+		return fmt.Errorf("pg/Tx.UpdatePasswordHash: %w", err)
 	}
 	return nil
 }
 
-func GetUserList(ctx cloud.Context, tx pg.Tx, listType string) ([]cloud.User, error) {
-	var query string
-	switch listType {
-	case "all":
-		query = `SELECT id, email, firstname, lastname, mustchange, datemodified, lastactivity from users.profile`
-	default:
-		query = `SELECT * from users.profile`
-	}
+// FindExistingEmails returns which of the emails already belong to a user.
+func FindExistingEmails(ctx cloud.Context, tx pg.Tx, emails []string) (map[string]bool, error) {
+	q := `SELECT email FROM users.profile WHERE email = ANY($1)`
 
-	var users []cloud.User
-	rows, err := tx.Query(ctx.Ctx, query)
+	rows, err := tx.Query(ctx.Ctx, q, emails)
 	if err != nil {
-		return []cloud.User{}, fmt.Errorf("pg/Tx.GetUserList query failed: %w", err)
+		return nil, fmt.Errorf("pg/Tx.FindExistingEmailsQuery: %w", err)
 	}
+	defer rows.Close()
 
+	existing := make(map[string]bool)
 	for rows.Next() {
-		var user cloud.User
-		if err = rows.Scan(&user.ID, &user.Email, &user.FirstName, &user.LastName, &user.MustChange, &user.DateModified, &user.LastActivity); err != nil {
-			return []cloud.User{}, fmt.Errorf("pg/Tx.GetUserList Assignment: %w", err)
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, fmt.Errorf("pg/Tx.FindExistingEmailsAssignment: %w", err)
 		}
-		users = append(users, user)
+		existing[email] = true
 	}
-	return users, nil
+	return existing, rows.Err()
 }
@@ -0,0 +1,165 @@
+package service
+
+import (
+	"fmt"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/db"
+	"github.com/kmhebb/serverExample/lib/token"
+	"github.com/kmhebb/serverExample/log"
+	"github.com/kmhebb/serverExample/pg"
+	"github.com/pborman/uuid"
+)
+
+// APIKeyDisplayLength is how many characters of a key, including
+// token.APIKeyPrefix, are kept in the clear to tell keys apart.
+const APIKeyDisplayLength = 12
+
+type APIKeyService struct {
+	DB Database
+	L  log.Logger
+	Au cloud.Auditor
+}
+
+type CreateAPIKeyRequest struct {
+	Name   string         `json:"name"`
+	Scopes []cloud.Action `json:"scopes"`
+}
+
+// CreateAPIKeyResponse holds the only copy of the new key. It can't be
+// recovered later, only revoked and replaced.
+type CreateAPIKeyResponse struct {
+	Key    string        `json:"key"`
+	APIKey *cloud.APIKey `json:"apiKey"`
+}
+
+type APIKeyRequest struct {
+	ID string `json:"id"`
+}
+
+type ListAPIKeysResponse struct {
+	APIKeys []*cloud.APIKey `json:"apiKeys"`
+}
+
+func (svc APIKeyService) Create(ctx cloud.Context, req CreateAPIKeyRequest) (_ *CreateAPIKeyResponse, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionCreateAPIKey, cloud.AuditTargetAPIKey, "")
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	if req.Name == "" {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "name is required",
+		})
+	}
+	if len(req.Scopes) == 0 {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "at least one scope is required",
+		})
+	}
+	for _, act := range req.Scopes {
+		if !act.Scopable() {
+			return nil, cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindBadRequest,
+				Message: fmt.Sprintf("api keys can't be scoped to %q", act),
+			})
+		}
+	}
+
+	key, hash, err := token.NewAPIKey()
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "api key service failed to generate key",
+			Cause:   err,
+		})
+	}
+	k := &cloud.APIKey{
+		ID:        uuid.New(),
+		Name:      req.Name,
+		Prefix:    key[:APIKeyDisplayLength],
+		Hash:      hash,
+		Scopes:    req.Scopes,
+		CreatedBy: ctx.UserKey,
+	}
+	entry.TargetID = k.ID
+
+	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		return db.CreateAPIKey(ctx, tx, k)
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "api key service create key db transaction failed",
+			Cause:   err,
+		})
+	}
+
+	entry.Diff(nil, k)
+	svc.L.Info(ctx.Ctx, "Created api key", log.Fields{"key_id": k.ID, "name": k.Name, "scopes": k.Scopes, "by": ctx.UserKey})
+
+	return &CreateAPIKeyResponse{Key: key, APIKey: k}, nil
+}
+
+func (svc APIKeyService) List(ctx cloud.Context) (*ListAPIKeysResponse, *cloud.Error) {
+	var resp ListAPIKeysResponse
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		resp.APIKeys, dbErr = db.ListAPIKeys(ctx, tx)
+		return dbErr
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "api key service list keys db transaction failed",
+			Cause:   err,
+		})
+	}
+
+	return &resp, nil
+}
+
+func (svc APIKeyService) Revoke(ctx cloud.Context, req APIKeyRequest) (_ interface{}, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionRevokeAPIKey, cloud.AuditTargetAPIKey, req.ID)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	if req.ID == "" {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "id is required",
+		})
+	}
+	if uuid.Parse(req.ID) == nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "id is not a valid api key id",
+		})
+	}
+
+	var revoked bool
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		revoked, dbErr = db.RevokeAPIKey(ctx, tx, req.ID)
+		return dbErr
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "api key service revoke key db transaction failed",
+			Cause:   err,
+		})
+	}
+	// Keys that were already revoked are treated as missing, so that a key is
+	// only ever reported revoked once.
+	if !revoked {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindNotFound,
+			Message: "api key not found",
+		})
+	}
+
+	entry.Diff(map[string]bool{"revoked": false}, map[string]bool{"revoked": true})
+	svc.L.Info(ctx.Ctx, "Revoked api key", log.Fields{"key_id": req.ID, "by": ctx.UserKey})
+
+	return nil, nil
+}
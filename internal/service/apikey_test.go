@@ -0,0 +1,50 @@
+package service_test
+
+import (
+	"testing"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/assert"
+	"github.com/kmhebb/serverExample/internal/service"
+)
+
+func TestAPIKeyCantActAsUser(t *testing.T) {
+	assert := assert.New(t)
+	ctx := cloud.Context{APIKeyID: "key-id", APIKeyScopes: []cloud.Action{cloud.ActionImpersonateUser}}
+	svc := service.UserService{}
+
+	var errs []*cloud.Error
+	_, e := svc.Impersonate(ctx, service.GetUserRequest{ID: "u1"})
+	errs = append(errs, e)
+	_, e = svc.Put(ctx, service.PutUserRequest{ID: "u1"})
+	errs = append(errs, e)
+	_, e = svc.Logout(ctx, service.RefreshTokenRequest{})
+	errs = append(errs, e)
+	_, e = svc.EnrollTOTP(ctx)
+	errs = append(errs, e)
+	_, e = svc.ConfirmTOTP(ctx, service.ConfirmTOTPRequest{Code: "123456"})
+	errs = append(errs, e)
+	_, e = svc.ValidateEmail(ctx, service.UserRequest{})
+	errs = append(errs, e)
+	_, e = svc.ConfirmValidation(ctx, service.ConfirmValidationRequest{Code: "123456"})
+	errs = append(errs, e)
+
+	for _, e := range errs {
+		assert.True(e != nil).Fatal()
+		assert.Equals(e.Kind(), cloud.ErrKindForbidden)
+		assert.Equals(e.Message(), "not allowed with an api key")
+	}
+}
+
+func TestRevokeAPIKeyRequiresValidID(t *testing.T) {
+	assert := assert.New(t)
+	svc := service.APIKeyService{}
+
+	_, e := svc.Revoke(cloud.Context{}, service.APIKeyRequest{})
+	assert.True(e != nil).Fatal()
+	assert.Equals(e.Kind(), cloud.ErrKindBadRequest)
+
+	_, e = svc.Revoke(cloud.Context{}, service.APIKeyRequest{ID: "not-a-uuid"})
+	assert.True(e != nil).Fatal()
+	assert.Equals(e.Kind(), cloud.ErrKindBadRequest)
+}
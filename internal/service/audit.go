@@ -0,0 +1,138 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/db"
+	"github.com/kmhebb/serverExample/log"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+// auditSort is the only order the audit log is listed in, newest first. It
+// is kept in cursors so that they can't be passed to other lists.
+const auditSort = "at"
+
+// AuditService stores the audit log in Postgres. It is the Auditor of the
+// other services, and lets admins query the log.
+type AuditService struct {
+	DB Database
+	L  log.Logger
+}
+
+type ListAuditLogRequest struct {
+	// ActorID limits the log to actions performed by the user or API key.
+	ActorID string `json:"actorId"`
+
+	// TargetType and TargetID limit the log to actions performed on the
+	// target, such as a user or a grid batch. TargetID needs TargetType.
+	TargetType string `json:"targetType"`
+	TargetID   string `json:"targetId"`
+
+	// From and To limit the log to actions performed in the range.
+	From *time.Time `json:"from"`
+	To   *time.Time `json:"to"`
+
+	// Limit is the number of entries on the page, and Cursor is the
+	// NextCursor of the previous page.
+	Limit  int    `json:"limit"`
+	Cursor string `json:"cursor"`
+}
+
+type ListAuditLogResponse struct {
+	Entries []*cloud.AuditEntry `json:"entries"`
+	Paging  cloud.Paging        `json:"paging"`
+}
+
+// Record implements cloud.Auditor. The entry is stored in its own
+// transaction, so that actions are recorded even when their own transaction
+// was rolled back. Entries that can't be stored are logged instead.
+func (svc AuditService) Record(ctx cloud.Context, e *cloud.AuditEntry) {
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		return db.CreateAuditEntry(ctx, tx, e)
+	})
+	if err != nil {
+		svc.L.Error(ctx.Ctx, err, "Failed to record audit entry", log.Fields{
+			"action":  e.Action,
+			"target":  e.TargetType + ":" + e.TargetID,
+			"actor":   e.ActorID,
+			"outcome": e.Outcome,
+		})
+	}
+}
+
+// List returns a page of the audit log, newest first.
+func (svc AuditService) List(ctx cloud.Context, req ListAuditLogRequest) (*ListAuditLogResponse, *cloud.Error) {
+	if req.TargetID != "" && req.TargetType == "" {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "targetType is required to filter by targetId",
+		})
+	}
+	if req.From != nil && req.To != nil && !req.From.Before(*req.To) {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "from must be before to",
+		})
+	}
+
+	f := db.AuditFilter{
+		ActorID:    strings.TrimSpace(req.ActorID),
+		TargetType: strings.TrimSpace(req.TargetType),
+		TargetID:   strings.TrimSpace(req.TargetID),
+		From:       req.From,
+		To:         req.To,
+		Limit:      pageLimit(req.Limit),
+	}
+	var err error
+	if f.After, err = decodeCursor(req.Cursor, auditSort); err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "cursor is invalid",
+			Cause:   err,
+		})
+	}
+
+	resp := ListAuditLogResponse{Paging: cloud.Paging{Limit: f.Limit}}
+	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var next *db.Position
+		resp.Entries, next, err = db.ListAuditEntries(ctx, tx, f)
+		if err != nil {
+			return fmt.Errorf("service/db.ListAuditEntries failed: %w", err)
+		}
+		resp.Paging.NextCursor = encodeCursor(auditSort, next)
+
+		resp.Paging.Total, err = db.CountAuditEntries(ctx, tx, f)
+		if err != nil {
+			return fmt.Errorf("service/db.CountAuditEntries failed: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "audit service list db transaction failed",
+			Cause:   err,
+		})
+	}
+	return &resp, nil
+}
+
+// audit records the entry with the auditor, if there is one.
+func audit(au cloud.Auditor, ctx cloud.Context, e *cloud.AuditEntry) {
+	if au != nil {
+		au.Record(ctx, e)
+	}
+}
+
+// auditPasswordChange records that the user's password was changed. Neither
+// the password nor its hash is ever recorded.
+func auditPasswordChange(e *cloud.AuditEntry) *cloud.AuditEntry {
+	if e.Changes == nil {
+		e.Changes = make(map[string]cloud.AuditChange)
+	}
+	e.Changes["password"] = cloud.AuditChange{After: "changed"}
+	return e
+}
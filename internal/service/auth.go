@@ -0,0 +1,147 @@
+package service
+
+import (
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/db"
+	"github.com/kmhebb/serverExample/lib/token"
+	"github.com/kmhebb/serverExample/log"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+// AuthService implements cloud.AuthorizationService by checking the role
+// stored on the requesting user's profile, or the scopes of the requesting API
+// key. It also implements web.TokenValidator, rejecting tokens that have been
+// revoked, and web.APIKeyAuthenticator.
+type AuthService struct {
+	DB Database
+	L  log.Logger
+}
+
+// Authorize returns a forbidden error unless the requesting user's role allows
+// the action. Public actions are always allowed.
+func (svc AuthService) Authorize(ctx cloud.Context, act cloud.Action) error {
+	if act.Public() {
+		return nil
+	}
+
+	if ctx.APIKeyID != "" {
+		for _, scope := range ctx.APIKeyScopes {
+			if scope == act {
+				return nil
+			}
+		}
+		svc.L.Info(ctx.Ctx, "Authorization denied", log.Fields{"key_id": ctx.APIKeyID, "action": act})
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindForbidden,
+			Message: "api key not allowed to perform this action",
+		})
+	}
+
+	if ctx.UserKey == "" {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindForbidden,
+			Message: "user not allowed to perform this action",
+		})
+	}
+
+	var u *cloud.User
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		u, dbErr = db.FindByID(ctx, tx, ctx.UserKey)
+		return dbErr
+	})
+	if err != nil {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "auth service find by id db transaction failed",
+			Cause:   err,
+		})
+	}
+
+	if u.ID == "" || !u.Role.Can(act) {
+		svc.L.Info(ctx.Ctx, "Authorization denied", log.Fields{"user": ctx.UserKey, "role": u.Role, "action": act})
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindForbidden,
+			Message: "user not allowed to perform this action",
+		})
+	}
+
+	return nil
+}
+
+// ValidateToken rejects tokens that were revoked individually, that were
+// issued before the user's token generation was last bumped, or that belong to
+// a user who is no longer active. Impersonation tokens are also rejected once
+// the impersonator is no longer allowed to impersonate.
+func (svc AuthService) ValidateToken(ctx cloud.Context, claims *token.Claims) error {
+	var u, imp *cloud.User
+	var revoked bool
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		if revoked, dbErr = db.IsAccessTokenRevoked(ctx, tx, claims.ID); dbErr != nil {
+			return dbErr
+		}
+		if claims.Impersonator != "" {
+			if imp, dbErr = db.FindByID(ctx, tx, claims.Impersonator); dbErr != nil {
+				return dbErr
+			}
+		}
+		u, dbErr = db.FindByID(ctx, tx, claims.UID)
+		return dbErr
+	})
+	if err != nil {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "auth service validate token db transaction failed",
+			Cause:   err,
+		})
+	}
+
+	if revoked || u.ID == "" || u.TokenGeneration != claims.Generation {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindAuthenticate,
+			Message: "token is no longer valid",
+		})
+	}
+	if e := statusError(u); e != nil {
+		return e
+	}
+	if imp != nil && (imp.ID == "" || imp.Status != cloud.StatusActive || !imp.Role.Can(cloud.ActionImpersonateUser)) {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindAuthenticate,
+			Message: "token is no longer valid",
+		})
+	}
+
+	return nil
+}
+
+// AuthenticateAPIKey returns the API key if it exists and has not been revoked,
+// and records that it was used.
+func (svc AuthService) AuthenticateAPIKey(ctx cloud.Context, key string) (*cloud.APIKey, error) {
+	var k *cloud.APIKey
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		k, dbErr = db.FindAPIKey(ctx, tx, token.Hash(key))
+		if dbErr != nil || k == nil || k.RevokedAt != nil {
+			return dbErr
+		}
+		return db.TouchAPIKey(ctx, tx, k.ID)
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "auth service authenticate api key db transaction failed",
+			Cause:   err,
+		})
+	}
+
+	if k == nil || k.RevokedAt != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindAuthenticate,
+			Message: "api key is invalid or revoked",
+		})
+	}
+
+	return k, nil
+}
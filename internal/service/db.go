@@ -1,32 +1,99 @@
 package service
 
 import (
+	"time"
+
 	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/db"
 	"github.com/kmhebb/serverExample/pg"
 )
 
 type Tx interface {
 	// User DB methods
-	FindByToken(ctx cloud.Context, token string) (*cloud.User, error)
 	FindByID(ctx cloud.Context, token string) (*cloud.User, error)
 	UpdateUserRecord(ctx cloud.Context, u *cloud.User) error
 	FindByEmail(ctx cloud.Context, email string) (*cloud.User, error)
 	CreateUser(ctx cloud.Context, u *cloud.User) error
-	SaveValidationCode(ctx cloud.Context, email string, code string) error
-	GetValidationCode(ctx cloud.Context, e string) (string, error)
-	DeleteValidationCode(ctx cloud.Context, email string) error
+	SaveEmailChange(ctx cloud.Context, ch *cloud.EmailChange) error
+	FindEmailChange(ctx cloud.Context, uid string) (*cloud.EmailChange, error)
+	RecordEmailChangeAttempt(ctx cloud.Context, uid string) error
+	DeleteEmailChange(ctx cloud.Context, uid string) error
+	UpdateUserEmail(ctx cloud.Context, uid, email string) error
+	EmailInUse(ctx cloud.Context, email, uid string) (bool, error)
 	UpdateLastActivity(ctx cloud.Context, uid string) error
-	GetUserList(ctx cloud.Context, listType string) ([]cloud.User, error)
+	FindExistingEmails(ctx cloud.Context, emails []string) (map[string]bool, error)
+	GetUserList(ctx cloud.Context, f db.UserFilter) ([]cloud.User, *db.Position, error)
+	CountUsers(ctx cloud.Context, f db.UserFilter) (int, error)
+	UpdateUserRole(ctx cloud.Context, uid string, role cloud.Role) error
+	UpdateUserStatus(ctx cloud.Context, uid string, from, to cloud.UserStatus) (bool, error)
+	RecordFailedLogin(ctx cloud.Context, uid string) (int, error)
+	LockUser(ctx cloud.Context, uid string, until time.Time) error
+	ResetFailedLogins(ctx cloud.Context, uid string) error
+	UpdatePasswordHash(ctx cloud.Context, uid, hash string) error
+	PasswordHistory(ctx cloud.Context, uid string, n int) ([]string, error)
+	AddPasswordHistory(ctx cloud.Context, uid, hash string, keep int) error
+	CreatePasswordReset(ctx cloud.Context, uid, hash string, expiresAt time.Time) error
+	FindPasswordReset(ctx cloud.Context, hash string) (string, error)
+	UsePasswordReset(ctx cloud.Context, hash string) (string, error)
+	ConsumeToken(ctx cloud.Context, jti string, uid string, expires time.Time) (bool, error)
+	SaveOIDCState(ctx cloud.Context, state, nonce, verifier string, expiresAt time.Time) error
+	UseOIDCState(ctx cloud.Context, state string) (nonce string, verifier string, ok bool, err error)
+	CreateInvite(ctx cloud.Context, inv *cloud.Invite) error
+	FindInvite(ctx cloud.Context, id string) (*cloud.Invite, error)
+	FindInviteByHash(ctx cloud.Context, hash string) (*cloud.Invite, error)
+	ListPendingInvites(ctx cloud.Context) ([]*cloud.Invite, error)
+	AcceptInvite(ctx cloud.Context, id string) (bool, error)
+	RevokeInvite(ctx cloud.Context, id string) error
+	RevokeUserInvites(ctx cloud.Context, uid string) error
+	SetTOTPSecret(ctx cloud.Context, uid string, secret string) error
+	EnableTOTP(ctx cloud.Context, uid string, step int64) error
+	UseTOTPStep(ctx cloud.Context, uid string, step int64) (bool, error)
+	ReplaceRecoveryCodes(ctx cloud.Context, uid string, hashes []string) error
+	UseRecoveryCode(ctx cloud.Context, uid string, hash string) (bool, error)
+
+	// Token DB methods
+	SaveRefreshToken(ctx cloud.Context, rt *cloud.RefreshToken) error
+	FindRefreshToken(ctx cloud.Context, hash string) (*cloud.RefreshToken, error)
+	MarkRefreshTokenUsed(ctx cloud.Context, id string) error
+	RevokeRefreshTokenFamily(ctx cloud.Context, familyID string) error
+	RevokeUserRefreshTokens(ctx cloud.Context, uid string) error
+	RevokeAllTokens(ctx cloud.Context, uid string) error
+	RevokeAccessToken(ctx cloud.Context, jti string, uid string, expires time.Time) error
+	IsAccessTokenRevoked(ctx cloud.Context, jti string) (bool, error)
+
+	// API key DB methods
+	CreateAPIKey(ctx cloud.Context, k *cloud.APIKey) error
+	FindAPIKey(ctx cloud.Context, hash string) (*cloud.APIKey, error)
+	ListAPIKeys(ctx cloud.Context) ([]*cloud.APIKey, error)
+	TouchAPIKey(ctx cloud.Context, id string) error
+	RevokeAPIKey(ctx cloud.Context, id string) (bool, error)
+
+	// Audit DB methods
+	CreateAuditEntry(ctx cloud.Context, e *cloud.AuditEntry) error
+	ListAuditEntries(ctx cloud.Context, f db.AuditFilter) ([]*cloud.AuditEntry, *db.Position, error)
+	CountAuditEntries(ctx cloud.Context, f db.AuditFilter) (int, error)
 
 	// Data Service DB methods
-	ImportGridData(ctx cloud.Context, data *[]cloud.GridDataRecord) error
-	DeleteGridData(ctx cloud.Context, BatchID string) error
+	CreateGridStaging(ctx cloud.Context) error
+	StageGridData(ctx cloud.Context, rows []db.StagedGridRow) (int64, error)
+	CheckStagedGridData(ctx cloud.Context) ([]cloud.GridRowError, error)
+	QuarantineStagedGridRows(ctx cloud.Context, batchID string, lines []int) error
+	CheckGridConflicts(ctx cloud.Context, limit int) ([]cloud.GridConflict, int, error)
+	SkipConflictingGridRows(ctx cloud.Context) error
+	ReplaceConflictingGridRows(ctx cloud.Context) ([]string, error)
+	ImportStagedGridData(ctx cloud.Context, batchID string) error
+	DeleteGridData(ctx cloud.Context, BatchID string) (string, error)
 	GetGridBatchList(ctx cloud.Context, ListType string) error
+	CreateGridImport(ctx cloud.Context, r *cloud.GridImportReport, header []string) error
+	UpdateGridImport(ctx cloud.Context, r *cloud.GridImportReport) error
+	QuarantineGridRows(ctx cloud.Context, batchID string, rows []cloud.GridQuarantinedRow) error
+	ListGridImportsByHash(ctx cloud.Context, hash string, batchID string) ([]string, error)
+	GetGridImport(ctx cloud.Context, batchID string) (*cloud.GridImportReport, []string, error)
+	ListGridQuarantine(ctx cloud.Context, batchID string) ([]cloud.GridQuarantinedRow, error)
 	GetBillingDataList(ctx cloud.Context, ListType string) ([]cloud.BillingData, error)
 	SyncronizeUtilibillStatementData(ctx cloud.Context, data []cloud.StatementData) error
 	ListInvoiceDataByCustomerID(ctx cloud.Context, customerid int) ([]cloud.StatementData, error)
 	GetInvoiceData(ctx cloud.Context, customerID int, statementID int) (cloud.StatementData, error)
-	UserAccess(ctx cloud.Context) error
 	SynchronizeUtilibillCustomerList(ctx cloud.Context, data []cloud.UBCustomerSummary) error
 	GetCustomerNumberList(ctx cloud.Context) (cloud.UBCustomerNumberList, error)
 	SynchronizeUtilibillCustomerData(ctx cloud.Context, data []cloud.UBCustomerDetail) error
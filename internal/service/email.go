@@ -0,0 +1,222 @@
+package service
+
+import (
+	"crypto/subtle"
+	"net/mail"
+	"strings"
+	"time"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/db"
+	"github.com/kmhebb/serverExample/lib/random"
+	"github.com/kmhebb/serverExample/lib/token"
+	"github.com/kmhebb/serverExample/log"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+const (
+	// EmailChangeExpiration is how long users have to confirm a new email
+	// with the code sent to it.
+	EmailChangeExpiration = 30 * time.Minute
+
+	// EmailChangeCodeLength is the number of characters in the code.
+	EmailChangeCodeLength = 6
+
+	// MaxEmailChangeAttempts is the number of wrong codes that can be
+	// entered before the change has to be requested again.
+	MaxEmailChangeAttempts = 5
+)
+
+// ValidateEmail starts changing the requesting user's email to req.Email. A
+// code is sent to the new address, and the change only applies once the code
+// is entered through ConfirmValidation.
+func (svc UserService) ValidateEmail(ctx cloud.Context, req UserRequest) (_ interface{}, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionChangeEmail, cloud.AuditTargetUser, ctx.UserKey)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	if e := forbidAPIKey(ctx); e != nil {
+		return nil, e
+	}
+	if e := forbidImpersonated(ctx); e != nil {
+		return nil, e
+	}
+
+	var u *cloud.User
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		u, dbErr = db.FindByID(ctx, tx, ctx.UserKey)
+		return dbErr
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service find by id db transaction failed",
+			Cause:   err,
+		})
+	}
+	if u.ID == "" {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindNotFound,
+			Message: "user not found",
+		})
+	}
+	if strings.ToLower(strings.TrimSpace(req.Email)) == u.Email {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "that is already your email",
+		})
+	}
+
+	return nil, svc.requestEmailChange(ctx, u, req.Email)
+}
+
+// requestEmailChange holds the change of the user's email as pending, replacing
+// any change they had already asked for. The code confirming it is sent to the
+// new address, and the old address is told about the change.
+func (svc UserService) requestEmailChange(ctx cloud.Context, u *cloud.User, email string) *cloud.Error {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !validEmail(email) {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "email is not a valid address",
+		})
+	}
+
+	code := random.GenerateCode(EmailChangeCodeLength)
+	ch := &cloud.EmailChange{
+		UserID:    u.ID,
+		Email:     email,
+		Hash:      token.Hash(code),
+		ExpiresAt: time.Now().Add(EmailChangeExpiration),
+	}
+
+	var inUse bool
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var err error
+		if inUse, err = db.EmailInUse(ctx, tx, email, u.ID); err != nil || inUse {
+			return err
+		}
+		return db.SaveEmailChange(ctx, tx, ch)
+	})
+	if err != nil {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service save email change db transaction failed",
+			Cause:   err,
+		})
+	}
+	if inUse {
+		return errEmailInUse()
+	}
+
+	svc.L.Info(ctx.Ctx, "Email change requested", log.Fields{"user": u.ID, "email": email, "by": ctx.UserKey})
+	svc.Em.ValidateEmailAsync(ctx, email, code)
+	svc.Em.EmailChangeAsync(ctx, svc.Name(u), u.Email, email)
+	return nil
+}
+
+// ConfirmValidation applies the requesting user's pending email change, once
+// they enter the code sent to the new address. The change is dropped once it
+// expires or too many wrong codes have been entered, and has to be requested
+// again.
+func (svc UserService) ConfirmValidation(ctx cloud.Context, req ConfirmValidationRequest) (_ interface{}, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionConfirmEmail, cloud.AuditTargetUser, ctx.UserKey)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	if req.Code == "" {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "code is required",
+		})
+	}
+	if e := forbidAPIKey(ctx); e != nil {
+		return nil, e
+	}
+	if e := forbidImpersonated(ctx); e != nil {
+		return nil, e
+	}
+	code := strings.ToUpper(strings.TrimSpace(req.Code))
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+
+	// Wrong codes are counted, so the transaction is committed even when the
+	// change is refused.
+	var ch *cloud.EmailChange
+	var refused *cloud.Error
+	var oldEmail string
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var err error
+		if ch, err = db.FindEmailChange(ctx, tx, ctx.UserKey); err != nil {
+			return err
+		}
+		switch {
+		case ch == nil:
+			refused = cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindBadRequest,
+				Message: "no email change is waiting to be confirmed",
+			})
+			return nil
+		case !time.Now().Before(ch.ExpiresAt) || ch.Attempts >= MaxEmailChangeAttempts:
+			refused = cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindBadRequest,
+				Message: "code has expired, change your email again to get a new one",
+			})
+			return db.DeleteEmailChange(ctx, tx, ctx.UserKey)
+		case email != "" && email != ch.Email,
+			subtle.ConstantTimeCompare([]byte(token.Hash(code)), []byte(ch.Hash)) != 1:
+			refused = cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindBadRequest,
+				Message: "code is not correct",
+			})
+			return db.RecordEmailChangeAttempt(ctx, tx, ctx.UserKey)
+		}
+
+		// Someone else may have taken the address since the change was asked
+		// for.
+		inUse, err := db.EmailInUse(ctx, tx, ch.Email, ctx.UserKey)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			refused = errEmailInUse()
+			return db.DeleteEmailChange(ctx, tx, ctx.UserKey)
+		}
+		u, err := db.FindByID(ctx, tx, ctx.UserKey)
+		if err != nil {
+			return err
+		}
+		oldEmail = u.Email
+		if err := db.UpdateUserEmail(ctx, tx, ctx.UserKey, ch.Email); err != nil {
+			return err
+		}
+		return db.DeleteEmailChange(ctx, tx, ctx.UserKey)
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service confirm email change db transaction failed",
+			Cause:   err,
+		})
+	}
+	if refused != nil {
+		svc.L.Info(ctx.Ctx, "Email change refused", log.Fields{"user": ctx.UserKey, "reason": refused.Message()})
+		return nil, refused
+	}
+
+	svc.L.Info(ctx.Ctx, "Email changed", log.Fields{"user": ctx.UserKey, "email": ch.Email})
+	entry.Diff(map[string]string{"email": oldEmail}, map[string]string{"email": ch.Email})
+	return nil, nil
+}
+
+// validEmail reports whether email is a bare address, without a display name
+// or anything else around it.
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email
+}
+
+func errEmailInUse() *cloud.Error {
+	return cloud.NewError(cloud.ErrOpts{
+		Kind:    cloud.ErrKindBadRequest,
+		Message: "email already in use on this platform, choose a different email",
+	})
+}
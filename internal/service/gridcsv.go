@@ -0,0 +1,273 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cloud "github.com/kmhebb/serverExample"
+)
+
+// gridDateLayout is the format of the dates in a grid data file.
+const gridDateLayout = "2006-01-02"
+
+// GridLayout is a known layout of the grid data files exported by the
+// utility. Columns are found by their header, so a layout only describes the
+// headers it names differently and the columns it may leave out. New layouts
+// are added to the end of gridLayouts when the utility changes its export.
+type GridLayout struct {
+	Version string
+
+	// Aliases maps the headers of the layout to the csv tag of the
+	// cloud.GridDataRecord field they hold. Headers are matched after
+	// normalizeGridHeader.
+	Aliases map[string]string
+
+	// Optional are the csv tags of the fields the layout may leave out.
+	// Missing fields are left at their zero value.
+	Optional []string
+}
+
+// gridLayouts are the known layouts, oldest first.
+var gridLayouts = []GridLayout{
+	{
+		// The original export, whose headers are the csv tags.
+		Version: "1",
+	},
+	{
+		// The export with descriptive headers, which dropped the
+		// community credit column.
+		Version: "2",
+		Aliases: map[string]string{
+			"host_account":          "host_acct",
+			"satellite_account":     "sat_acct",
+			"service_class":         "sat_serv_class",
+			"satellite_vdl":         "sat_vdl",
+			"satellite_status":      "sat_status",
+			"transfer_kwh":          "trans_kwh",
+			"bill_period":           "host_bill_period",
+			"satellite_bill_date":   "sat_bill_date",
+			"satellite_bill_amount": "sat_bill_amt",
+			"banked_carryover":      "banked_carry_over",
+		},
+		Optional: []string{"vder_cc"},
+	},
+}
+
+// gridAliases are headers every layout may use for a column.
+var gridAliases = map[string]string{
+	// Early exports misspelled the column, as did the struct tag.
+	"vdr_drv": "vder_drv",
+}
+
+// gridKeyTags are the csv tags of the columns that identify a record: the
+// host and satellite accounts, and the billing period.
+var gridKeyTags = map[string]bool{
+	"host_acct":        true,
+	"sat_acct":         true,
+	"host_bill_period": true,
+}
+
+// gridField is a field of cloud.GridDataRecord that is read from a column.
+type gridField struct {
+	tag   string
+	index int
+}
+
+// gridFields are the fields of cloud.GridDataRecord with a csv tag, in order.
+var gridFields = func() []gridField {
+	var fields []gridField
+	t := reflect.TypeOf(cloud.GridDataRecord{})
+	for i := 0; i < t.NumField(); i++ {
+		if tag := t.Field(i).Tag.Get("csv"); tag != "" && tag != "-" {
+			fields = append(fields, gridField{tag: tag, index: i})
+		}
+	}
+	return fields
+}()
+
+// gridTags are the csv tags of gridFields.
+var gridTags = func() map[string]bool {
+	tags := make(map[string]bool)
+	for _, f := range gridFields {
+		tags[f.tag] = true
+	}
+	return tags
+}()
+
+// GridMapping maps the columns of a grid data file to the fields of
+// cloud.GridDataRecord. Columns it doesn't know are ignored.
+type GridMapping struct {
+	Layout string
+
+	// columns holds the column index of each field, or -1 for optional
+	// fields missing from the file.
+	columns []int
+}
+
+// NewGridMapping matches the header row of a grid data file against a
+// layout. If version is empty, the first layout the header satisfies is
+// used, so that files which fit an older, stricter layout are read with it.
+// The file is rejected if it is missing a column the layout requires, or has
+// two columns for the same field.
+func NewGridMapping(header []string, version string) (*GridMapping, *cloud.Error) {
+	layouts := gridLayouts
+	if version != "" {
+		layouts = nil
+		for _, l := range gridLayouts {
+			if l.Version == version {
+				layouts = []GridLayout{l}
+			}
+		}
+		if layouts == nil {
+			return nil, cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindBadRequest,
+				Message: fmt.Sprintf("unknown grid data layout %q", version),
+			})
+		}
+	}
+
+	// The file is matched against each layout in turn, and when none of them
+	// fit it is the missing columns of each that are reported.
+	missing := make(map[string][]string)
+	for _, l := range layouts {
+		m, cols, e := l.match(header)
+		if e != nil {
+			return nil, e
+		}
+		if len(cols) == 0 {
+			return m, nil
+		}
+		missing[l.Version] = cols
+	}
+
+	msg := "grid data file is missing required columns"
+	if len(layouts) == 1 {
+		msg += ": " + strings.Join(missing[layouts[0].Version], ", ")
+	}
+	return nil, cloud.NewError(cloud.ErrOpts{
+		Kind:    cloud.ErrKindBadRequest,
+		Message: msg,
+		Details: missing,
+	})
+}
+
+// match maps the header to the layout's fields. It returns the required
+// columns the header is missing, if any, rather than a mapping.
+func (l GridLayout) match(header []string) (*GridMapping, []string, *cloud.Error) {
+	found := make(map[string]int)
+	for i, h := range header {
+		tag := normalizeGridHeader(h)
+		if alias, ok := l.Aliases[tag]; ok {
+			tag = alias
+		} else if alias, ok := gridAliases[tag]; ok {
+			tag = alias
+		}
+		if !gridTags[tag] {
+			continue
+		}
+		if _, ok := found[tag]; ok {
+			return nil, nil, cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindBadRequest,
+				Message: fmt.Sprintf("grid data file has more than one %s column", tag),
+			})
+		}
+		found[tag] = i
+	}
+
+	optional := make(map[string]bool)
+	for _, tag := range l.Optional {
+		optional[tag] = true
+	}
+	m := &GridMapping{Layout: l.Version, columns: make([]int, len(gridFields))}
+	var missing []string
+	for i, f := range gridFields {
+		col, ok := found[f.tag]
+		switch {
+		case ok:
+			m.columns[i] = col
+		case optional[f.tag]:
+			m.columns[i] = -1
+		default:
+			missing = append(missing, f.tag)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, missing, nil
+	}
+	return m, nil, nil
+}
+
+// Record decodes a row of the file. Empty cells are left at their zero value,
+// except for the columns that identify a record, which are required. Each cell
+// that is missing or can't be decoded is returned as a FieldError named for
+// its column, and leaves its field at the zero value.
+func (m *GridMapping) Record(row []string) (cloud.GridDataRecord, []*FieldError) {
+	var gd cloud.GridDataRecord
+	var fes []*FieldError
+	v := reflect.ValueOf(&gd).Elem()
+	for i, f := range gridFields {
+		col := m.columns[i]
+		if col < 0 {
+			continue
+		}
+		if col >= len(row) {
+			fes = append(fes, NewFieldError(f.tag, "Missing from the row"))
+			continue
+		}
+		s := strings.TrimSpace(row[col])
+		if s == "" {
+			if gridKeyTags[f.tag] {
+				fes = append(fes, NewFieldError(f.tag, "Required"))
+			}
+			continue
+		}
+		if err := setGridField(v.Field(f.index), s); err != nil {
+			fes = append(fes, NewFieldError(f.tag, err.Error()))
+		}
+	}
+	return gd, fes
+}
+
+// setGridField parses s into a field of cloud.GridDataRecord.
+func setGridField(fv reflect.Value, s string) error {
+	switch fv.Interface().(type) {
+	case string:
+		fv.SetString(s)
+	case int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return errors.New("Must be a whole number")
+		}
+		fv.SetInt(int64(n))
+	case float64:
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return errors.New("Must be a number")
+		}
+		fv.SetFloat(n)
+	case time.Time:
+		t, err := time.Parse(gridDateLayout, s)
+		if err != nil {
+			return errors.New("Must be a date formatted as YYYY-MM-DD")
+		}
+		fv.Set(reflect.ValueOf(t))
+	default:
+		return errors.New("Cannot be imported")
+	}
+	return nil
+}
+
+// normalizeGridHeader returns the header in the form of a csv tag, so that
+// "Host Acct" and "host-acct" both match host_acct.
+func normalizeGridHeader(h string) string {
+	h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+	return strings.Join(strings.FieldsFunc(h, func(r rune) bool {
+		return r == ' ' || r == '-' || r == '_'
+	}), "_")
+}
@@ -0,0 +1,104 @@
+package service_test
+
+import (
+	"testing"
+	"time"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/assert"
+	"github.com/kmhebb/serverExample/internal/service"
+)
+
+var gridHeaderV1 = []string{
+	"host_acct", "sat_acct", "satellite_name", "sat_serv_class", "sat_vdl", "sat_status",
+	"vder_energy", "vder_cap", "vder_env", "vdr_drv", "vder_lsrv", "vder_mtc", "vder_cc", "vder_total",
+	"trans_kwh", "allocation", "host_bill_period", "transfer_date", "sat_bill_date",
+	"banked_prior_month", "current_vder", "total_available", "sat_bill_amt", "applied", "banked_carry_over",
+}
+
+func TestGridMappingByHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	// Columns are read by their header, whatever order they are in.
+	header := append([]string{"Notes"}, gridHeaderV1...)
+	header[1], header[2] = header[2], header[1]
+	m, e := service.NewGridMapping(header, "")
+	assert.True(e == nil)
+	assert.Equals(m.Layout, "1")
+
+	row := make([]string, len(header))
+	row[0] = "ignored"
+	row[1], row[2], row[10] = "202", "101", "1.5"
+	row[17], row[18] = "2021-02", "2021-03-04"
+	gd, fes := m.Record(row)
+	assert.Equals(len(fes), 0)
+	assert.Equals(gd.HostAcct, 101)
+	assert.Equals(gd.SatAcct, 202)
+	assert.Equals(gd.VderDrv, 1.5)
+	assert.Equals(gd.TransferDate, time.Date(2021, 3, 4, 0, 0, 0, 0, time.UTC))
+
+	row[1], row[18] = "two", "03/04/2021"
+	_, fes = m.Record(row)
+	assert.Equals(fes, []*service.FieldError{
+		{Name: "sat_acct", Errors: []string{"Must be a whole number"}},
+		{Name: "transfer_date", Errors: []string{"Must be a date formatted as YYYY-MM-DD"}},
+	})
+}
+
+func TestGridMappingLayouts(t *testing.T) {
+	assert := assert.New(t)
+
+	// The descriptive headers and missing vder_cc column are layout 2.
+	header := []string{"Host Account", "Satellite Account"}
+	for _, h := range gridHeaderV1[2:] {
+		if h != "vder_cc" {
+			header = append(header, h)
+		}
+	}
+	m, e := service.NewGridMapping(header, "")
+	assert.True(e == nil)
+	assert.Equals(m.Layout, "2")
+
+	_, e = service.NewGridMapping(header, "1")
+	assert.True(e != nil)
+	assert.Equals(e.Kind(), cloud.ErrKindBadRequest)
+	assert.Equals(e.Message(), "grid data file is missing required columns: host_acct, sat_acct, vder_cc")
+
+	_, e = service.NewGridMapping(gridHeaderV1, "3")
+	assert.True(e != nil)
+	assert.Equals(e.Message(), `unknown grid data layout "3"`)
+}
+
+func TestGridMappingRejectsHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	_, e := service.NewGridMapping(gridHeaderV1[1:], "")
+	assert.True(e != nil)
+	assert.Equals(e.Message(), "grid data file is missing required columns")
+	assert.Equals(e.Details(), map[string][]string{"1": {"host_acct"}, "2": {"host_acct"}})
+
+	_, e = service.NewGridMapping(append([]string{"Host Acct"}, gridHeaderV1...), "")
+	assert.True(e != nil)
+	assert.Equals(e.Message(), "grid data file has more than one host_acct column")
+}
+
+func TestGridMappingRequiredCells(t *testing.T) {
+	assert := assert.New(t)
+	m, e := service.NewGridMapping(gridHeaderV1, "1")
+	assert.True(e == nil)
+
+	// The columns that identify a record can't be empty, and a short row is
+	// missing the columns after its end.
+	row := make([]string, 20)
+	row[0], row[1] = "101", " "
+	_, fes := m.Record(row)
+	assert.Equals(fes, []*service.FieldError{
+		{Name: "sat_acct", Errors: []string{"Required"}},
+		{Name: "host_bill_period", Errors: []string{"Required"}},
+		{Name: "current_vder", Errors: []string{"Missing from the row"}},
+		{Name: "total_available", Errors: []string{"Missing from the row"}},
+		{Name: "sat_bill_amt", Errors: []string{"Missing from the row"}},
+		{Name: "applied", Errors: []string{"Missing from the row"}},
+		{Name: "banked_carry_over", Errors: []string{"Missing from the row"}},
+	})
+}
@@ -0,0 +1,437 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/instrumentation"
+	"github.com/kmhebb/serverExample/internal/db"
+	"github.com/kmhebb/serverExample/log"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+// The rules for a grid data file with rows that can't be imported.
+// GridRejectFile rejects the whole file. GridQuarantine imports the valid rows
+// and sets the rest aside with the batch.
+const (
+	GridRejectFile = "reject"
+	GridQuarantine = "quarantine"
+)
+
+// The modes of importing a grid data file that was already imported, in whole
+// or in part. GridSkip imports only the rows that weren't, and nothing if the
+// file was. GridReplace deletes the earlier rows and imports the file in their
+// place. GridForce imports the file as a new batch regardless. Without a mode,
+// such a file is rejected so that its credits aren't counted twice.
+const (
+	GridSkip    = "skip"
+	GridReplace = "replace"
+	GridForce   = "force"
+)
+
+// GridImportPolicy decides how grid data files are imported. Zero fields take
+// their value from DefaultGridImportPolicy.
+type GridImportPolicy struct {
+	// Rule is the rule for files with rows that can't be imported, unless
+	// the import asks for another.
+	Rule string
+
+	// MaxUploadSize is the largest file, in bytes, that can be imported.
+	MaxUploadSize int64
+
+	// UploadDir is the directory imported files are kept in, named by the
+	// ID of their batch.
+	UploadDir string
+}
+
+var DefaultGridImportPolicy = GridImportPolicy{
+	Rule:          GridRejectFile,
+	MaxUploadSize: 100 << 20,
+	UploadDir:     "uploads/grid",
+}
+
+// gridChunkSize is the number of rows copied to the database at a time. Only
+// one chunk of a file is held in memory.
+const gridChunkSize = 1000
+
+// maxGridReportErrors is the most errors a report lists.
+const maxGridReportErrors = 1000
+
+// rule returns the rule an import follows, which is the requested rule if
+// there is one.
+func (p GridImportPolicy) rule(requested string) (string, *cloud.Error) {
+	rule := requested
+	if rule == "" {
+		rule = p.Rule
+	}
+	if rule == "" {
+		rule = DefaultGridImportPolicy.Rule
+	}
+	if rule != GridRejectFile && rule != GridQuarantine {
+		return "", cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "rule must be reject or quarantine",
+		})
+	}
+	return rule, nil
+}
+
+// gridImportMode checks the mode an import asked for.
+func gridImportMode(mode string) *cloud.Error {
+	switch mode {
+	case "", GridSkip, GridReplace, GridForce:
+		return nil
+	}
+	return cloud.NewError(cloud.ErrOpts{
+		Kind:    cloud.ErrKindBadRequest,
+		Message: "mode must be skip, replace or force",
+	})
+}
+
+// errGridImportSkipped rolls back an import that GridSkip left nothing to
+// import from.
+var errGridImportSkipped = errors.New("grid import skipped")
+
+type GridImportReportRequest struct {
+	BatchID string `json:"id"`
+}
+
+type GridImportReportResponse struct {
+	Report *cloud.GridImportReport `json:"report"`
+
+	// Header is the header of the imported file, which names the columns of
+	// the quarantined rows.
+	Header      []string                   `json:"header"`
+	Quarantined []cloud.GridQuarantinedRow `json:"quarantined"`
+}
+
+// keepUpload copies an upload to the file it is kept in, no further than the
+// size limit, and sets its path, size and hash on the report. The upload is
+// read in full before the import touches the database, so that a slow client
+// can't hold a transaction open. The file is left behind if it fails, for the
+// caller to remove.
+func (p GridImportPolicy) keepUpload(r *cloud.GridImportReport, src io.Reader) *cloud.Error {
+	dir := p.UploadDir
+	if dir == "" {
+		dir = DefaultGridImportPolicy.UploadDir
+	}
+	r.File.Path = filepath.Join(dir, r.BatchID+".csv")
+	err := os.MkdirAll(dir, 0o750)
+	var f *os.File
+	if err == nil {
+		f, err = os.OpenFile(r.File.Path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	}
+	if err != nil {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "failed to keep uploaded file",
+			Cause:   err,
+		})
+	}
+	defer f.Close()
+
+	upload := &gridUpload{r: src, w: f, limit: p.UploadLimit(), hash: sha256.New()}
+	if _, err := io.Copy(io.Discard, upload); err != nil {
+		return p.readError(err)
+	}
+	if err := f.Close(); err != nil {
+		return p.readError(fmt.Errorf("%w: %v", errUploadNotKept, err))
+	}
+	r.File.Size, r.File.Hash = upload.size, upload.sum()
+	return nil
+}
+
+// readError returns the error for an upload that couldn't be read.
+func (p GridImportPolicy) readError(err error) *cloud.Error {
+	switch {
+	case errors.Is(err, errUploadTooLarge):
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: fmt.Sprintf("grid data file is larger than the %d byte limit", p.UploadLimit()),
+		})
+	case errors.Is(err, errUploadNotKept):
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "failed to keep uploaded file",
+			Cause:   err,
+		})
+	}
+	return cloud.NewError(cloud.ErrOpts{
+		Kind:    cloud.ErrKindBadRequest,
+		Message: "failed to read csv data",
+		Cause:   err,
+	})
+}
+
+// UploadLimit returns the largest file, in bytes, that can be imported.
+func (p GridImportPolicy) UploadLimit() int64 {
+	if p.MaxUploadSize == 0 {
+		return DefaultGridImportPolicy.MaxUploadSize
+	}
+	return p.MaxUploadSize
+}
+
+var (
+	errUploadTooLarge = errors.New("upload is too large")
+	errUploadNotKept  = errors.New("upload could not be kept")
+)
+
+// gridUpload reads an upload, no further than its size limit, and keeps a
+// copy and the SHA-256 of everything it reads.
+type gridUpload struct {
+	r     io.Reader
+	w     io.Writer
+	limit int64
+	size  int64
+	hash  hash.Hash
+}
+
+func (u *gridUpload) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	u.size += int64(n)
+	if u.size > u.limit {
+		return 0, errUploadTooLarge
+	}
+	if n > 0 {
+		if _, werr := u.w.Write(p[:n]); werr != nil {
+			return 0, fmt.Errorf("%w: %v", errUploadNotKept, werr)
+		}
+		u.hash.Write(p[:n])
+	}
+	return n, err
+}
+
+// sum returns the hex encoded SHA-256 of what has been read.
+func (u *gridUpload) sum() string {
+	return hex.EncodeToString(u.hash.Sum(nil))
+}
+
+// stageGridRows reads the rows of a file after its header, staging the rows
+// that can be imported and quarantining the rest a chunk at a time. It returns
+// the number of each. Errors reading the file are returned as a *cloud.Error.
+func (p GridImportPolicy) stageGridRows(ctx cloud.Context, tx pg.Tx, cr *csv.Reader, m *GridMapping, r *cloud.GridImportReport) (int, int, error) {
+	var staged []db.StagedGridRow
+	var quarantined []cloud.GridQuarantinedRow
+	var nStaged, nQuarantined int
+	var copying time.Duration
+	flush := func() error {
+		if len(staged) > 0 {
+			start := time.Now()
+			if _, err := db.StageGridData(ctx, tx, staged); err != nil {
+				return err
+			}
+			copying += time.Since(start)
+		}
+		if len(quarantined) > 0 {
+			if err := db.QuarantineGridRows(ctx, tx, r.BatchID, quarantined); err != nil {
+				return err
+			}
+		}
+		nStaged, nQuarantined = nStaged+len(staged), nQuarantined+len(quarantined)
+		staged, quarantined = staged[:0], quarantined[:0]
+		return nil
+	}
+
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, p.readError(err)
+		}
+		r.Rows++
+
+		gd, fes := m.Record(row)
+		if len(fes) == 0 {
+			staged = append(staged, db.StagedGridRow{Row: line, Data: row, Record: gd})
+		} else {
+			for _, fe := range fes {
+				for _, msg := range fe.Errors {
+					addGridError(r, cloud.GridRowError{Row: line, Column: fe.Name, Error: msg})
+				}
+			}
+			quarantined = append(quarantined, cloud.GridQuarantinedRow{Row: line, Data: row})
+		}
+		if len(staged)+len(quarantined) >= gridChunkSize {
+			if err := flush(); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return 0, 0, err
+	}
+	reportGridThroughput(ctx, "copy", nStaged, copying)
+	return nStaged, nQuarantined, nil
+}
+
+// resolveGridConflicts finds the earlier imports of a file and the staged rows
+// that conflict with rows already imported, and resolves them by the report's
+// mode. It returns the number of staged rows left to import, and the kept
+// uploads of the batches it deleted.
+func resolveGridConflicts(ctx cloud.Context, tx pg.Tx, r *cloud.GridImportReport, staged int) (int, []string, error) {
+	var err error
+	r.DuplicateOf, err = db.ListGridImportsByHash(ctx, tx, r.File.Hash, r.BatchID)
+	if err != nil {
+		return 0, nil, err
+	}
+	conflicts, total, err := db.CheckGridConflicts(ctx, tx, maxGridReportErrors)
+	if err != nil {
+		return 0, nil, err
+	}
+	r.Conflicts, r.MoreConflicts = append(r.Conflicts, conflicts...), total-len(conflicts)
+	if len(r.DuplicateOf) == 0 && total == 0 {
+		return staged, nil, nil
+	}
+
+	switch r.Mode {
+	case GridSkip:
+		if len(r.DuplicateOf) > 0 || total == staged {
+			r.Skipped = staged
+			return 0, nil, errGridImportSkipped
+		}
+		if err := db.SkipConflictingGridRows(ctx, tx); err != nil {
+			return 0, nil, err
+		}
+		r.Skipped = total
+		return staged - total, nil, nil
+	case GridReplace:
+		// The earlier imports of the file are replaced whole, along with
+		// the rows they quarantined and their uploads.
+		var paths []string
+		for _, id := range r.DuplicateOf {
+			path, err := db.DeleteGridData(ctx, tx, id)
+			if err != nil {
+				return 0, nil, err
+			}
+			paths = append(paths, path)
+		}
+		replaced, err := db.ReplaceConflictingGridRows(ctx, tx)
+		if err != nil {
+			return 0, nil, err
+		}
+		seen := make(map[string]bool)
+		for _, id := range append(r.DuplicateOf, replaced...) {
+			if !seen[id] {
+				seen[id] = true
+				r.Replaced = append(r.Replaced, id)
+			}
+		}
+		return staged, paths, nil
+	case GridForce:
+		return staged, nil, nil
+	}
+
+	msg := fmt.Sprintf("%d rows of the grid data file were already imported", total)
+	if len(r.DuplicateOf) > 0 {
+		msg = fmt.Sprintf("grid data file was already imported as batch %s", r.DuplicateOf[0])
+	}
+	return 0, nil, cloud.NewError(cloud.ErrOpts{
+		Kind:    cloud.ErrKindConflict,
+		Message: msg + ", import it with a mode of skip, replace or force",
+		Details: r,
+	})
+}
+
+// removeUploads removes the kept uploads of deleted batches, once their
+// deletion has been committed. Failures are only logged, as the batches are
+// already gone.
+func (svc NPDataService) removeUploads(ctx cloud.Context, paths []string) {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			svc.L.Error(ctx.Ctx, err, "Failed to remove kept grid upload", log.Fields{"path": path})
+		}
+	}
+}
+
+// addGridError adds an error to the report, unless it already lists as many
+// as it may.
+func addGridError(r *cloud.GridImportReport, err cloud.GridRowError) {
+	if len(r.Errors) >= maxGridReportErrors {
+		r.MoreErrors++
+		return
+	}
+	r.Errors = append(r.Errors, err)
+}
+
+// rejectGridRows returns the error that rejects a file with rows that can't be
+// imported, unless the rule is to quarantine them and some rows can be.
+func rejectGridRows(r *cloud.GridImportReport, valid, invalid int) *cloud.Error {
+	if invalid == 0 || (r.Rule == GridQuarantine && valid > 0) {
+		return nil
+	}
+	return cloud.NewError(cloud.ErrOpts{
+		Kind:    cloud.ErrKindInvalid,
+		Message: fmt.Sprintf("no grid data was imported, %d of %d rows have errors", invalid, r.Rows),
+		Details: r,
+	})
+}
+
+// reportGridThroughput reports how long a step of an import took, and how
+// many rows it handled per second, through the instrumentation Sensor.
+func reportGridThroughput(ctx cloud.Context, step string, rows int, d time.Duration) {
+	var rate float64
+	if d > 0 {
+		rate = float64(rows) / d.Seconds()
+	}
+	instrumentation.NewSensor().Timing(ctx.Ctx, "grid_import."+step, d, instrumentation.Tags{
+		"rows":         strconv.Itoa(rows),
+		"rows_per_sec": strconv.FormatFloat(rate, 'f', 0, 64),
+	})
+}
+
+// GetGridImportReport returns the report of a batch's import, and the rows it
+// quarantined.
+func (svc NPDataService) GetGridImportReport(ctx cloud.Context, req GridImportReportRequest) (*GridImportReportResponse, *cloud.Error) {
+	if req.BatchID == "" {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "batch id required",
+		})
+	}
+
+	var resp GridImportReportResponse
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var err error
+		resp.Report, resp.Header, err = db.GetGridImport(ctx, tx, req.BatchID)
+		if err != nil {
+			return fmt.Errorf("service/db.GetGridImport failed: %w", err)
+		}
+		if resp.Report == nil {
+			return nil
+		}
+		resp.Quarantined, err = db.ListGridQuarantine(ctx, tx, req.BatchID)
+		if err != nil {
+			return fmt.Errorf("service/db.ListGridQuarantine failed: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "dataservice get grid import report transaction failed",
+			Cause:   err,
+		})
+	}
+	if resp.Report == nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindNotFound,
+			Message: "no import report for batch",
+		})
+	}
+	return &resp, nil
+}
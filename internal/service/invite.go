@@ -0,0 +1,267 @@
+package service
+
+import (
+	"fmt"
+	"time"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/db"
+	"github.com/kmhebb/serverExample/lib/passhash"
+	"github.com/kmhebb/serverExample/lib/token"
+	"github.com/kmhebb/serverExample/log"
+	"github.com/kmhebb/serverExample/pg"
+	"github.com/pborman/uuid"
+)
+
+type InviteRequest struct {
+	ID string `json:"id"`
+}
+
+type ListInvitesResponse struct {
+	Invites []*cloud.Invite `json:"invites"`
+}
+
+type AcceptInviteRequest struct {
+	Password string `json:"password"`
+	Confirm  string `json:"confirm"`
+}
+
+// invite sends the user an invite to choose their password, replacing any
+// invite they already have.
+func (svc UserService) invite(ctx cloud.Context, u *cloud.User) *cloud.Error {
+	tok, hash, err := token.NewInvite()
+	if err != nil {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service failed to issue invite token",
+			Cause:   err,
+		})
+	}
+	inv := &cloud.Invite{
+		ID:        uuid.New(),
+		UserID:    u.ID,
+		Email:     u.Email,
+		Hash:      hash,
+		InvitedBy: ctx.UserKey,
+		ExpiresAt: time.Now().Add(token.InviteExpiration),
+	}
+
+	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		if err := db.RevokeUserInvites(ctx, tx, u.ID); err != nil {
+			return err
+		}
+		return db.CreateInvite(ctx, tx, inv)
+	})
+	if err != nil {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service create invite db transaction failed",
+			Cause:   err,
+		})
+	}
+
+	svc.L.Info(ctx.Ctx, "Invited user", log.Fields{"user": u.ID, "invite_id": inv.ID, "by": ctx.UserKey})
+	svc.Em.InviteAsync(ctx, svc.Name(u), u.Email, tok, inv.ExpiresAt)
+	return nil
+}
+
+// ListInvites returns the invites that have been neither accepted nor revoked,
+// including expired ones.
+func (svc UserService) ListInvites(ctx cloud.Context) (*ListInvitesResponse, *cloud.Error) {
+	var resp ListInvitesResponse
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		resp.Invites, dbErr = db.ListPendingInvites(ctx, tx)
+		return dbErr
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service list invites db transaction failed",
+			Cause:   err,
+		})
+	}
+	return &resp, nil
+}
+
+// ResendInvite sends a new invite in place of a pending or expired one. The
+// link in the old invite stops working.
+func (svc UserService) ResendInvite(ctx cloud.Context, req InviteRequest) (_ interface{}, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionResendInvite, cloud.AuditTargetInvite, req.ID)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	inv, e := svc.findInvite(ctx, req.ID)
+	if e != nil {
+		return nil, e
+	}
+	if inv.AcceptedAt != nil || inv.RevokedAt != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindConflict,
+			Message: "invite has already been accepted or revoked",
+		})
+	}
+
+	var u *cloud.User
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		u, dbErr = db.FindByID(ctx, tx, inv.UserID)
+		return dbErr
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service find by id db transaction failed",
+			Cause:   err,
+		})
+	}
+	if u.Status != cloud.StatusInvited {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindConflict,
+			Message: fmt.Sprintf("user is %s and can't be invited again", u.Status),
+		})
+	}
+
+	return nil, svc.invite(ctx, u)
+}
+
+// RevokeInvite stops a pending invite from being accepted.
+func (svc UserService) RevokeInvite(ctx cloud.Context, req InviteRequest) (_ interface{}, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionRevokeInvite, cloud.AuditTargetInvite, req.ID)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	if _, e := svc.findInvite(ctx, req.ID); e != nil {
+		return nil, e
+	}
+
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		return db.RevokeInvite(ctx, tx, req.ID)
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service revoke invite db transaction failed",
+			Cause:   err,
+		})
+	}
+
+	svc.L.Info(ctx.Ctx, "Revoked invite", log.Fields{"invite_id": req.ID, "by": ctx.UserKey})
+	return nil, nil
+}
+
+func (svc UserService) findInvite(ctx cloud.Context, id string) (*cloud.Invite, *cloud.Error) {
+	if id == "" {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "id is required",
+		})
+	}
+
+	var inv *cloud.Invite
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		inv, dbErr = db.FindInvite(ctx, tx, id)
+		return dbErr
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service find invite db transaction failed",
+			Cause:   err,
+		})
+	}
+	if inv == nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindNotFound,
+			Message: "invite not found",
+		})
+	}
+	return inv, nil
+}
+
+// AcceptInvite sets the password of an invited user, carried as the
+// confirmation token, and logs them in. Each invite can be accepted once.
+func (svc UserService) AcceptInvite(ctx cloud.Context, req AcceptInviteRequest) (resp LoginUserResponse, e *cloud.Error) {
+	// The handler has already checked that the confirmation token is present.
+	var inv *cloud.Invite
+	var u *cloud.User
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		inv, dbErr = db.FindInviteByHash(ctx, tx, token.Hash(ctx.ConfirmationToken))
+		if dbErr != nil || inv == nil {
+			return dbErr
+		}
+		u, dbErr = db.FindByID(ctx, tx, inv.UserID)
+		return dbErr
+	})
+	if err != nil {
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service find invite db transaction failed",
+			Cause:   err,
+		})
+	}
+	if inv == nil || !inv.Pending(time.Now()) || u.ID != inv.UserID || u.Status != cloud.StatusInvited {
+		return resp, errInviteInvalid(nil)
+	}
+	ctx.UserKey = u.ID
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionAcceptInvite, cloud.AuditTargetUser, u.ID)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	if req.Password != req.Confirm {
+		return resp, policyError(NewFieldError("Password", "Passwords do not match"))
+	}
+	fe, e := svc.checkNewPassword(ctx, u, req.Password)
+	if e != nil {
+		return resp, e
+	}
+	if fe != nil {
+		return resp, policyError(fe)
+	}
+
+	hash, err := passhash.Hash(req.Password)
+	if err != nil {
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "there was an error hashing the new password",
+			Cause:   err,
+		})
+	}
+	u.PasswordHash = hash
+	u.MustChange = false
+
+	var accepted bool
+	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var err error
+		if accepted, err = db.AcceptInvite(ctx, tx, inv.ID); err != nil || !accepted {
+			return err
+		}
+		// The user may have been deleted since the invite was sent.
+		if accepted, err = db.UpdateUserStatus(ctx, tx, u.ID, cloud.StatusInvited, cloud.StatusActive); err != nil || !accepted {
+			return err
+		}
+		return db.UpdateUserRecord(ctx, tx, u)
+	})
+	if err != nil {
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service accept invite db transaction failed",
+			Cause:   err,
+		})
+	}
+	if !accepted {
+		return resp, errInviteInvalid(nil)
+	}
+	u.Status = cloud.StatusActive
+
+	svc.L.Info(ctx.Ctx, "Invite accepted", log.Fields{"user": u.ID, "invite_id": inv.ID})
+	auditPasswordChange(entry.Diff(map[string]cloud.UserStatus{"status": cloud.StatusInvited}, map[string]cloud.UserStatus{"status": u.Status}))
+	return svc.completeLogin(ctx, u)
+}
+
+func errInviteInvalid(cause error) *cloud.Error {
+	return cloud.NewError(cloud.ErrOpts{
+		Kind:    cloud.ErrKindAuthenticate,
+		Message: "invite is invalid, has already been accepted or has expired",
+		Cause:   cause,
+	})
+}
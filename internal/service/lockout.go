@@ -0,0 +1,48 @@
+package service
+
+import "time"
+
+// LockoutPolicy decides how long a user is locked out after failed logins.
+// Zero fields take their value from DefaultLockoutPolicy.
+type LockoutPolicy struct {
+	// Threshold is the number of failed attempts in a row that locks the user
+	// out.
+	Threshold int
+
+	// Duration is how long the first lockout lasts. Every failed attempt after
+	// a lockout has ended doubles it, up to MaxDuration.
+	Duration    time.Duration
+	MaxDuration time.Duration
+}
+
+var DefaultLockoutPolicy = LockoutPolicy{
+	Threshold:   5,
+	Duration:    time.Minute,
+	MaxDuration: 24 * time.Hour,
+}
+
+// LockDuration returns how long a user is locked out after the given number
+// of failed attempts in a row, or 0 if they are not locked out.
+func (p LockoutPolicy) LockDuration(failures int) time.Duration {
+	if p.Threshold == 0 {
+		p.Threshold = DefaultLockoutPolicy.Threshold
+	}
+	if p.Duration == 0 {
+		p.Duration = DefaultLockoutPolicy.Duration
+	}
+	if p.MaxDuration == 0 {
+		p.MaxDuration = DefaultLockoutPolicy.MaxDuration
+	}
+
+	if failures < p.Threshold {
+		return 0
+	}
+	d := p.Duration
+	for i := p.Threshold; i < failures; i++ {
+		d *= 2
+		if d >= p.MaxDuration {
+			return p.MaxDuration
+		}
+	}
+	return d
+}
@@ -0,0 +1,34 @@
+package service_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kmhebb/serverExample/internal/assert"
+	"github.com/kmhebb/serverExample/internal/service"
+)
+
+func TestLockDuration(t *testing.T) {
+	p := service.LockoutPolicy{Threshold: 3, Duration: time.Minute, MaxDuration: 10 * time.Minute}
+
+	for failures, want := range map[int]time.Duration{
+		0:   0,
+		2:   0,
+		3:   time.Minute,
+		4:   2 * time.Minute,
+		5:   4 * time.Minute,
+		6:   8 * time.Minute,
+		7:   10 * time.Minute,
+		100: 10 * time.Minute,
+	} {
+		assert.New(t).Equals(p.LockDuration(failures), want)
+	}
+}
+
+func TestLockDurationDefaults(t *testing.T) {
+	assert := assert.New(t)
+	var p service.LockoutPolicy
+
+	assert.Equals(p.LockDuration(service.DefaultLockoutPolicy.Threshold-1), time.Duration(0))
+	assert.Equals(p.LockDuration(service.DefaultLockoutPolicy.Threshold), service.DefaultLockoutPolicy.Duration)
+}
@@ -0,0 +1,135 @@
+package service
+
+import (
+	"strings"
+	"time"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/db"
+	"github.com/kmhebb/serverExample/lib/token"
+	"github.com/kmhebb/serverExample/log"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+// RequestMagicLink emails a single-use login link to the user, if they have
+// opted in to magic links. The response is the same whether or not a link was
+// sent, so that it can't be used to find out which emails have accounts.
+func (svc UserService) RequestMagicLink(ctx cloud.Context, req UserRequest) (interface{}, *cloud.Error) {
+	if req.Email == "" {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "email is required",
+		})
+	}
+
+	req.Email = strings.ToLower(req.Email)
+	var u *cloud.User
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		u, dbErr = db.FindByEmail(ctx, tx, req.Email)
+		return dbErr
+	})
+	if err != nil || u.ID == "" {
+		svc.L.Info(ctx.Ctx, "Magic link requested for unknown email", log.Fields{"email": req.Email})
+		return nil, nil
+	}
+	if !u.MagicLinkEnabled {
+		svc.L.Info(ctx.Ctx, "Magic link requested, user has not opted in", log.Fields{"email": req.Email})
+		return nil, nil
+	}
+
+	link, err := token.NewPurpose(u.ID, token.PurposeMagicLink, u.TokenGeneration, token.MagicLinkExpiration)
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service failed to issue magic link",
+			Cause:   err,
+		})
+	}
+
+	svc.L.Info(ctx.Ctx, "Magic link sent", log.Fields{"email": u.Email})
+	svc.Em.MagicLinkAsync(ctx, svc.Name(u), u.Email, link)
+
+	return nil, nil
+}
+
+// LoginMagicLink exchanges the token from a magic link, carried as the
+// confirmation token, for the tokens Login would have returned. Each link
+// works once. Users with TOTP enabled still have to provide a code, so they
+// get a challenge token instead.
+func (svc UserService) LoginMagicLink(ctx cloud.Context) (resp LoginUserResponse, e *cloud.Error) {
+	// The handler has already checked that the confirmation token is present.
+	claims, err := token.ParsePurpose(ctx.ConfirmationToken, token.PurposeMagicLink)
+	if err != nil {
+		return resp, errMagicLinkInvalid(err)
+	}
+
+	var u *cloud.User
+	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		u, dbErr = db.FindByID(ctx, tx, claims.UID)
+		return dbErr
+	})
+	if err != nil {
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service find by id db transaction failed",
+			Cause:   err,
+		})
+	}
+	// Opting out, or changing the password, voids links already sent.
+	if u.ID == "" || !u.MagicLinkEnabled || u.TokenGeneration != claims.Generation {
+		return resp, errMagicLinkInvalid(nil)
+	}
+	ctx.UserKey = u.ID
+
+	if u.Locked(time.Now()) {
+		svc.L.Info(ctx.Ctx, "Login rejected, user is locked", log.Fields{"user": u.ID, "until": u.LockedUntil})
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindForbidden,
+			Message: "account is temporarily locked after too many failed login attempts",
+		})
+	}
+
+	var consumed bool
+	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		consumed, dbErr = db.ConsumeToken(ctx, tx, claims.ID, u.ID, claims.ExpiresAt)
+		return dbErr
+	})
+	if err != nil {
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service consume magic link db transaction failed",
+			Cause:   err,
+		})
+	}
+	if !consumed {
+		svc.L.Info(ctx.Ctx, "Magic link reused", log.Fields{"user": u.ID})
+		return resp, errMagicLinkInvalid(nil)
+	}
+
+	if u.TOTPEnabled {
+		challenge, err := token.NewPurpose(u.ID, token.PurposeMFA, u.TokenGeneration, token.ChallengeExpiration)
+		if err != nil {
+			return resp, cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindInternal,
+				Message: "user service failed to issue challenge token",
+				Cause:   err,
+			})
+		}
+		svc.L.Info(ctx.Ctx, "Magic link accepted, second factor required", log.Fields{"user": u.ID})
+		return LoginUserResponse{MFARequired: true, ChallengeToken: challenge}, nil
+	}
+
+	svc.L.Info(ctx.Ctx, "Magic link accepted", log.Fields{"user": u.ID})
+	return svc.completeLogin(ctx, u)
+}
+
+func errMagicLinkInvalid(cause error) *cloud.Error {
+	return cloud.NewError(cloud.ErrOpts{
+		Kind:    cloud.ErrKindAuthenticate,
+		Message: "magic link is invalid, has already been used or has expired",
+		Cause:   cause,
+	})
+}
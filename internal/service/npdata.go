@@ -1,7 +1,12 @@
 package service
 
 import (
+	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"sort"
 	"strconv"
 	"time"
 
@@ -15,16 +20,42 @@ import (
 	uuid "github.com/pborman/uuid"
 )
 
+// NPDataService serves the grid, customer, invoice and meter data. Its methods
+// don't check who is calling them: the handler of each route authorizes its
+// action, for users and API keys alike, before the method is called.
 type NPDataService struct {
 	DB Database
 	L  log.Logger
 	Em email.Service
-}
 
-type GridData []string
+	// GridImport decides what happens to grid data files with rows that
+	// can't be imported.
+	GridImport GridImportPolicy
+
+	// Au records every change made to the grid, customer, invoice and meter
+	// data.
+	Au cloud.Auditor
+}
 
 type ImportGridDataRequest struct {
-	GD []GridData
+	// File is the uploaded file, starting with its header. It is read as it
+	// is imported, and is never held in memory as a whole.
+	File io.Reader
+
+	// Filename is the name the file was uploaded with, if any.
+	Filename string
+
+	// Layout is the version of the GridLayout the file was exported in. It
+	// is found from the header if empty.
+	Layout string
+
+	// Rule is GridRejectFile or GridQuarantine, overriding the GridImport
+	// policy of the service.
+	Rule string
+
+	// Mode is GridSkip, GridReplace or GridForce, for a file that was
+	// already imported in whole or in part.
+	Mode string
 }
 
 type ImportGridDataResponse struct {
@@ -95,129 +126,156 @@ type InitializeMeterDataRequest struct {
 }
 
 // This method will import data from a csv into the database with a unique identifier.
-func (svc NPDataService) ImportGridData(ctx cloud.Context, req ImportGridDataRequest) (interface{}, *cloud.Error) {
-	// We checked that the token existed and was valid in the handler, but now we need to make sure the user is allowed to do this action.
-	err := svc.ValidateUserAccess(ctx)
+// The upload is streamed to disk first, where it is kept with its batch once
+// it has been imported, and then read into the database a chunk at a time.
+func (svc NPDataService) ImportGridData(ctx cloud.Context, req ImportGridDataRequest) (_ interface{}, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionImportGridData, cloud.AuditTargetGridBatch, "")
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	if req.File == nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "import csv did not contain data",
+		})
+	}
+	rule, e := svc.GridImport.rule(req.Rule)
+	if e != nil {
+		return nil, e
+	}
+	if e := gridImportMode(req.Mode); e != nil {
+		return nil, e
+	}
+
+	// The upload is copied to disk before it is imported, and removed again
+	// unless it is.
+	report := &cloud.GridImportReport{
+		BatchID:   uuid.New(),
+		File:      cloud.GridUpload{Name: req.Filename},
+		Rule:      rule,
+		Mode:      req.Mode,
+		Errors:    []cloud.GridRowError{},
+		Conflicts: []cloud.GridConflict{},
+	}
+	var kept bool
+	defer func() {
+		if !kept && report.File.Path != "" {
+			os.Remove(report.File.Path)
+		}
+	}()
+	if e := svc.GridImport.keepUpload(report, req.File); e != nil {
+		return nil, e
+	}
+	upload, err := os.Open(report.File.Path)
 	if err != nil {
 		return nil, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindForbidden,
-			Message: "user not allowed to perform this action",
+			Kind:    cloud.ErrKindInternal,
+			Message: "failed to open kept upload",
 			Cause:   err,
-		}) //fmt.Errorf("user not allowed to perform this action: %w", err)
+		})
 	}
+	defer upload.Close()
+	cr := csv.NewReader(upload)
+	// Short rows are reported along with the rest of their errors, rather
+	// than failing the whole file.
+	cr.FieldsPerRecord = -1
 
-	// Here we are receiving a .csv of grid data that we need to save into the data base.
-	// At this point, the csv has been loaded into a slice contained in the req parameter, lets make sure it has values:
-	if len(req.GD) == 0 {
+	// The columns are found by the header row, so that a reordered or added
+	// column in the utility's export can't be read into the wrong field.
+	header, err := cr.Read()
+	if err == io.EOF {
 		return nil, cloud.NewError(cloud.ErrOpts{
 			Kind:    cloud.ErrKindBadRequest,
 			Message: "import csv did not contain data",
-			Cause:   err,
 		}) //fmt.Errorf("import csv did not contain data")
 	}
+	if err != nil {
+		return nil, svc.GridImport.readError(err)
+	}
+	m, e := NewGridMapping(header, req.Layout)
+	if e != nil {
+		return nil, e
+	}
+	report.Layout = m.Layout
 
-	// We are going to load the data into a golang data structure for handling.
-	var GridData []cloud.GridDataRecord
-	for i, col := range req.GD {
-		if i == 0 {
-			continue
-		}
-		var gd cloud.GridDataRecord
-		gd.HostAcct, err = strconv.Atoi(col[0])
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: HostAcct", log.Fields{"error": err})
-		}
-		gd.SatAcct, err = strconv.Atoi(col[1])
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: SatAcct", log.Fields{"error": err})
-		}
-		gd.SatelliteName = col[2]
-		gd.SatServClass = col[3]
-		gd.SatVDL, err = strconv.Atoi(col[4])
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: SatVDL", log.Fields{"error": err})
-		}
-		gd.SatStatus = col[5]
-		gd.VderEnergy, err = strconv.ParseFloat(col[6], 64)
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: VderEnergy", log.Fields{"error": err})
-		}
-		gd.VderCap, err = strconv.ParseFloat(col[7], 64)
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: VderCap", log.Fields{"error": err})
-		}
-		gd.VderEnv, err = strconv.ParseFloat(col[8], 64)
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: VderEnv", log.Fields{"error": err})
-		}
-		gd.VderDrv, err = strconv.ParseFloat(col[9], 64)
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: VderDrv", log.Fields{"error": err})
-		}
-		gd.VderLsrv, err = strconv.ParseFloat(col[10], 64)
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: VderLsrv", log.Fields{"error": err})
-		}
-		gd.VderMTC, err = strconv.ParseFloat(col[11], 64)
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: vdermtc", log.Fields{"error": err})
-		}
-		gd.VderCc, err = strconv.ParseFloat(col[12], 64)
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: vdercc", log.Fields{"error": err})
-		}
-		gd.VderTotal, err = strconv.ParseFloat(col[13], 64)
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: vdertotal", log.Fields{"error": err})
-		}
-		gd.TransKWH, err = strconv.ParseFloat(col[14], 64)
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: transkwh", log.Fields{"error": err})
-		}
-		gd.Allocation, err = strconv.ParseFloat(col[15], 64)
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: allocation", log.Fields{"error": err})
-		}
-		gd.HostBillPeriod = col[16]
-		gd.TransferDate, err = time.Parse("2006-01-02", col[17])
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: transferdate", log.Fields{"error": err})
+	// Now we are going to pass this over to the database, reading the file
+	// back from disk a chunk at a time. Rows with cells
+	// that can't be read are either quarantined or reject the whole file, so
+	// that they never reach the database as zeros. The rest are copied into
+	// a staging table, checked against each other, and inserted as a set.
+	// The uploads of batches the import replaces are removed once it has
+	// been committed.
+	var replaced []string
+	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		if err := db.CreateGridImport(ctx, tx, report, header); err != nil {
+			return err
 		}
-		gd.SatBillDate, err = time.Parse("2006-01-02", col[18])
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: satbilldate", log.Fields{"error": err})
+		if err := db.CreateGridStaging(ctx, tx); err != nil {
+			return err
 		}
-		gd.BankedPriorMonth, err = strconv.ParseFloat(col[19], 64)
+		staged, quarantined, err := svc.GridImport.stageGridRows(ctx, tx, cr, m, report)
 		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: bankedpriormonth", log.Fields{"error": err})
+			return err
 		}
-		gd.CurrentVDER, err = strconv.ParseFloat(col[20], 64)
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: currentvder", log.Fields{"error": err})
+		if report.Rows == 0 {
+			return cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindBadRequest,
+				Message: "import csv did not contain data",
+			})
 		}
-		gd.TotalAvailable, err = strconv.ParseFloat(col[21], 64)
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: totalavailable", log.Fields{"error": err})
+		if e := rejectGridRows(report, staged, quarantined); e != nil {
+			return e
 		}
-		gd.SatBillAmt, err = strconv.ParseFloat(col[22], 64)
+
+		problems, err := db.CheckStagedGridData(ctx, tx)
 		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: satbillamount", log.Fields{"error": err})
-		}
-		gd.Applied, err = strconv.ParseFloat(col[23], 64)
+			return err
+		}
+		if len(problems) > 0 {
+			var lines []int
+			for _, p := range problems {
+				lines = append(lines, p.Row)
+				addGridError(report, p)
+			}
+			sort.SliceStable(report.Errors, func(i, j int) bool { return report.Errors[i].Row < report.Errors[j].Row })
+			staged, quarantined = staged-len(lines), quarantined+len(lines)
+			if e := rejectGridRows(report, staged, quarantined); e != nil {
+				return e
+			}
+			if err := db.QuarantineStagedGridRows(ctx, tx, report.BatchID, lines); err != nil {
+				return err
+			}
+		}
+		report.Quarantined = quarantined
+
+		// A file, or rows of it, that were already imported are found by
+		// the hash of the file and the accounts and bill period of the rows.
+		staged, replaced, err = resolveGridConflicts(ctx, tx, report, staged)
 		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: applied", log.Fields{"error": err})
+			return err
 		}
-		gd.BankedCarryOver, err = strconv.ParseFloat(col[24], 64)
-		if err != nil {
-			svc.L.Debug(ctx.Ctx, "decode csv: bankedcarryover", log.Fields{"error": err})
+		report.Imported = staged
+
+		start := time.Now()
+		if err := db.ImportStagedGridData(ctx, tx, report.BatchID); err != nil {
+			return err
 		}
-		GridData = append(GridData, gd)
-	}
+		reportGridThroughput(ctx, "insert", staged, time.Since(start))
 
-	// Now we are going to pass this over to the database.
-	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
-		return db.ImportGridData(ctx, tx, GridData)
+		return db.UpdateGridImport(ctx, tx, report)
 	})
+	if errors.Is(err, errGridImportSkipped) {
+		// Nothing was imported, so the report is of no batch.
+		if len(report.DuplicateOf) > 0 {
+			entry.TargetID = report.DuplicateOf[0]
+		}
+		entry.Diff(nil, map[string]interface{}{"skipped": report.Skipped, "mode": report.Mode, "file": report.File.Name})
+		report.BatchID = ""
+		return report, nil
+	}
+	var ce *cloud.Error
+	if errors.As(err, &ce) {
+		return nil, ce
+	}
 	if err != nil {
 		return nil, cloud.NewError(cloud.ErrOpts{
 			Kind:    cloud.ErrKindInternal,
@@ -225,21 +283,28 @@ func (svc NPDataService) ImportGridData(ctx cloud.Context, req ImportGridDataReq
 			Cause:   err,
 		}) //fmt.Errorf("service/DataService.ImportGridData.RunInTransaction failed: %w", err)
 	}
+	kept = true
+	svc.removeUploads(ctx, replaced)
+	entry.TargetID = report.BatchID
+	entry.Diff(nil, map[string]interface{}{
+		"rows":        report.Imported,
+		"quarantined": report.Quarantined,
+		"skipped":     report.Skipped,
+		"replaced":    report.Replaced,
+		"layout":      m.Layout,
+		"mode":        report.Mode,
+		"file":        report.File.Name,
+	})
 
-	return nil, nil
+	return report, nil
 }
 
 // This method will delete a batch of data that was uploaded via csv.
-func (svc NPDataService) DeleteBatchOfGridData(ctx cloud.Context, req ProcessBatchGridDataRequest) (interface{}, *cloud.Error) {
-	// We checked that the token existed and was valid in the handler, but now we need to make sure the user is allowed to do this action.
-	err := svc.ValidateUserAccess(ctx)
-	if err != nil {
-		return nil, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindForbidden,
-			Message: "user not allowed to perform this action",
-			Cause:   err,
-		}) //fmt.Errorf("user not allowed to perform this action: %w", err)
-	}
+func (svc NPDataService) DeleteBatchOfGridData(ctx cloud.Context, req ProcessBatchGridDataRequest) (_ interface{}, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionDeleteGridBatch, cloud.AuditTargetGridBatch, req.GridDataID)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	var err error
 
 	if req.GridDataID == "" {
 		return nil, cloud.NewError(cloud.ErrOpts{
@@ -249,8 +314,11 @@ func (svc NPDataService) DeleteBatchOfGridData(ctx cloud.Context, req ProcessBat
 		}) //fmt.Errorf("batch id required")
 	}
 
+	var path string
 	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
-		return db.DeleteGridData(ctx, tx, req.GridDataID)
+		var err error
+		path, err = db.DeleteGridData(ctx, tx, req.GridDataID)
+		return err
 	})
 	if err != nil {
 		return nil, cloud.NewError(cloud.ErrOpts{
@@ -259,6 +327,7 @@ func (svc NPDataService) DeleteBatchOfGridData(ctx cloud.Context, req ProcessBat
 			Cause:   err,
 		}) //fmt.Errorf("service/Dataservice.DeleteBatchofGridData.RunInTransaction failed: %w", err)
 	}
+	svc.removeUploads(ctx, []string{path})
 
 	return nil, nil
 }
@@ -266,15 +335,6 @@ func (svc NPDataService) DeleteBatchOfGridData(ctx cloud.Context, req ProcessBat
 // This method will list the batches of data that are in the database.
 func (svc NPDataService) GetListOfGridBatches(ctx cloud.Context, req GridBatchListRequest) (GridBatchListResponse, *cloud.Error) {
 	var err error
-	// We checked that the token existed and was valid in the handler, but now we need to make sure the user is allowed to do this action.
-	err = svc.ValidateUserAccess(ctx)
-	if err != nil {
-		return GridBatchListResponse{}, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindForbidden,
-			Message: "user not allowed to perform this action",
-			Cause:   err,
-		}) //fmt.Errorf("user not allowed to perform this action: %w", err)
-	}
 
 	var resp GridBatchListResponse
 	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
@@ -301,30 +361,12 @@ func (svc NPDataService) GetListOfGridBatches(ctx cloud.Context, req GridBatchLi
 
 // This method will take the grid data that has been uploaded and turn it into billing information.
 func (svc NPDataService) ProcessBatchGridData(ctx cloud.Context, req ProcessBatchGridDataRequest) (interface{}, *cloud.Error) {
-	// We checked that the token existed and was valid in the handler, but now we need to make sure the user is allowed to do this action.
-	err := svc.ValidateUserAccess(ctx)
-	if err != nil {
-		return nil, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindForbidden,
-			Message: "user not allowed to perform this action",
-			Cause:   err,
-		}) //fmt.Errorf("user not allowed to perform this action: %w", err)
-	}
 	return nil, nil
 }
 
 // This method will list batches of billing information in the database.
 func (svc NPDataService) GetBillingDataList(ctx cloud.Context, req GetBillingDataListRequest) (interface{}, *cloud.Error) {
 	var err error
-	// We checked that the token existed and was valid in the handler, but now we need to make sure the user is allowed to do this action.
-	err = svc.ValidateUserAccess(ctx)
-	if err != nil {
-		return nil, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindForbidden,
-			Message: "user not allowed to perform this action",
-			Cause:   err,
-		}) //fmt.Errorf("user not allowed to perform this action: %w", err)
-	}
 	var resp GetBillingDataListResponse
 
 	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
@@ -351,20 +393,13 @@ func (svc NPDataService) GetBillingDataList(ctx cloud.Context, req GetBillingDat
 
 // This method will return a set of billing data as csv.
 func (svc NPDataService) GetBillingDataCSV(ctx cloud.Context, req GetBillingDataRequest) (interface{}, *cloud.Error) {
-	// We checked that the token existed and was valid in the handler, but now we need to make sure the user is allowed to do this action.
-	err := svc.ValidateUserAccess(ctx)
-	if err != nil {
-		return nil, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindForbidden,
-			Message: "user not allowed to perform this action",
-			Cause:   err,
-		}) //fmt.Errorf("user not allowed to perform this action: %w", err)
-	}
 	return nil, nil
 }
 
 // This method will pull all statement data from utilibill and synchronize the statement data in the database.
-func (svc NPDataService) SyncInvoiceDataFromUB(ctx cloud.Context, req UBRequest) (interface{}, *cloud.Error) {
+func (svc NPDataService) SyncInvoiceDataFromUB(ctx cloud.Context, req UBRequest) (_ interface{}, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionSyncInvoices, cloud.AuditTargetInvoices, "")
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
 
 	var sd []cloud.CustomerStatements
 
@@ -388,21 +423,16 @@ func (svc NPDataService) SyncInvoiceDataFromUB(ctx cloud.Context, req UBRequest)
 			Cause:   err,
 		}) //fmt.Errorf("service/DataService.SyncInvoiceData.RunInTransaction failed: %w", err)
 	}
+	entry.Diff(nil, map[string]int{"customers": len(sd)})
 
 	return nil, nil
 }
 
-func (svc NPDataService) InitializeInvoiceDataFromUtilibill(ctx cloud.Context, req InitializeUtilibillRequest) (interface{}, *cloud.Error) {
+func (svc NPDataService) InitializeInvoiceDataFromUtilibill(ctx cloud.Context, req InitializeUtilibillRequest) (_ interface{}, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionInitializeInvoices, cloud.AuditTargetInvoices, "")
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
 	var err error
-	// We checked that the token existed and was valid in the handler, but now we need to make sure the user is allowed to do this action.
-	err = svc.ValidateUserAccess(ctx)
-	if err != nil {
-		return nil, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindForbidden,
-			Message: "user not allowed to perform this action",
-			Cause:   err,
-		}) //fmt.Errorf("user not allowed to perform this action: %w", err)
-	}
 
 	var sd []cloud.CustomerStatements
 	sd, err = utilibill.InitializeInvoiceDataFromUtilibill(ctx.Ctx)
@@ -424,20 +454,16 @@ func (svc NPDataService) InitializeInvoiceDataFromUtilibill(ctx cloud.Context, r
 			Cause:   err,
 		}) //fmt.Errorf("service/DataService.InitUBInvoiceData.RunInTransaction failed: %w", err)
 	}
+	entry.Diff(nil, map[string]int{"customers": len(sd)})
 
 	return nil, nil
 }
 
-func (svc NPDataService) InitCustomersFromUB(ctx cloud.Context, req interface{}) (interface{}, *cloud.Error) {
-	// We checked that the token existed and was valid in the handler, but now we need to make sure the user is allowed to do this action.
-	err := svc.ValidateUserAccess(ctx)
-	if err != nil {
-		return nil, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindForbidden,
-			Message: "user not allowed to perform this action",
-			Cause:   err,
-		}) //fmt.Errorf("user not allowed to perform this action: %w", err)
-	}
+func (svc NPDataService) InitCustomersFromUB(ctx cloud.Context, req interface{}) (_ interface{}, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionInitializeCustomers, cloud.AuditTargetCustomer, "")
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	var err error
 
 	data, err := utilibill.GetCustomerListFromUB()
 	if err != nil {
@@ -458,21 +484,17 @@ func (svc NPDataService) InitCustomersFromUB(ctx cloud.Context, req interface{})
 			Cause:   err,
 		}) //fmt.Errorf("service/DataService.InitUBCustomerunInTransaction failed: %w", err)
 	}
+	entry.Diff(nil, map[string]int{"customers": len(data)})
 
 	return nil, nil
 }
 
 // This method will pull all customer data from utilibill and synchronize the customer data in the database.
-func (svc NPDataService) PullCustomerDataFromUB(ctx cloud.Context, req UBRequest) (interface{}, *cloud.Error) {
-	// We checked that the token existed and was valid in the handler, but now we need to make sure the user is allowed to do this action.
-	err := svc.ValidateUserAccess(ctx)
-	if err != nil {
-		return nil, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindForbidden,
-			Message: "user not allowed to perform this action",
-			Cause:   err,
-		}) //fmt.Errorf("user not allowed to perform this action: %w", err)
-	}
+func (svc NPDataService) PullCustomerDataFromUB(ctx cloud.Context, req UBRequest) (_ interface{}, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionUpdateAllCustomers, cloud.AuditTargetCustomer, "")
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	var err error
 
 	var List cloud.UBCustomerNumberList
 	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
@@ -488,6 +510,10 @@ func (svc NPDataService) PullCustomerDataFromUB(ctx cloud.Context, req UBRequest
 		}) //fmt.Errorf("failed to get customer number list in transaction: %w", err)
 	}
 
+	// The customers synced before a failure stay synced, so the count is
+	// recorded either way.
+	var synced int
+	defer func() { entry.Diff(nil, map[string]int{"customers": synced}) }()
 	for _, v := range List.Customers {
 		// utilibill will only allow one request per second to these endpoints, so we will start with a wait.
 		time.Sleep(1 * time.Second)
@@ -533,36 +559,18 @@ func (svc NPDataService) PullCustomerDataFromUB(ctx cloud.Context, req UBRequest
 				Cause:   err,
 			}) //fmt.Errorf("service/DataService.SyncUBCustomerDDSInTransaction failed: %w", err)
 		}
-
+		synced++
 	}
 
 	return nil, nil
 }
 
 func (svc NPDataService) PullMeterDataFromUB(ctx cloud.Context, req UBRequest) (interface{}, *cloud.Error) {
-	// We checked that the token existed and was valid in the handler, but now we need to make sure the user is allowed to do this action.
-	err := svc.ValidateUserAccess(ctx)
-	if err != nil {
-		return InvoiceListResponse{}, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindForbidden,
-			Message: "user not allowed to perform this action",
-			Cause:   err,
-		}) //fmt.Errorf("user not allowed to perform this action: %w", err)
-	}
-
 	return nil, nil
 }
 
 func (svc NPDataService) GetListOfInvoices(ctx cloud.Context, req InvoiceListRequest) (InvoiceListResponse, *cloud.Error) {
-	// We checked that the token existed and was valid in the handler, but now we need to make sure the user is allowed to do this action.
-	err := svc.ValidateUserAccess(ctx)
-	if err != nil {
-		return InvoiceListResponse{}, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindForbidden,
-			Message: "user not allowed to perform this action",
-			Cause:   err,
-		}) //fmt.Errorf("user not allowed to perform this action: %w", err)
-	}
+	var err error
 
 	var resp InvoiceListResponse
 	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
@@ -583,15 +591,7 @@ func (svc NPDataService) GetListOfInvoices(ctx cloud.Context, req InvoiceListReq
 
 // This method will return a set of customer statement data.
 func (svc NPDataService) GetInvoiceDataForDisplay(ctx cloud.Context, req GetInvoiceDataRequest) (GetInvoiceDataResponse, *cloud.Error) {
-	// We checked that the token existed and was valid in the handler, but now we need to make sure the user is allowed to do this action.
-	err := svc.ValidateUserAccess(ctx)
-	if err != nil {
-		return GetInvoiceDataResponse{}, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindForbidden,
-			Message: "user not allowed to perform this action",
-			Cause:   err,
-		}) //fmt.Errorf("user not allowed to perform this action: %w", err)
-	}
+	var err error
 	var resp GetInvoiceDataResponse
 	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
 		var dbErr error
@@ -613,18 +613,8 @@ func (svc NPDataService) GetInvoiceDataForDisplay(ctx cloud.Context, req GetInvo
 }
 
 func (svc NPDataService) ListCustomers(ctx cloud.Context, req UBRequest) (interface{}, *cloud.Error) {
-	// We checked that the token existed and was valid in the handler, but now we need to make sure the user is allowed to do this action.
-	err := svc.ValidateUserAccess(ctx)
-	if err != nil {
-		return GetInvoiceDataResponse{}, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindForbidden,
-			Message: "user not allowed to perform this action",
-			Cause:   err,
-		}) //fmt.Errorf("user not allowed to perform this action: %w", err)
-	}
-
 	var list []cloud.NPCustomerSummary
-	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
 		var dbErr error
 		list, dbErr = db.ListNPCustomers(ctx, tx)
 		if dbErr != nil {
@@ -644,15 +634,7 @@ func (svc NPDataService) ListCustomers(ctx cloud.Context, req UBRequest) (interf
 }
 
 func (svc NPDataService) GetCustomerDetails(ctx cloud.Context, req InvoiceListRequest) (interface{}, *cloud.Error) {
-	// We checked that the token existed and was valid in the handler, but now we need to make sure the user is allowed to do this action.
-	err := svc.ValidateUserAccess(ctx)
-	if err != nil {
-		return GetInvoiceDataResponse{}, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindForbidden,
-			Message: "user not allowed to perform this action",
-			Cause:   err,
-		}) //fmt.Errorf("user not allowed to perform this action: %w", err)
-	}
+	var err error
 
 	var customer cloud.NPCustomerDetail
 	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
@@ -673,19 +655,19 @@ func (svc NPDataService) GetCustomerDetails(ctx cloud.Context, req InvoiceListRe
 	return customer, nil
 }
 
-func (svc NPDataService) UpdateCustomerDetails(ctx cloud.Context, req UpdateCustomerDetailRequest) (interface{}, *cloud.Error) {
-	// We checked that the token existed and was valid in the handler, but now we need to make sure the user is allowed to do this action.
-	err := svc.ValidateUserAccess(ctx)
-	if err != nil {
-		return GetInvoiceDataResponse{}, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindForbidden,
-			Message: "user not allowed to perform this action",
-			Cause:   err,
-		}) //fmt.Errorf("user not allowed to perform this action: %w", err)
-	}
+func (svc NPDataService) UpdateCustomerDetails(ctx cloud.Context, req UpdateCustomerDetailRequest) (_ interface{}, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionUpdateCustomerDetail, cloud.AuditTargetCustomer, strconv.Itoa(req.Data.CustomerNumber))
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	var err error
 
 	// First, lets save these values to the database.
+	var before cloud.NPCustomerDetail
 	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		if before, dbErr = db.GetNPCustomerDetail(ctx, tx, req.Data.CustomerNumber); dbErr != nil {
+			return dbErr
+		}
 		return db.UpdateNPCustomerDetail(ctx, tx, req.Data)
 	})
 	if err != nil {
@@ -695,6 +677,9 @@ func (svc NPDataService) UpdateCustomerDetails(ctx cloud.Context, req UpdateCust
 			Cause:   err,
 		}) //fmt.Errorf("updateCustomerDetail/RunInTransaction failed: %w", err)
 	}
+	// The change is saved even if Utilibill then refuses it, in which case the
+	// entry records the failure.
+	entry.Diff(before, req.Data)
 
 	// Now, lets send these values to Utilibill to update that record.
 	retDetail, err := utilibill.UpdateCustomerDetailOnUtilibill(ctx, req.Data)
@@ -709,16 +694,11 @@ func (svc NPDataService) UpdateCustomerDetails(ctx cloud.Context, req UpdateCust
 	return nil, nil
 }
 
-func (svc NPDataService) InitializeMeterData(ctx cloud.Context, req InitializeMeterDataRequest) (interface{}, *cloud.Error) {
-	// We checked that the token existed and was valid in the handler, but now we need to make sure the user is allowed to do this action.
-	err := svc.ValidateUserAccess(ctx)
-	if err != nil {
-		return GetInvoiceDataResponse{}, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindForbidden,
-			Message: "user not allowed to perform this action",
-			Cause:   err,
-		}) //fmt.Errorf("user not allowed to perform this action: %w", err)
-	}
+func (svc NPDataService) InitializeMeterData(ctx cloud.Context, req InitializeMeterDataRequest) (_ interface{}, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionInitializeMeterData, cloud.AuditTargetMeters, "")
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	var err error
 
 	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
 		return db.InitMeterData(ctx, tx, req.Data)
@@ -730,22 +710,7 @@ func (svc NPDataService) InitializeMeterData(ctx cloud.Context, req InitializeMe
 			Cause:   err,
 		}) //fmt.Errorf("updateCustomerDetail/RunInTransaction failed: %w", err)
 	}
+	entry.Diff(nil, map[string]int{"meters": len(req.Data)})
 
 	return nil, nil
 }
-
-func (svc NPDataService) ValidateUserAccess(ctx cloud.Context) error {
-	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
-		dbErr := db.UserAccess(ctx, tx)
-		if dbErr != nil {
-			return dbErr
-		}
-		return nil
-	})
-
-	if err != nil {
-		return fmt.Errorf("user not found: %w", err)
-	}
-
-	return nil
-}
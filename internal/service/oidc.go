@@ -0,0 +1,166 @@
+package service
+
+import (
+	"strings"
+	"time"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/db"
+	"github.com/kmhebb/serverExample/lib/oidc"
+	"github.com/kmhebb/serverExample/log"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+// OIDCStateExpiration is how long users have to log in at the identity
+// provider and come back.
+const OIDCStateExpiration = 10 * time.Minute
+
+type StartOIDCResponse struct {
+	// URL is where the client should send the user to log in.
+	URL string `json:"url"`
+}
+
+type OIDCCallbackRequest struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
+
+	// Error is set instead of Code when the provider did not log the user in.
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// StartOIDC begins a login through the identity provider. The state, nonce
+// and PKCE verifier of the login are stored until the user comes back through
+// OIDCCallback.
+func (svc UserService) StartOIDC(ctx cloud.Context) (*StartOIDCResponse, *cloud.Error) {
+	if svc.OIDC == nil {
+		return nil, errOIDCDisabled()
+	}
+
+	state, err := oidc.Random()
+	if err != nil {
+		return nil, errOIDCStart(err)
+	}
+	nonce, err := oidc.Random()
+	if err != nil {
+		return nil, errOIDCStart(err)
+	}
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		return nil, errOIDCStart(err)
+	}
+
+	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		return db.SaveOIDCState(ctx, tx, state, nonce, verifier, time.Now().Add(OIDCStateExpiration))
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service save oidc state db transaction failed",
+			Cause:   err,
+		})
+	}
+
+	return &StartOIDCResponse{URL: svc.OIDC.AuthCodeURL(state, nonce, challenge)}, nil
+}
+
+// OIDCCallback finishes a login through the identity provider. The code is
+// exchanged for an ID token, whose verified email is mapped to a user through
+// FindOrCreate, and the user gets the tokens Login would have returned. Second
+// factors are left to the provider.
+func (svc UserService) OIDCCallback(ctx cloud.Context, req OIDCCallbackRequest) (resp LoginUserResponse, e *cloud.Error) {
+	if svc.OIDC == nil {
+		return resp, errOIDCDisabled()
+	}
+	if req.Error != "" {
+		svc.L.Info(ctx.Ctx, "OIDC login refused by provider", log.Fields{"error": req.Error, "description": req.ErrorDescription})
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindAuthenticate,
+			Message: "identity provider did not log the user in",
+		})
+	}
+	if req.Code == "" || req.State == "" {
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "code and state are required",
+		})
+	}
+
+	var nonce, verifier string
+	var ok bool
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		nonce, verifier, ok, dbErr = db.UseOIDCState(ctx, tx, req.State)
+		return dbErr
+	})
+	if err != nil {
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service use oidc state db transaction failed",
+			Cause:   err,
+		})
+	}
+	if !ok {
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindAuthenticate,
+			Message: "login is unknown or has expired, start again",
+		})
+	}
+
+	id, err := svc.OIDC.Exchange(ctx.Ctx, req.Code, verifier, nonce)
+	if err != nil {
+		svc.L.Info(ctx.Ctx, "OIDC code exchange failed", log.Fields{"err": err})
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindAuthenticate,
+			Message: "identity provider login could not be verified",
+			Cause:   err,
+		})
+	}
+	// Only an address the provider has verified can be trusted to identify
+	// one of our users.
+	if id.Email == "" || !id.EmailVerified {
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindAuthenticate,
+			Message: "identity provider did not share a verified email",
+		})
+	}
+
+	first, last := id.GivenName, id.FamilyName
+	if first == "" {
+		first = strings.Split(id.Email, "@")[0]
+	}
+	if last == "" {
+		last = "Unknown"
+	}
+	u, e := svc.FindOrCreate(ctx, id.Email, first, last)
+	if e != nil {
+		return resp, e
+	}
+	ctx.UserKey = u.ID
+
+	if u.Locked(time.Now()) {
+		svc.L.Info(ctx.Ctx, "Login rejected, user is locked", log.Fields{"user": u.ID, "until": u.LockedUntil})
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindForbidden,
+			Message: "account is temporarily locked after too many failed login attempts",
+		})
+	}
+
+	svc.L.Info(ctx.Ctx, "OIDC login accepted", log.Fields{"user": u.ID, "subject": id.Subject})
+	return svc.completeLogin(ctx, u)
+}
+
+func errOIDCDisabled() *cloud.Error {
+	return cloud.NewError(cloud.ErrOpts{
+		Kind:    cloud.ErrKindTodo,
+		Message: "login through an identity provider is not configured",
+	})
+}
+
+func errOIDCStart(err error) *cloud.Error {
+	return cloud.NewError(cloud.ErrOpts{
+		Kind:    cloud.ErrKindInternal,
+		Message: "user service failed to start oidc login",
+		Cause:   err,
+	})
+}
@@ -0,0 +1,60 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/db"
+)
+
+var errInvalidCursor = errors.New("cursor is invalid")
+
+// cursor is the form of a db.Position sent to clients, who treat it as opaque.
+// It records the sort it was made for, since a position means nothing in
+// another order.
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+// encodeCursor returns the cursor continuing the list sorted by sort after p,
+// or "" if p is nil.
+func encodeCursor(sort string, p *db.Position) string {
+	if p == nil {
+		return ""
+	}
+	b, _ := json.Marshal(cursor{Sort: sort, Value: p.Value, ID: p.ID})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor returns the position of a cursor made by encodeCursor for the
+// same sort, or nil if s is empty.
+func decodeCursor(s, sort string) (*db.Position, error) {
+	if s == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errInvalidCursor
+	}
+	var c cursor
+	if err := json.Unmarshal(b, &c); err != nil || c.Sort != sort || c.ID == "" {
+		return nil, errInvalidCursor
+	}
+	return &db.Position{Value: c.Value, ID: c.ID}, nil
+}
+
+// pageLimit returns the number of items to put on a page when limit were asked
+// for.
+func pageLimit(limit int) int {
+	switch {
+	case limit <= 0:
+		return cloud.DefaultPageLimit
+	case limit > cloud.MaxPageLimit:
+		return cloud.MaxPageLimit
+	}
+	return limit
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/db"
+	"github.com/kmhebb/serverExample/lib/passhash"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+// PasswordPolicy decides which new passwords users may choose. Zero fields
+// take their value from DefaultPasswordPolicy.
+type PasswordPolicy struct {
+	// MinLength is the fewest characters a password may have.
+	MinLength int
+
+	// History is how many of the user's most recent passwords, counting the
+	// current one, may not be reused. A negative value allows any reuse.
+	History int
+
+	// Breached holds known breached or common passwords, which are refused.
+	Breached BreachedPasswords
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength: 10,
+	History:   5,
+}
+
+func (p PasswordPolicy) withDefaults() PasswordPolicy {
+	if p.MinLength == 0 {
+		p.MinLength = DefaultPasswordPolicy.MinLength
+	}
+	if p.History == 0 {
+		p.History = DefaultPasswordPolicy.History
+	}
+	if p.History < 0 {
+		p.History = 0
+	}
+	return p
+}
+
+// Remembered returns how many of a user's previous passwords, not counting
+// the current one, must be kept to enforce the policy.
+func (p PasswordPolicy) Remembered() int {
+	p = p.withDefaults()
+	if p.History < 1 {
+		return 0
+	}
+	return p.History - 1
+}
+
+// Check returns every way the password breaks the policy, or nil if it
+// doesn't. previous holds the hashes of the user's current and earlier
+// passwords.
+func (p PasswordPolicy) Check(password string, previous []string) *FieldError {
+	p = p.withDefaults()
+
+	var errs []string
+	if n := len([]rune(password)); n < p.MinLength {
+		errs = append(errs, fmt.Sprintf("Must be at least %d characters long", p.MinLength))
+	}
+	if p.Breached.Contains(password) {
+		errs = append(errs, "Is too common, or has appeared in a data breach")
+	}
+	for i, hash := range previous {
+		if i >= p.History {
+			break
+		}
+		if ok, _, _ := passhash.Verify(hash, password); ok {
+			errs = append(errs, fmt.Sprintf("Must not be one of your last %d passwords", p.History))
+			break
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return NewFieldError("Password", errs...)
+}
+
+// checkNewPassword checks a new password for the user against the policy,
+// including the user's current password and as many earlier ones as the
+// policy remembers.
+func (svc UserService) checkNewPassword(ctx cloud.Context, u *cloud.User, password string) (*FieldError, *cloud.Error) {
+	previous := []string{u.PasswordHash}
+	if n := svc.Password.Remembered(); n > 0 {
+		var history []string
+		err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+			var dbErr error
+			history, dbErr = db.PasswordHistory(ctx, tx, u.ID, n)
+			return dbErr
+		})
+		if err != nil {
+			return nil, cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindInternal,
+				Message: "user service password history db transaction failed",
+				Cause:   err,
+			})
+		}
+		previous = append(previous, history...)
+	}
+	return svc.Password.Check(password, previous), nil
+}
+
+// policyError wraps the policy violations of a new password in an error the
+// client can show in full.
+func policyError(fe *FieldError) *cloud.Error {
+	return cloud.NewError(cloud.ErrOpts{
+		Kind:    cloud.ErrKindInvalid,
+		Message: "new password does not meet the password policy",
+		Details: []*FieldError{fe},
+	})
+}
+
+// BreachedPasswords is a set of passwords that must not be used. Passwords are
+// compared without regard to case.
+type BreachedPasswords map[string]struct{}
+
+// LoadBreachedPasswords reads a list of passwords, one per line. Blank lines
+// and lines starting with # are skipped.
+func LoadBreachedPasswords(r io.Reader) (BreachedPasswords, error) {
+	b := BreachedPasswords{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		b[strings.ToLower(line)] = struct{}{}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("could not read breached passwords: %w", err)
+	}
+	return b, nil
+}
+
+// Contains reports whether the password is in the set.
+func (b BreachedPasswords) Contains(password string) bool {
+	_, ok := b[strings.ToLower(password)]
+	return ok
+}
@@ -0,0 +1,59 @@
+package service_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kmhebb/serverExample/internal/assert"
+	"github.com/kmhebb/serverExample/internal/service"
+	"github.com/kmhebb/serverExample/lib/passhash"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	assert := assert.New(t)
+
+	breached, err := service.LoadBreachedPasswords(strings.NewReader("# common\nPassword123\n\nletmeinplease\n"))
+	assert.OK(err)
+
+	current, err := passhash.Hash("current-password")
+	assert.OK(err)
+	older, err := passhash.Hash("older-password")
+	assert.OK(err)
+	previous := []string{current, older}
+
+	p := service.PasswordPolicy{MinLength: 12, History: 2, Breached: breached}
+
+	assert.True(p.Check("a perfectly fine one", previous) == nil)
+
+	fe := p.Check("short", previous)
+	assert.NotNil(fe)
+	assert.Equals(fe.Name, "Password")
+	assert.Equals(len(fe.Errors), 1)
+
+	// Breached passwords are matched without regard to case.
+	assert.NotNil(p.Check("LETMEINPLEASE", previous))
+
+	assert.NotNil(p.Check("current-password", previous))
+	assert.NotNil(p.Check("older-password", previous))
+
+	// Every violation is reported at once.
+	fe = p.Check("password123", previous)
+	assert.NotNil(fe)
+	assert.Equals(len(fe.Errors), 2)
+
+	// Passwords older than the history are allowed again.
+	p.History = 1
+	assert.True(p.Check("older-password", previous) == nil)
+}
+
+func TestPasswordPolicyDefaults(t *testing.T) {
+	assert := assert.New(t)
+
+	var p service.PasswordPolicy
+	assert.Equals(p.Remembered(), service.DefaultPasswordPolicy.History-1)
+	assert.NotNil(p.Check("123456789", nil))
+	assert.True(p.Check("1234567890", nil) == nil)
+
+	p.History = -1
+	assert.Equals(p.Remembered(), 0)
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/db"
+	"github.com/kmhebb/serverExample/log"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+// DisableUser stops a user from logging in, and logs them out everywhere,
+// until they are enabled again.
+func (svc UserService) DisableUser(ctx cloud.Context, req GetUserRequest) (interface{}, *cloud.Error) {
+	return nil, svc.setStatus(ctx, cloud.ActionDisableUser, req.ID, cloud.StatusDisabled)
+}
+
+// EnableUser lets a disabled or locked user log in again.
+func (svc UserService) EnableUser(ctx cloud.Context, req GetUserRequest) (interface{}, *cloud.Error) {
+	return nil, svc.setStatus(ctx, cloud.ActionEnableUser, req.ID, cloud.StatusActive)
+}
+
+// LockUser stops a user from logging in, and logs them out everywhere, until
+// an admin unlocks them through UnlockUser.
+func (svc UserService) LockUser(ctx cloud.Context, req GetUserRequest) (interface{}, *cloud.Error) {
+	return nil, svc.setStatus(ctx, cloud.ActionLockUser, req.ID, cloud.StatusLocked)
+}
+
+// DeleteUser deletes a user for good. Their profile is kept, so that what
+// they did can still be traced to them, but it can't be used again.
+func (svc UserService) DeleteUser(ctx cloud.Context, req GetUserRequest) (interface{}, *cloud.Error) {
+	return nil, svc.setStatus(ctx, cloud.ActionDeleteUser, req.ID, cloud.StatusDeleted)
+}
+
+// setStatus moves a user to a new status, if their current status allows it.
+// Users who can no longer log in have every token revoked, and deleted users
+// lose their pending invites. The change is audited as act.
+func (svc UserService) setStatus(ctx cloud.Context, act cloud.Action, id string, to cloud.UserStatus) (e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, act, cloud.AuditTargetUser, id)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	if id == "" {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "id is required",
+		})
+	}
+	// An admin locking themselves out could leave nobody able to manage users.
+	if id == ctx.UserKey {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "you cannot change your own status",
+		})
+	}
+
+	var u *cloud.User
+	var changed bool
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		u, dbErr = db.FindByID(ctx, tx, id)
+		if dbErr != nil || u.ID == "" || !u.Status.CanBecome(to) {
+			return dbErr
+		}
+		if changed, dbErr = db.UpdateUserStatus(ctx, tx, id, u.Status, to); dbErr != nil || !changed {
+			return dbErr
+		}
+		if to == cloud.StatusActive {
+			return nil
+		}
+		if dbErr = db.RevokeAllTokens(ctx, tx, id); dbErr != nil {
+			return dbErr
+		}
+		if to == cloud.StatusDeleted {
+			return db.RevokeUserInvites(ctx, tx, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service set user status db transaction failed",
+			Cause:   err,
+		})
+	}
+	if u.ID == "" {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindNotFound,
+			Message: "user not found",
+		})
+	}
+	if !changed {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindConflict,
+			Message: fmt.Sprintf("user is %s and can't be made %s", u.Status, to),
+		})
+	}
+
+	svc.L.Info(ctx.Ctx, "Updated user status", log.Fields{"id": id, "from": u.Status, "to": to, "by": ctx.UserKey})
+	entry.Diff(map[string]cloud.UserStatus{"status": u.Status}, map[string]cloud.UserStatus{"status": to})
+
+	return nil
+}
+
+// Find returns the user with the email.
+func (svc UserService) Find(ctx cloud.Context, req UserRequest) (*GetUserResponse, *cloud.Error) {
+	if req.Email == "" {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "email is required",
+		})
+	}
+
+	var resp GetUserResponse
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		resp.User, dbErr = db.FindByEmail(ctx, tx, strings.ToLower(req.Email))
+		return dbErr
+	})
+	// FindByEmail fails when there is no such user, as well as on a real
+	// database error, and the two can't be told apart.
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindNotFound,
+			Message: "user not found",
+			Cause:   err,
+		})
+	}
+
+	return &resp, nil
+}
+
+// statusError returns the error a user who is not active gets when they try to
+// log in or use a token, or nil if they are active.
+func statusError(u *cloud.User) *cloud.Error {
+	var msg string
+	switch u.Status {
+	case cloud.StatusActive:
+		return nil
+	case cloud.StatusInvited:
+		msg = "account has not been activated, accept your invite first"
+	case cloud.StatusLocked:
+		msg = "account is locked, ask an admin to unlock it"
+	case cloud.StatusDeleted:
+		msg = "account has been deleted"
+	default:
+		msg = "account is disabled"
+	}
+	return cloud.NewError(cloud.ErrOpts{
+		Kind:    cloud.ErrKindForbidden,
+		Message: msg,
+	})
+}
@@ -0,0 +1,297 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"strings"
+	"time"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/db"
+	"github.com/kmhebb/serverExample/lib/token"
+	"github.com/kmhebb/serverExample/lib/totp"
+	"github.com/kmhebb/serverExample/log"
+	"github.com/kmhebb/serverExample/pg"
+)
+
+const (
+	// TOTPIssuer names the application in authenticator apps.
+	TOTPIssuer = "Cloud"
+
+	// RecoveryCodeCount is how many recovery codes a user gets when they
+	// enroll.
+	RecoveryCodeCount = 10
+)
+
+type EnrollTOTPResponse struct {
+	Secret string `json:"secret"`
+	// URI is the otpauth URI to show as a QR code.
+	URI string `json:"uri"`
+}
+
+type ConfirmTOTPRequest struct {
+	Code string `json:"code"`
+}
+
+// ConfirmTOTPResponse holds the only copy of the user's recovery codes.
+type ConfirmTOTPResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// LoginTOTPRequest finishes a login with either a code from the user's
+// authenticator or one of their recovery codes.
+type LoginTOTPRequest struct {
+	ChallengeToken string `json:"challengeToken"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recoveryCode"`
+}
+
+// EnrollTOTP creates a new TOTP secret for the requesting user. It does not
+// take effect until the user proves they have set up their authenticator by
+// calling ConfirmTOTP.
+func (svc UserService) EnrollTOTP(ctx cloud.Context) (_ *EnrollTOTPResponse, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionEnrollTOTP, cloud.AuditTargetUser, ctx.UserKey)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	if e := forbidAPIKey(ctx); e != nil {
+		return nil, e
+	}
+	if e := forbidImpersonated(ctx); e != nil {
+		return nil, e
+	}
+	u, e := svc.requester(ctx)
+	if e != nil {
+		return nil, e
+	}
+	// Replacing a working second factor needs more than a bearer token.
+	if u.TOTPEnabled {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindConflict,
+			Message: "two-factor authentication is already enabled",
+		})
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service failed to generate totp secret",
+			Cause:   err,
+		})
+	}
+
+	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		return db.SetTOTPSecret(ctx, tx, u.ID, secret)
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service enroll totp db transaction failed",
+			Cause:   err,
+		})
+	}
+
+	return &EnrollTOTPResponse{
+		Secret: secret,
+		URI:    totp.ProvisioningURI(secret, TOTPIssuer, u.Email),
+	}, nil
+}
+
+// ConfirmTOTP enables TOTP for the requesting user once they send a valid code
+// for the secret from EnrollTOTP, and returns their recovery codes.
+func (svc UserService) ConfirmTOTP(ctx cloud.Context, req ConfirmTOTPRequest) (_ *ConfirmTOTPResponse, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionConfirmTOTP, cloud.AuditTargetUser, ctx.UserKey)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	if e := forbidAPIKey(ctx); e != nil {
+		return nil, e
+	}
+	if e := forbidImpersonated(ctx); e != nil {
+		return nil, e
+	}
+	u, e := svc.requester(ctx)
+	if e != nil {
+		return nil, e
+	}
+	if u.TOTPSecret == "" || u.TOTPEnabled {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "no two-factor enrollment is pending",
+		})
+	}
+
+	step, ok, err := totp.Validate(u.TOTPSecret, req.Code, time.Now())
+	if err != nil || !ok {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInvalid,
+			Message: "code is invalid",
+			Cause:   err,
+		})
+	}
+
+	var resp ConfirmTOTPResponse
+	hashes := make([]string, RecoveryCodeCount)
+	for i := range hashes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindInternal,
+				Message: "user service failed to generate recovery codes",
+				Cause:   err,
+			})
+		}
+		resp.RecoveryCodes = append(resp.RecoveryCodes, code)
+		hashes[i] = token.Hash(normalizeRecoveryCode(code))
+	}
+
+	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		if err := db.EnableTOTP(ctx, tx, u.ID, step); err != nil {
+			return err
+		}
+		return db.ReplaceRecoveryCodes(ctx, tx, u.ID, hashes)
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service confirm totp db transaction failed",
+			Cause:   err,
+		})
+	}
+
+	svc.L.Info(ctx.Ctx, "Enabled two-factor authentication", log.Fields{"user": u.ID})
+	entry.Diff(map[string]bool{"totpEnabled": false}, map[string]bool{"totpEnabled": true})
+
+	return &resp, nil
+}
+
+// LoginTOTP is the second step of logging in for users with TOTP enabled. It
+// exchanges the challenge token from Login, along with a code, for the tokens
+// Login would otherwise have returned. Wrong codes count as failed logins.
+func (svc UserService) LoginTOTP(ctx cloud.Context, req LoginTOTPRequest) (resp LoginUserResponse, e *cloud.Error) {
+	if req.Code == "" && req.RecoveryCode == "" {
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "code is required",
+		})
+	}
+
+	claims, err := token.ParsePurpose(req.ChallengeToken, token.PurposeMFA)
+	if err != nil {
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindAuthenticate,
+			Message: "challenge token is invalid or expired",
+			Cause:   err,
+		})
+	}
+
+	var u *cloud.User
+	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		u, dbErr = db.FindByID(ctx, tx, claims.UID)
+		return dbErr
+	})
+	if err != nil {
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service find by id db transaction failed",
+			Cause:   err,
+		})
+	}
+	if u.ID == "" || !u.TOTPEnabled || u.TokenGeneration != claims.Generation {
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindAuthenticate,
+			Message: "challenge token is invalid or expired",
+		})
+	}
+	ctx.UserKey = u.ID
+
+	if u.Locked(time.Now()) {
+		svc.L.Info(ctx.Ctx, "Login rejected, user is locked", log.Fields{"user": u.ID, "until": u.LockedUntil})
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindForbidden,
+			Message: "account is temporarily locked after too many failed login attempts",
+		})
+	}
+
+	var ok bool
+	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		if req.RecoveryCode != "" {
+			var dbErr error
+			ok, dbErr = db.UseRecoveryCode(ctx, tx, u.ID, token.Hash(normalizeRecoveryCode(req.RecoveryCode)))
+			return dbErr
+		}
+
+		step, valid, err := totp.Validate(u.TOTPSecret, req.Code, time.Now())
+		if err != nil || !valid {
+			return err
+		}
+		// Each code is only accepted once, even within its period.
+		ok, err = db.UseTOTPStep(ctx, tx, u.ID, step)
+		return err
+	})
+	if err != nil {
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service verify totp db transaction failed",
+			Cause:   err,
+		})
+	}
+
+	if !ok {
+		if err := svc.recordFailedLogin(ctx, u); err != nil {
+			svc.L.Info(ctx.Ctx, "Failed to record failed login", log.Fields{"user": u.ID, "err": err})
+		}
+		svc.L.Info(ctx.Ctx, "Login Failed, invalid second factor", log.Fields{"user": u.ID})
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindAuthenticate,
+			Message: "code is invalid",
+		})
+	}
+	if req.RecoveryCode != "" {
+		svc.L.Info(ctx.Ctx, "Recovery code used", log.Fields{"user": u.ID})
+	}
+
+	return svc.completeLogin(ctx, u)
+}
+
+// requester loads the requesting user.
+func (svc UserService) requester(ctx cloud.Context) (*cloud.User, *cloud.Error) {
+	var u *cloud.User
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		u, dbErr = db.FindByID(ctx, tx, ctx.UserKey)
+		return dbErr
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service find by id db transaction failed",
+			Cause:   err,
+		})
+	}
+	if u.ID == "" {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindNotFound,
+			Message: "user not found",
+		})
+	}
+	return u, nil
+}
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRecoveryCode returns a random code formatted as xxxxx-xxxxx.
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	c := strings.ToLower(recoveryEncoding.EncodeToString(b))[:10]
+	return c[:5] + "-" + c[5:], nil
+}
+
+func normalizeRecoveryCode(c string) string {
+	c = strings.ToLower(c)
+	c = strings.ReplaceAll(c, "-", "")
+	return strings.ReplaceAll(c, " ", "")
+}
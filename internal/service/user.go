@@ -1,17 +1,17 @@
 package service
 
 import (
+	"bytes"
 	"fmt"
+	"html/template"
 	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
-
 	cloud "github.com/kmhebb/serverExample"
 	"github.com/kmhebb/serverExample/internal/db"
 	"github.com/kmhebb/serverExample/lib/email"
-	"github.com/kmhebb/serverExample/lib/random"
-	"github.com/kmhebb/serverExample/lib/random/password"
+	"github.com/kmhebb/serverExample/lib/oidc"
+	"github.com/kmhebb/serverExample/lib/passhash"
 	"github.com/kmhebb/serverExample/lib/token"
 	"github.com/kmhebb/serverExample/log"
 	"github.com/kmhebb/serverExample/pg"
@@ -22,6 +22,20 @@ type UserService struct {
 	DB Database
 	L  log.Logger
 	Em email.Service
+	Az cloud.AuthorizationService
+
+	// Lockout decides how long users are locked out after failed logins.
+	Lockout LockoutPolicy
+
+	// Password decides which new passwords users may choose.
+	Password PasswordPolicy
+
+	// OIDC is the identity provider users can log in through instead of with
+	// a password. OIDC logins are turned off if it is nil.
+	OIDC *oidc.Provider
+
+	// Au records every change made to users.
+	Au cloud.Auditor
 }
 
 type GetUserRequest struct {
@@ -37,8 +51,18 @@ type LoginUserRequest struct {
 	Password string `json:"password"`
 }
 
+// LoginUserResponse holds the tokens of a logged in user. If MFARequired is
+// set, the tokens are empty and ChallengeToken must be sent to LoginTOTP with
+// a code to finish logging in.
 type LoginUserResponse struct {
-	Token string `json:"token"`
+	Token          string `json:"token"`
+	RefreshToken   string `json:"refreshToken"`
+	MFARequired    bool   `json:"mfaRequired,omitempty"`
+	ChallengeToken string `json:"challengeToken,omitempty"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
 }
 
 type PutUserRequest struct {
@@ -48,6 +72,10 @@ type PutUserRequest struct {
 	LastName    string `json:"lastname"`
 	OldPassword string `json:"oldpassword"`
 	NewPassword string `json:"newpassword"`
+
+	// MagicLink opts the user in to, or out of, logging in through magic
+	// links. It is left alone if not set.
+	MagicLink *bool `json:"magiclink"`
 }
 
 type UserRequest struct {
@@ -56,6 +84,12 @@ type UserRequest struct {
 
 type ResetPasswordRequest struct {
 	Token string `json:"token"`
+
+	// Password and Confirm are the new password, as posted from the reset
+	// form. Submitted is false when the form is only being shown.
+	Password  string `json:"password"`
+	Confirm   string `json:"confirm"`
+	Submitted bool   `json:"-"`
 }
 
 type ConfirmValidationRequest struct {
@@ -64,9 +98,15 @@ type ConfirmValidationRequest struct {
 }
 
 type CreateNewUserRequest struct {
-	Email     string `json:"email"`
-	FirstName string `json:"firstName"`
-	LastName  string `json:"lastName"`
+	Email     string     `json:"email"`
+	FirstName string     `json:"firstName"`
+	LastName  string     `json:"lastName"`
+	Role      cloud.Role `json:"role"`
+}
+
+type SetUserRoleRequest struct {
+	ID   string     `json:"id"`
+	Role cloud.Role `json:"role"`
 }
 
 type NewUserResponse struct {
@@ -74,15 +114,37 @@ type NewUserResponse struct {
 }
 
 type ListUsersRequest struct {
-	ListType string `json:"listType"`
+	// Search limits the list to users whose name or email contains it.
+	Search string `json:"search"`
+
+	// Status limits the list to users with the status. Deleted users are only
+	// listed when asked for.
+	Status cloud.UserStatus `json:"status"`
+
+	// ActiveAfter and ActiveBefore limit the list to users last active in the
+	// range.
+	ActiveAfter  *time.Time `json:"activeAfter"`
+	ActiveBefore *time.Time `json:"activeBefore"`
+
+	// Sort is the key to sort on: name, email or lastActivity. A leading "-"
+	// sorts in descending order. Users are sorted by name by default.
+	Sort string `json:"sort"`
+
+	// Limit is the number of users on the page, and Cursor is the NextCursor
+	// of the previous page.
+	Limit  int    `json:"limit"`
+	Cursor string `json:"cursor"`
 }
 
 type ListUsersResponse struct {
-	Users []cloud.User
+	Users  []cloud.User `json:"users"`
+	Paging cloud.Paging `json:"paging"`
 }
 
-func (svc UserService) CreateNewUser(ctx cloud.Context, req CreateNewUserRequest) (*NewUserResponse, *cloud.Error) {
-	// We will need to come up with a way to authenticate these requests. Will depend on if it will be user driven or admin driven.
+func (svc UserService) CreateNewUser(ctx cloud.Context, req CreateNewUserRequest) (_ *NewUserResponse, e *cloud.Error) {
+	// Only admins can reach this endpoint, the handler has already checked the requesting user's role.
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionCreateUser, cloud.AuditTargetUser, "")
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
 
 	if req.Email == "" {
 		return &NewUserResponse{}, cloud.NewError(cloud.ErrOpts{
@@ -92,7 +154,17 @@ func (svc UserService) CreateNewUser(ctx cloud.Context, req CreateNewUserRequest
 		}) //fmt.Errorf("email is required")
 	}
 
-	user, err := svc.FindOrCreate(ctx, req.Email, req.FirstName, req.LastName)
+	if req.Role == "" {
+		req.Role = cloud.DefaultRole
+	}
+	if !req.Role.Valid() {
+		return &NewUserResponse{}, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "role must be one of admin, operator or viewer",
+		})
+	}
+
+	user, created, err := svc.findOrCreate(ctx, req.Email, req.FirstName, req.LastName, req.Role, cloud.StatusInvited)
 	if err != nil {
 		return &NewUserResponse{}, cloud.NewError(cloud.ErrOpts{
 			Kind:    cloud.ErrKindInternal,
@@ -101,12 +173,36 @@ func (svc UserService) CreateNewUser(ctx cloud.Context, req CreateNewUserRequest
 		}) //fmt.Errorf("failed to create new user: %s", err)
 	}
 
+	entry.TargetID = user.ID
+
+	// New users choose their own password by accepting an invite.
+	if created {
+		entry.Diff(nil, user)
+		if e := svc.invite(ctx, user); e != nil {
+			return &NewUserResponse{}, e
+		}
+	}
+
 	return &NewUserResponse{User: user}, nil
 }
 
+// FindOrCreate returns the existing user with the email, or creates one. New
+// users are active but have no password, so they log in through the identity
+// provider that vouched for them until they reset it.
 func (svc UserService) FindOrCreate(ctx cloud.Context, email string, firstName string, lastName string) (*cloud.User, *cloud.Error) {
+	u, created, e := svc.findOrCreate(ctx, email, firstName, lastName, cloud.DefaultRole, cloud.StatusActive)
+	if created {
+		audit(svc.Au, ctx, cloud.NewAuditEntry(ctx, cloud.ActionOIDCCallback, cloud.AuditTargetUser, u.ID).Diff(nil, u))
+	}
+	return u, e
+}
+
+// findOrCreate returns the existing user with the email, or creates one with
+// the given role and status, and reports whether it was created. The role and
+// status of an existing user are left untouched.
+func (svc UserService) findOrCreate(ctx cloud.Context, email string, firstName string, lastName string, role cloud.Role, status cloud.UserStatus) (*cloud.User, bool, *cloud.Error) {
 	if email == "" {
-		return nil, cloud.NewError(cloud.ErrOpts{
+		return nil, false, cloud.NewError(cloud.ErrOpts{
 			Kind:    cloud.ErrKindBadRequest,
 			Message: "email is required",
 			//Cause: err,
@@ -125,34 +221,28 @@ func (svc UserService) FindOrCreate(ctx cloud.Context, email string, firstName s
 	// If err != nil, the find failed, we have to continue with then new user creation.
 	// This complicates error reporting if there is truly a DB error. But that will be another day.
 	if err == nil {
-		return existing, nil
+		return existing, false, nil
 	}
 
 	newUser, err := NewUser(email, firstName, lastName)
 	if err != nil {
-		return nil, cloud.NewError(cloud.ErrOpts{
+		return nil, false, cloud.NewError(cloud.ErrOpts{
 			Kind:    cloud.ErrKindInternal,
 			Message: "user service failed to initialize new user",
 			Cause:   err,
 		}) //err
 	}
-	passphrase, err := SetTempPassword(newUser)
-	if err != nil {
-		return nil, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindInternal,
-			Message: "user service failed to set a temp password",
-			Cause:   err,
-		}) //fmt.Errorf("failed to set passphrase")
-	}
+	// There is no password to log in with until the user chooses one.
+	newUser.MustChange = true
 	newUser.ID = uuid.New()
-	newUser.DateCreated = string(time.Now().Format("1/2/2006"))
-	newUser.DateModified = string(time.Now().Format("1/2/2006"))
+	newUser.Role = role
+	newUser.Status = status
 
 	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
 		return db.CreateUser(ctx, tx, newUser)
 	})
 	if err != nil {
-		return nil, cloud.NewError(cloud.ErrOpts{
+		return nil, false, cloud.NewError(cloud.ErrOpts{
 			Kind:    cloud.ErrKindInternal,
 			Message: "user service create user db transaction failed",
 			Cause:   err,
@@ -161,9 +251,7 @@ func (svc UserService) FindOrCreate(ctx cloud.Context, email string, firstName s
 
 	svc.L.Info(ctx.Ctx, "Created new user", log.Fields{"email": email})
 
-	svc.Em.NewUserAsync(ctx, svc.Name(newUser), email, passphrase)
-
-	return newUser, nil
+	return newUser, true, nil
 }
 
 func (svc UserService) Get(ctx cloud.Context, req GetUserRequest) (resp GetUserResponse, e *cloud.Error) {
@@ -186,6 +274,10 @@ func (svc UserService) Get(ctx cloud.Context, req GetUserRequest) (resp GetUserR
 		}) //fmt.Errorf("id is required")
 	}
 
+	if e := svc.authorizeOther(ctx, req.ID); e != nil {
+		return resp, e
+	}
+
 	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
 		var dbErr error
 		resp.User, dbErr = db.FindByID(ctx, tx, req.ID)
@@ -233,46 +325,101 @@ func (svc UserService) Login(ctx cloud.Context, req LoginUserRequest) (resp Logi
 	}
 
 	ctx.UserKey = u.ID
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionLogin, cloud.AuditTargetUser, u.ID)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	// Locked and disabled users are turned away without checking the
+	// password, so that guesses made while locked out tell an attacker nothing.
+	if e := statusError(u); e != nil {
+		svc.L.Info(ctx.Ctx, "Login rejected, user is not active", log.Fields{"email": req.Email, "status": u.Status})
+		return resp, e
+	}
+	if u.Locked(time.Now()) {
+		svc.L.Info(ctx.Ctx, "Login rejected, user is locked", log.Fields{"email": req.Email, "until": u.LockedUntil})
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindForbidden,
+			Message: "account is temporarily locked after too many failed login attempts",
+		})
+	}
 
-	if err = bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(req.Password)); err != nil {
-		if err != bcrypt.ErrMismatchedHashAndPassword {
-			svc.L.Info(ctx.Ctx, "Failed to verify password", log.Fields{"email": req.Email, "err": err})
-			return resp, cloud.NewError(cloud.ErrOpts{
-				Kind:    cloud.ErrKindBadRequest,
-				Message: "invalid password - password did not match",
-				Cause:   err,
-			}) //err
+	ok, rehash, err := passhash.Verify(u.PasswordHash, req.Password)
+	if err != nil {
+		svc.L.Info(ctx.Ctx, "Failed to verify password", log.Fields{"email": req.Email, "err": err})
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "invalid password - password did not match",
+			Cause:   err,
+		}) //err
+	}
+	if !ok {
+		if err := svc.recordFailedLogin(ctx, u); err != nil {
+			svc.L.Info(ctx.Ctx, "Failed to record failed login", log.Fields{"email": req.Email, "err": err})
 		}
 
-		// We are not tracking failed logins, but we could. I will leave this here.
-		// err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
-		// 	return db.UpdateLastFailedLogin(ctx, tx, u)
-		// })
-		// if err != nil {
-		// 	svc.L.Info(ctx.Ctx, "Failed to update last failed login", log.Fields{"email": req.Email, "err": err})
-		// }
-
 		svc.L.Info(ctx.Ctx, "Login Failed", log.Fields{"email": req.Email})
-		// TODO: install auditor and log this.
 
 		return resp, cloud.NewError(cloud.ErrOpts{
 			Kind:    cloud.ErrKindInternal,
 			Message: "error comparing password",
-			Cause:   err,
 		}) //err
 	}
 
-	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+	// The password is only known in the clear right now, so this is the one
+	// chance to move a legacy or outdated hash onto the default hasher. Failing
+	// to do so is not a reason to fail the login; it is retried next time.
+	if rehash {
+		if err := svc.rehashPassword(ctx, u, req.Password); err != nil {
+			svc.L.Info(ctx.Ctx, "Failed to rehash password", log.Fields{"email": req.Email, "err": err})
+		}
+	}
+
+	// Users with a second factor get a challenge token instead, which they
+	// exchange for real tokens through LoginTOTP. Failed logins are only
+	// cleared once the whole login succeeds.
+	if u.TOTPEnabled {
+		challenge, err := token.NewPurpose(u.ID, token.PurposeMFA, u.TokenGeneration, token.ChallengeExpiration)
+		if err != nil {
+			return resp, cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindInternal,
+				Message: "user service failed to issue challenge token",
+				Cause:   err,
+			})
+		}
+		svc.L.Info(ctx.Ctx, "Login password accepted, second factor required", log.Fields{"user": req.Email})
+		return LoginUserResponse{MFARequired: true, ChallengeToken: challenge}, nil
+	}
+
+	return svc.completeLogin(ctx, u)
+}
+
+// completeLogin issues tokens to a user who has passed every login step. It is
+// the last chance to turn away users who are not active, whichever way they
+// logged in.
+func (svc UserService) completeLogin(ctx cloud.Context, u *cloud.User) (resp LoginUserResponse, e *cloud.Error) {
+	if e := statusError(u); e != nil {
+		svc.L.Info(ctx.Ctx, "Login rejected, user is not active", log.Fields{"user": u.ID, "status": u.Status})
+		return resp, e
+	}
+
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		if u.FailedLogins > 0 {
+			if err := db.ResetFailedLogins(ctx, tx, u.ID); err != nil {
+				return err
+			}
+		}
 		return db.UpdateLastActivity(ctx, tx, u.ID)
 	})
 	if err != nil {
-		svc.L.Info(ctx.Ctx, "Failed to update last activity", log.Fields{"email": req.Email, "err": err})
+		svc.L.Info(ctx.Ctx, "Failed to update last activity", log.Fields{"email": u.Email, "err": err})
 	}
 
-	svc.L.Info(ctx.Ctx, "Login succeeded", log.Fields{"user": req.Email})
-	// audit entry here too.
+	svc.L.Info(ctx.Ctx, "Login succeeded", log.Fields{"user": u.Email})
 
-	resp.Token, err = token.New(string(u.ID), "")
+	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var txErr error
+		resp, txErr = svc.issueTokens(ctx, tx, u, "")
+		return txErr
+	})
 	if err != nil {
 		return resp, cloud.NewError(cloud.ErrOpts{
 			Kind:    cloud.ErrKindInternal,
@@ -284,7 +431,322 @@ func (svc UserService) Login(ctx cloud.Context, req LoginUserRequest) (resp Logi
 	return resp, nil
 }
 
-func (svc UserService) Put(ctx cloud.Context, req PutUserRequest) (interface{}, *cloud.Error) {
+// recordFailedLogin counts a failed login attempt, and locks the user out once
+// the lockout policy says so. The user is notified whenever they get locked.
+func (svc UserService) recordFailedLogin(ctx cloud.Context, u *cloud.User) error {
+	var until time.Time
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		failures, err := db.RecordFailedLogin(ctx, tx, u.ID)
+		if err != nil {
+			return err
+		}
+		d := svc.Lockout.LockDuration(failures)
+		if d == 0 {
+			return nil
+		}
+		until = time.Now().Add(d)
+		return db.LockUser(ctx, tx, u.ID, until)
+	})
+	if err != nil {
+		return err
+	}
+
+	if !until.IsZero() {
+		svc.L.Info(ctx.Ctx, "User locked after failed logins", log.Fields{"user": u.ID, "until": until})
+		svc.Em.AccountLockedAsync(ctx, svc.Name(u), u.Email, until)
+	}
+	return nil
+}
+
+// rehashPassword replaces the user's password hash with one made by the
+// default hasher.
+func (svc UserService) rehashPassword(ctx cloud.Context, u *cloud.User, password string) error {
+	hash, err := passhash.Hash(password)
+	if err != nil {
+		return err
+	}
+	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		return db.UpdatePasswordHash(ctx, tx, u.ID, hash)
+	})
+	if err != nil {
+		return err
+	}
+	u.PasswordHash = hash
+	return nil
+}
+
+// UnlockUser lets an admin clear a lockout, and the failed login count, before
+// it ends on its own. Users locked by an admin become active again.
+func (svc UserService) UnlockUser(ctx cloud.Context, req GetUserRequest) (_ interface{}, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionUnlockUser, cloud.AuditTargetUser, req.ID)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	if req.ID == "" {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "id is required",
+		})
+	}
+
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		if err := db.ResetFailedLogins(ctx, tx, req.ID); err != nil {
+			return err
+		}
+		unlocked, err := db.UpdateUserStatus(ctx, tx, req.ID, cloud.StatusLocked, cloud.StatusActive)
+		if unlocked {
+			entry.Diff(map[string]cloud.UserStatus{"status": cloud.StatusLocked}, map[string]cloud.UserStatus{"status": cloud.StatusActive})
+		}
+		return err
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service unlock user db transaction failed",
+			Cause:   err,
+		})
+	}
+
+	svc.L.Info(ctx.Ctx, "Unlocked user", log.Fields{"id": req.ID, "by": ctx.UserKey})
+
+	return nil, nil
+}
+
+// ImpersonateResponse holds an access token for the impersonated user. No
+// refresh token is issued, so impersonation ends when the token expires.
+type ImpersonateResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Impersonate lets an admin act as another user, to see the application the
+// way they do. The token it returns is authorized as the user, but records
+// the admin as the impersonator so that everything done with it is logged
+// against both.
+func (svc UserService) Impersonate(ctx cloud.Context, req GetUserRequest) (_ *ImpersonateResponse, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionImpersonateUser, cloud.AuditTargetUser, req.ID)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	if req.ID == "" {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "id is required",
+		})
+	}
+	if e := forbidAPIKey(ctx); e != nil {
+		return nil, e
+	}
+	if e := forbidImpersonated(ctx); e != nil {
+		return nil, e
+	}
+	if req.ID == ctx.UserKey {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "users can't impersonate themselves",
+		})
+	}
+
+	var u *cloud.User
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		u, dbErr = db.FindByID(ctx, tx, req.ID)
+		return dbErr
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service find by id db transaction failed",
+			Cause:   err,
+		})
+	}
+	if u.ID == "" {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindNotFound,
+			Message: "user not found",
+		})
+	}
+
+	tok, err := token.New(u.ID, ctx.UserKey, u.TokenGeneration)
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service failed to issue impersonation token",
+			Cause:   err,
+		})
+	}
+
+	svc.L.Info(ctx.Ctx, "Impersonation started", log.Fields{"user_id": u.ID, "impersonator_id": ctx.UserKey})
+
+	return &ImpersonateResponse{
+		Token:     tok,
+		ExpiresAt: time.Now().Add(token.OverrideExpiration),
+	}, nil
+}
+
+// forbidImpersonated returns an error if the request is made by an admin
+// impersonating a user. Impersonation is for seeing what the user sees, not
+// for changing their credentials or starting another impersonation.
+func forbidImpersonated(ctx cloud.Context) *cloud.Error {
+	if ctx.ImpersonatorKey == "" {
+		return nil
+	}
+	return cloud.NewError(cloud.ErrOpts{
+		Kind:    cloud.ErrKindForbidden,
+		Message: "not allowed while impersonating a user",
+	})
+}
+
+// forbidAPIKey returns an error if the request is made with an API key. Keys
+// are not tied to a user, so they can't act as one: they can't mint a user's
+// tokens, change a profile or end a session.
+func forbidAPIKey(ctx cloud.Context) *cloud.Error {
+	if ctx.APIKeyID == "" {
+		return nil
+	}
+	return cloud.NewError(cloud.ErrOpts{
+		Kind:    cloud.ErrKindForbidden,
+		Message: "not allowed with an api key",
+	})
+}
+
+// Refresh exchanges a refresh token for a new access token and a new refresh
+// token. Each refresh token can be used once. Presenting one that was already
+// used means it has leaked, so every token descending from the same login is
+// revoked.
+func (svc UserService) Refresh(ctx cloud.Context, req RefreshTokenRequest) (resp LoginUserResponse, e *cloud.Error) {
+	if req.RefreshToken == "" {
+		return resp, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "refresh token is required",
+		})
+	}
+
+	var reused bool
+	var rt *cloud.RefreshToken
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		rt, dbErr = db.FindRefreshToken(ctx, tx, token.Hash(req.RefreshToken))
+		if dbErr != nil || rt == nil {
+			return dbErr
+		}
+		if rt.UsedAt != nil || rt.RevokedAt != nil {
+			reused = rt.UsedAt != nil
+			return db.RevokeRefreshTokenFamily(ctx, tx, rt.FamilyID)
+		}
+		if time.Now().After(rt.ExpiresAt) {
+			return nil
+		}
+
+		u, dbErr := db.FindByID(ctx, tx, rt.UserID)
+		if dbErr != nil || u.Status != cloud.StatusActive {
+			return dbErr
+		}
+		if dbErr = db.MarkRefreshTokenUsed(ctx, tx, rt.ID); dbErr != nil {
+			return dbErr
+		}
+		resp, dbErr = svc.issueTokens(ctx, tx, u, rt.FamilyID)
+		return dbErr
+	})
+	if err != nil {
+		return LoginUserResponse{}, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service refresh token db transaction failed",
+			Cause:   err,
+		})
+	}
+
+	if reused {
+		svc.L.Info(ctx.Ctx, "Refresh token reused, revoked token family", log.Fields{"user": rt.UserID, "family": rt.FamilyID})
+	}
+	if resp.Token == "" {
+		return LoginUserResponse{}, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindAuthenticate,
+			Message: "refresh token is invalid or expired",
+		})
+	}
+
+	return resp, nil
+}
+
+// Logout revokes the access token used to make the request and, if provided,
+// the refresh token issued alongside it.
+func (svc UserService) Logout(ctx cloud.Context, req RefreshTokenRequest) (_ interface{}, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionLogout, cloud.AuditTargetUser, ctx.UserKey)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	if e := forbidAPIKey(ctx); e != nil {
+		return nil, e
+	}
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		if err := db.RevokeAccessToken(ctx, tx, ctx.TokenID, ctx.UserKey, ctx.TokenExpiry); err != nil {
+			return err
+		}
+		if req.RefreshToken == "" {
+			return nil
+		}
+		rt, err := db.FindRefreshToken(ctx, tx, token.Hash(req.RefreshToken))
+		if err != nil {
+			return err
+		}
+		// Users can only log out their own sessions.
+		if rt == nil || rt.UserID != ctx.UserKey {
+			return nil
+		}
+		return db.RevokeRefreshTokenFamily(ctx, tx, rt.FamilyID)
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service logout db transaction failed",
+			Cause:   err,
+		})
+	}
+
+	svc.L.Info(ctx.Ctx, "Logout succeeded", log.Fields{"user": ctx.UserKey})
+
+	return nil, nil
+}
+
+// issueTokens creates an access token and a refresh token for the user. The
+// refresh token joins the given token family, or starts a new one if family is
+// empty.
+func (svc UserService) issueTokens(ctx cloud.Context, tx pg.Tx, u *cloud.User, family string) (LoginUserResponse, error) {
+	var resp LoginUserResponse
+	var err error
+
+	resp.Token, err = token.New(u.ID, "", u.TokenGeneration)
+	if err != nil {
+		return LoginUserResponse{}, err
+	}
+
+	var hash string
+	resp.RefreshToken, hash, err = token.NewRefresh()
+	if err != nil {
+		return LoginUserResponse{}, err
+	}
+	if family == "" {
+		family = uuid.New()
+	}
+	err = db.SaveRefreshToken(ctx, tx, &cloud.RefreshToken{
+		ID:        uuid.New(),
+		UserID:    u.ID,
+		Hash:      hash,
+		FamilyID:  family,
+		ExpiresAt: time.Now().Add(token.RefreshExpiration),
+	})
+	if err != nil {
+		return LoginUserResponse{}, err
+	}
+
+	return resp, nil
+}
+
+func (svc UserService) Put(ctx cloud.Context, req PutUserRequest) (_ interface{}, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionPutUser, cloud.AuditTargetUser, req.ID)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	if e := forbidAPIKey(ctx); e != nil {
+		return nil, e
+	}
 	// Only users allowed to access this data should request it.
 	// Well, we did check in the handler that there was a token, but now we will validate that the user profile is valid.
 	accessError := svc.ValidateUserAuth(ctx)
@@ -304,6 +766,16 @@ func (svc UserService) Put(ctx cloud.Context, req PutUserRequest) (interface{},
 		}) //fmt.Errorf("id is required")
 	}
 
+	if e := svc.authorizeOther(ctx, req.ID); e != nil {
+		return nil, e
+	}
+	if req.NewPassword != "" || req.MagicLink != nil {
+		if e := forbidImpersonated(ctx); e != nil {
+			return nil, e
+		}
+	}
+	requester := ctx.UserKey
+
 	// First thing we will do is pull up the user profile. Then we will figure out what the user wants to change and then commit those things to the db.
 	var u *cloud.User
 	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
@@ -319,36 +791,23 @@ func (svc UserService) Put(ctx cloud.Context, req PutUserRequest) (interface{},
 		}) //fmt.Errorf("service/UserService.Put.FindByID.RunInTransaction failed: %w", err)
 	}
 	ctx.UserKey = u.ID
+	before := *u
 
-	// Lets check the email first.
-	if req.Email != "" {
-		req.Email = strings.ToLower(req.Email)
-		// if the profile email and request email dont match, they want to change it.
-		// but we are going to check and make sure it is not already in use on the platform. We do not want duplicates.
-		if u.Email != req.Email {
-			var existing *cloud.User
-			err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
-				var dbErr error
-				existing, dbErr = db.FindByEmail(ctx, tx, req.Email)
-				return dbErr
-			})
-			// Strange quirk here. If the find succeeds, ie err == nil, that means it is in use in the db.
-			// So we will need to compare the id returned to the id submitted. If they are the same, its the same profile.
-			// If they are different, it means the user wants to change the email to an email that is already in use in the system. We will not allow this.
-			if err == nil {
-				if req.ID != existing.ID {
-					return nil, cloud.NewError(cloud.ErrOpts{
-						Kind:    cloud.ErrKindBadRequest,
-						Message: "email already in use on this platform, choose a different email",
-						Cause:   err,
-					}) //fmt.Errorf("email already in use on this platform, choose a different email")
-				}
-				// If there is an error, ie err != nil, that is fine, the user can change the email to that value.
-			}
-			u.Email = req.Email
+	// Email changes are held until the new address is confirmed through
+	// ConfirmValidation. They are requested first, so that an address already
+	// in use stops the whole update.
+	req.Email = strings.ToLower(req.Email)
+	if req.Email != "" && req.Email != u.Email {
+		if e := forbidImpersonated(ctx); e != nil {
+			return nil, e
+		}
+		if e := svc.requestEmailChange(ctx, u, req.Email); e != nil {
+			return nil, e
 		}
 	}
 
+	var passwordChanged bool
+	var oldHash string
 	// Password is a property that we will commonly want to change, but is optional for this procedure - the user could change other properties and not PW.
 	// But, in cases where this call is to change the PW we want to check the old pw hash first, to make sure the user requesting this can change it.
 	// Then, if that succeeds, we will need to take a hash of the value and save that to the db.
@@ -361,23 +820,31 @@ func (svc UserService) Put(ctx cloud.Context, req PutUserRequest) (interface{},
 			}) //fmt.Errorf("old password is required to change password")
 		}
 
-		if err = bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(req.OldPassword)); err != nil {
-			if err != bcrypt.ErrMismatchedHashAndPassword {
-				svc.L.Info(ctx.Ctx, "Failed to verify password", log.Fields{"email": req.Email, "err": err})
-				return nil, cloud.NewError(cloud.ErrOpts{
-					Kind:    cloud.ErrKindInternal,
-					Message: "failed to verify old password - try again",
-					Cause:   err,
-				}) //fmt.Errorf("failed to verify old password - try again")
-			}
+		ok, _, err := passhash.Verify(u.PasswordHash, req.OldPassword)
+		if err != nil {
+			svc.L.Info(ctx.Ctx, "Failed to verify password", log.Fields{"email": req.Email, "err": err})
+			return nil, cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindInternal,
+				Message: "failed to verify old password - try again",
+				Cause:   err,
+			}) //fmt.Errorf("failed to verify old password - try again")
+		}
+		if !ok {
 			return nil, cloud.NewError(cloud.ErrOpts{
 				Kind:    cloud.ErrKindBadRequest,
 				Message: "old password was not correct - try again",
-				Cause:   err,
 			}) //fmt.Errorf("old password was not correct - try again")
 		}
 
-		hash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+		fe, e := svc.checkNewPassword(ctx, u, req.NewPassword)
+		if e != nil {
+			return nil, e
+		}
+		if fe != nil {
+			return nil, policyError(fe)
+		}
+
+		hash, err := passhash.Hash(req.NewPassword)
 		if err != nil {
 			return nil, cloud.NewError(cloud.ErrOpts{
 				Kind:    cloud.ErrKindInternal,
@@ -385,8 +852,10 @@ func (svc UserService) Put(ctx cloud.Context, req PutUserRequest) (interface{},
 				Cause:   err,
 			}) //fmt.Errorf("there was an error hashing password: %w", err)
 		}
-		u.PasswordHash = string(hash)
+		oldHash = u.PasswordHash
+		u.PasswordHash = hash
 		u.MustChange = false
+		passwordChanged = true
 	}
 
 	// The name properties are trivial. We will let the user do whatever they want with them. If they are populated, we will save those values.
@@ -396,9 +865,35 @@ func (svc UserService) Put(ctx cloud.Context, req PutUserRequest) (interface{},
 	if req.LastName != "" {
 		u.LastName = req.LastName
 	}
+	if req.MagicLink != nil {
+		u.MagicLinkEnabled = *req.MagicLink
+	}
 
+	// A password change signs the user out everywhere. When users change their own password, we hand back fresh
+	// tokens so that the session they made the change from carries on.
+	var resp interface{}
 	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
-		return db.UpdateUserRecord(ctx, tx, u)
+		if err := db.UpdateUserRecord(ctx, tx, u); err != nil {
+			return err
+		}
+		if !passwordChanged {
+			return nil
+		}
+		if n := svc.Password.Remembered(); n > 0 {
+			if err := db.AddPasswordHistory(ctx, tx, u.ID, oldHash, n); err != nil {
+				return err
+			}
+		}
+		if err := db.RevokeAllTokens(ctx, tx, u.ID); err != nil {
+			return err
+		}
+		if u.ID != requester {
+			return nil
+		}
+		u.TokenGeneration++
+		tokens, err := svc.issueTokens(ctx, tx, u, "")
+		resp = tokens
+		return err
 	})
 	if err != nil {
 		return nil, cloud.NewError(cloud.ErrOpts{
@@ -409,16 +904,15 @@ func (svc UserService) Put(ctx cloud.Context, req PutUserRequest) (interface{},
 	}
 
 	svc.L.Info(ctx.Ctx, "Updated user", log.Fields{"id": req.ID, "email": req.Email})
-	//  TODO: s.auditor.Log(ctx,
-	// 	"Update User Succeeded",
-	// 	u.Email,
-	// 	"user",
-	// 	"update")
+	entry.Diff(&before, u)
+	if passwordChanged {
+		auditPasswordChange(entry)
+	}
 
-	return nil, nil
+	return resp, nil
 }
 
-func (svc UserService) RequestPasswordReset(ctx cloud.Context, req UserRequest) (interface{}, *cloud.Error) {
+func (svc UserService) RequestPasswordReset(ctx cloud.Context, req UserRequest) (_ interface{}, e *cloud.Error) {
 	if req.Email == "" {
 		return nil, cloud.NewError(cloud.ErrOpts{
 			Kind:    cloud.ErrKindBadRequest,
@@ -441,44 +935,52 @@ func (svc UserService) RequestPasswordReset(ctx cloud.Context, req UserRequest)
 			Cause:   err,
 		}) //fmt.Errorf("service/UserService.RequestPwdReset.RunInTransaction failed: %w", err)
 	}
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionRequestPasswordReset, cloud.AuditTargetUser, u.ID)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
 
-	token, _ := random.String(cloud.DefaultTokenLength)
-	u.ResetToken = token
-	u.ResetTokenExpiration = string(time.Now().Add(24 * time.Hour).Format("1/2/2006 15:04"))
+	// Only the hash of the token is stored, so a leaked database can't be used to reset passwords.
+	tok, hash, err := token.NewReset()
+	if err != nil {
+		return ResetFailed, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "failed to generate reset token",
+			Cause:   err,
+		})
+	}
 
 	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
-		return db.UpdateUserRecord(ctx, tx, u)
+		return db.CreatePasswordReset(ctx, tx, u.ID, hash, time.Now().Add(token.ResetExpiration))
 	})
 
 	if err != nil {
 		return ResetFailed, cloud.NewError(cloud.ErrOpts{
 			Kind:    cloud.ErrKindInternal,
-			Message: "user service update user db transaction failed",
+			Message: "user service create password reset db transaction failed",
 			Cause:   err,
 		}) //fmt.Errorf("service/UserService.ResetPassword.RunInTransaction failed: %w", err)
 	}
 
 	svc.L.Info(ctx.Ctx, "User requested a password reset, token set", log.Fields{"email": u.Email})
 
-	// s.auditor.Log(ctx,
-	// 	"Password Reset Requested",
-	// 	"password reset initiated",
-	// 	"user",
-	// 	"reset_password",
-	// )
-
-	svc.Em.ResetPasswordAsync(ctx, svc.Name(u), u.Email, u.ResetToken)
+	svc.Em.ResetPasswordAsync(ctx, svc.Name(u), u.Email, tok)
 
 	return nil, nil
 }
 
-func (svc UserService) ResetPassword(ctx cloud.Context, req ResetPasswordRequest) (interface{}, *cloud.Error) {
+// ResetPassword serves the page a password reset link leads to. Following the
+// link shows a form for the new password, and posting the form sets it. The
+// link can only be used once, and only until it expires.
+func (svc UserService) ResetPassword(ctx cloud.Context, req ResetPasswordRequest) (_ interface{}, e *cloud.Error) {
 	// we have already checked that the confirmation token is present.
+	hash := token.Hash(ctx.ConfirmationToken)
 
 	var u *cloud.User
 	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
-		var dbErr error
-		u, dbErr = db.FindByToken(ctx, tx, ctx.ConfirmationToken)
+		uid, dbErr := db.FindPasswordReset(ctx, tx, hash)
+		if dbErr != nil || uid == "" {
+			return dbErr
+		}
+		u, dbErr = db.FindByID(ctx, tx, uid)
 		return dbErr
 	})
 	if err != nil {
@@ -486,36 +988,64 @@ func (svc UserService) ResetPassword(ctx cloud.Context, req ResetPasswordRequest
 			Kind:    cloud.ErrKindInternal,
 			Message: "user service find reset token db transaction failed",
 			Cause:   err,
-		}) //fmt.Errorf("service/UserService.ResetPassword.FindByToken.RunInTransaction failed: %w", err)
+		}) //fmt.Errorf("service/UserService.ResetPassword.FindPasswordReset.RunInTransaction failed: %w", err)
 	}
-
-	if u.Email == "" {
-		return ResetFailed, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindBadRequest,
-			Message: "reset token invalid, user not found",
-		})
+	if u == nil {
+		return ResetFailed, errResetLinkInvalid()
 	}
 
-	// ok. the confirmation token was valid and we have a userid, we will now generate a password, email it to the user
-	// and then we will save the hash of that password to the database for the user to login with.
 	ctx.UserKey = u.ID
 
-	password, hash, err := password.Generate()
+	if !req.Submitted {
+		return renderResetForm(ctx.ConfirmationToken, nil)
+	}
+	if req.Password != req.Confirm {
+		return renderResetForm(ctx.ConfirmationToken, []string{"Passwords do not match"})
+	}
+	fe, e := svc.checkNewPassword(ctx, u, req.Password)
+	if e != nil {
+		return ResetFailed, e
+	}
+	if fe != nil {
+		return renderResetForm(ctx.ConfirmationToken, fe.Errors)
+	}
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionResetPassword, cloud.AuditTargetUser, u.ID)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	newHash, err := passhash.Hash(req.Password)
 	if err != nil {
 		return ResetFailed, cloud.NewError(cloud.ErrOpts{
 			Kind:    cloud.ErrKindInternal,
-			Message: "failed to generate temp password",
-			//Cause:   err,
-		}) //err
+			Message: "there was an error hashing the new password",
+			Cause:   err,
+		})
 	}
+	oldHash := u.PasswordHash
+	u.PasswordHash = newHash
+	u.MustChange = false
 
-	u.MustChange = true
-	u.PasswordHash = hash
-	u.ResetToken = ""
-	u.ResetTokenExpiration = ""
-
+	// The token is used up in the same transaction that sets the password, so
+	// that a link posted twice at once only takes effect once.
+	var used bool
 	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
-		return db.UpdateUserRecord(ctx, tx, u)
+		uid, err := db.UsePasswordReset(ctx, tx, hash)
+		if err != nil || uid != u.ID {
+			return err
+		}
+		used = true
+
+		if err := db.UpdateUserRecord(ctx, tx, u); err != nil {
+			return err
+		}
+		if n := svc.Password.Remembered(); n > 0 {
+			if err := db.AddPasswordHistory(ctx, tx, u.ID, oldHash, n); err != nil {
+				return err
+			}
+		}
+		if err := db.ResetFailedLogins(ctx, tx, u.ID); err != nil {
+			return err
+		}
+		return db.RevokeAllTokens(ctx, tx, u.ID)
 	})
 
 	if err != nil {
@@ -525,14 +1055,41 @@ func (svc UserService) ResetPassword(ctx cloud.Context, req ResetPasswordRequest
 			Cause:   err,
 		}) //fmt.Errorf("service/UserService.ResetPassword.UpdateUserRecord.RunInTransaction failed: %w", err)
 	}
+	if !used {
+		return ResetFailed, errResetLinkInvalid()
+	}
 
 	svc.L.Info(ctx.Ctx, "Reset password for user", log.Fields{"email": u.Email})
-
-	svc.Em.NewPasswordAsync(ctx, svc.Name(u), u.Email, password)
+	auditPasswordChange(entry)
 
 	return resetSucceeded, nil
 }
 
+func errResetLinkInvalid() *cloud.Error {
+	return cloud.NewError(cloud.ErrOpts{
+		Kind:    cloud.ErrKindBadRequest,
+		Message: "reset link is invalid, has already been used or has expired",
+	})
+}
+
+// renderResetForm renders the form for choosing a new password, along with
+// any problems with the last attempt.
+func renderResetForm(tok string, problems []string) (interface{}, *cloud.Error) {
+	var b bytes.Buffer
+	err := resetForm.Execute(&b, struct {
+		Token    string
+		Problems []string
+	}{tok, problems})
+	if err != nil {
+		return ResetFailed, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "failed to render password reset form",
+			Cause:   err,
+		})
+	}
+	return b.String(), nil
+}
+
 func (svc UserService) ListUsers(ctx cloud.Context, req ListUsersRequest) (interface{}, *cloud.Error) {
 	// Only users allowed to access this data should request it.
 	// Well, we did check in the handler that there was a token, but now we will validate that the user profile is valid.
@@ -545,12 +1102,52 @@ func (svc UserService) ListUsers(ctx cloud.Context, req ListUsersRequest) (inter
 		}) //fmt.Errorf("user profile not validated: %w", accessError)
 	}
 
-	var resp ListUsersResponse
+	if req.Status != "" && !req.Status.Valid() {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "status must be one of invited, active, disabled, locked or deleted",
+		})
+	}
+
+	f := db.UserFilter{
+		Search:       strings.TrimSpace(req.Search),
+		Status:       req.Status,
+		ActiveAfter:  req.ActiveAfter,
+		ActiveBefore: req.ActiveBefore,
+		Sort:         strings.TrimPrefix(req.Sort, "-"),
+		Desc:         strings.HasPrefix(req.Sort, "-"),
+		Limit:        pageLimit(req.Limit),
+	}
+	if f.Sort == "" {
+		f.Sort = "name"
+	}
+	if !db.IsUserSort(f.Sort) {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "sort must be one of name, email or lastActivity",
+		})
+	}
 	var err error
+	if f.After, err = decodeCursor(req.Cursor, req.Sort); err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "cursor is invalid, or was made for another sort",
+			Cause:   err,
+		})
+	}
+
+	resp := ListUsersResponse{Paging: cloud.Paging{Limit: f.Limit}}
 	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
-		resp.Users, err = db.GetUserList(ctx, tx, req.ListType)
+		var next *db.Position
+		resp.Users, next, err = db.GetUserList(ctx, tx, f)
+		if err != nil {
+			return fmt.Errorf("service/db.GetUserList failed: %w", err)
+		}
+		resp.Paging.NextCursor = encodeCursor(req.Sort, next)
+
+		resp.Paging.Total, err = db.CountUsers(ctx, tx, f)
 		if err != nil {
-			return fmt.Errorf("service/db.GetGridBatchList failed: %w", err)
+			return fmt.Errorf("service/db.CountUsers failed: %w", err)
 		}
 		return nil
 	})
@@ -565,7 +1162,75 @@ func (svc UserService) ListUsers(ctx cloud.Context, req ListUsersRequest) (inter
 	return resp, nil
 }
 
+func (svc UserService) SetUserRole(ctx cloud.Context, req SetUserRoleRequest) (_ interface{}, e *cloud.Error) {
+	entry := cloud.NewAuditEntry(ctx, cloud.ActionSetUserRole, cloud.AuditTargetUser, req.ID)
+	defer func() { audit(svc.Au, ctx, entry.Result(e)) }()
+
+	if req.ID == "" {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "id is required",
+		})
+	}
+	if !req.Role.Valid() {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "role must be one of admin, operator or viewer",
+		})
+	}
+	// An admin demoting themselves could leave nobody able to manage users.
+	if req.ID == ctx.UserKey {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "you cannot change your own role",
+		})
+	}
+
+	var before cloud.Role
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		u, err := db.FindByID(ctx, tx, req.ID)
+		if err != nil {
+			return err
+		}
+		before = u.Role
+		return db.UpdateUserRole(ctx, tx, req.ID, req.Role)
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service update user role db transaction failed",
+			Cause:   err,
+		})
+	}
+
+	svc.L.Info(ctx.Ctx, "Updated user role", log.Fields{"id": req.ID, "role": req.Role, "by": ctx.UserKey})
+	entry.Diff(map[string]cloud.Role{"role": before}, map[string]cloud.Role{"role": req.Role})
+
+	return nil, nil
+}
+
+// authorizeOther checks that the requesting user may manage other users when
+// the target user is not the requesting user themselves.
+func (svc UserService) authorizeOther(ctx cloud.Context, id string) *cloud.Error {
+	if id == ctx.UserKey {
+		return nil
+	}
+	if err := svc.Az.Authorize(ctx, cloud.ActionManageUsers); err != nil {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindForbidden,
+			Message: "user not allowed to perform this action",
+			Cause:   err,
+		})
+	}
+	return nil
+}
+
 func (svc UserService) ValidateUserAuth(ctx cloud.Context) error {
+	// API keys are not tied to a user, and were checked when authenticated.
+	if ctx.APIKeyID != "" {
+		return nil
+	}
+
 	var u *cloud.User
 	var err error
 	err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
@@ -601,65 +1266,6 @@ func (svc UserService) ValidateUserAuth(ctx cloud.Context) error {
 // 	return resp, nil
 // }
 
-func (svc UserService) ValidateEmail(ctx cloud.Context, req UserRequest) (interface{}, error) {
-	req.Email = strings.ToLower(req.Email)
-	code := random.GenerateCode(6)
-
-	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
-		dbErr := db.SaveValidationCode(ctx, tx, req.Email, code)
-		return dbErr
-	})
-	if err != nil {
-		return nil, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindInternal,
-			Message: "user service save validation code transaction failed",
-			Cause:   err,
-		}) //fmt.Errorf("service/UserService.SaveValidation.RunInTransaction failed: %w", err)
-	}
-
-	svc.Em.ValidateEmailAsync(ctx, req.Email, code)
-
-	return nil, nil
-}
-
-func (svc UserService) ConfirmValidation(ctx cloud.Context, req ConfirmValidationRequest) (interface{}, error) {
-	var gotCode string
-	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
-		var dbErr error
-		gotCode, dbErr = db.GetValidationCode(ctx, tx, req.Email)
-		return dbErr
-	})
-	if err != nil {
-		if err.Error() == "no validation code for email" {
-			return nil, cloud.NewError(cloud.ErrOpts{
-				Kind:    cloud.ErrKindBadRequest,
-				Message: "no validation code for email",
-				Cause:   err,
-			}) //fmt.Errorf("no validation code for email: %s", req.Email)
-		}
-		return nil, cloud.NewError(cloud.ErrOpts{
-			Kind:    cloud.ErrKindInternal,
-			Message: "user service get validation code db transaction failed",
-			Cause:   err,
-		}) //fmt.Errorf("service/UserService.GetValidation.RunInTransaction failed: %w", err)
-	}
-
-	if req.Code == gotCode {
-		err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
-			dbErr := db.DeleteValidationCode(ctx, tx, req.Email)
-			return dbErr
-		})
-		if err != nil {
-			// we are not  going to throw off the whole process by returning an error here. log it, see if it happens much.
-			svc.L.Error(ctx.Ctx, err, "validation code not deleted", log.Fields{"code: ": req.Code, "email: ": req.Email})
-		}
-
-		return nil, nil
-	}
-
-	return nil, fmt.Errorf("code mismatch")
-}
-
 func (svc UserService) UpdateLastActivity(ctx cloud.Context, req GetUserRequest) error {
 	if req.ID == "" {
 		return cloud.NewError(cloud.ErrOpts{
@@ -685,17 +1291,7 @@ func (svc UserService) Name(u *cloud.User) string {
 }
 
 func NewUser(email, fn, ln string) (*cloud.User, error) {
-	var fieldErrors []*FieldError
-	if email == "" {
-		fieldErrors = append(fieldErrors, NewFieldError("Email", "Required"))
-	}
-	if fn == "" {
-		fieldErrors = append(fieldErrors, NewFieldError("First Name", "Required)"))
-	}
-	if ln == "" {
-		fieldErrors = append(fieldErrors, NewFieldError("Last Name", "Required)"))
-	}
-	if len(fieldErrors) > 0 {
+	if fieldErrors := newUserErrors(email, fn, ln); len(fieldErrors) > 0 {
 		return nil, fmt.Errorf("%s", fieldErrors)
 	}
 
@@ -703,9 +1299,29 @@ func NewUser(email, fn, ln string) (*cloud.User, error) {
 		Email:     strings.ToLower(email),
 		FirstName: fn,
 		LastName:  ln,
+		Role:      cloud.DefaultRole,
 	}, nil
 }
 
+// newUserErrors returns the problems NewUser finds with the fields of a new
+// user, one FieldError per field.
+func newUserErrors(email, fn, ln string) []*FieldError {
+	var fieldErrors []*FieldError
+	switch {
+	case email == "":
+		fieldErrors = append(fieldErrors, NewFieldError("Email", "Required"))
+	case !validEmail(strings.ToLower(email)):
+		fieldErrors = append(fieldErrors, NewFieldError("Email", "Must be a valid address"))
+	}
+	if fn == "" {
+		fieldErrors = append(fieldErrors, NewFieldError("First Name", "Required"))
+	}
+	if ln == "" {
+		fieldErrors = append(fieldErrors, NewFieldError("Last Name", "Required"))
+	}
+	return fieldErrors
+}
+
 func NewFieldError(name string, errors ...string) *FieldError {
 	if len(errors) < 1 {
 		return nil
@@ -730,8 +1346,8 @@ func NewFieldError(name string, errors ...string) *FieldError {
 //
 //   Name: Required, Length must be greater than 10
 type FieldError struct {
-	Name   string
-	Errors []string
+	Name   string   `json:"name"`
+	Errors []string `json:"errors"`
 }
 
 func (e *FieldError) Error() string {
@@ -741,20 +1357,6 @@ func (e *FieldError) Error() string {
 	return fmt.Sprintf("%s: %s", e.Name, strings.Join(e.Errors, ", "))
 }
 
-func SetTempPassword(u *cloud.User) (string, error) {
-	password, hash, err := password.Generate()
-	if err != nil {
-		return "", err
-	}
-
-	u.MustChange = true
-	u.PasswordHash = hash
-	u.ResetToken = ""
-	u.ResetTokenExpiration = ""
-
-	return password, nil
-}
-
 // HTML Templates
 
 var ResetFailed = `
@@ -914,9 +1516,108 @@ var resetSucceeded = `
             </nav>
             <div class="content">
                 <p>Password reset was successful.</p>
-                <p>Please check your email for a temporary password to access your account.</p>
+                <p>You can now log in with your new password.</p>
             </div>
         </main>
     </body>
 </html>
 `
+
+var resetForm = template.Must(template.New("resetForm").Parse(`
+<!doctype html>
+
+<html>
+    <head>
+        <title>
+            Reset Password
+        </title>
+        <style>
+            * {
+                margin: 0;
+                padding: 0;
+            }
+
+            html {
+                height: 100%;
+            }
+            
+            body {
+                height: 100%;
+            }
+
+            main {
+                display: flex;
+                flex-direction: column;
+                height: 100%;
+            }
+
+            nav {
+                background: #000;
+                height: 50px;
+                padding: 10px;
+                display: flex;
+                align-items: center;
+                border-top: 5px solid #ffd600;
+            }
+
+            .logo {
+                height: 50px;
+            }
+
+            h1 {
+                color: #ffd600;
+            }
+
+            .content {
+                background: #fff;
+                flex: 1;
+                flex-direction: column;
+                height: 100%;
+                display: flex;
+                justify-content: center;
+                align-items: center;
+            }
+
+            p, label, input, button {
+                font-family: 'Lato', sans-serif;
+                color: #333;
+                padding: 10px;
+                font-size: 20px;
+            }
+
+            form {
+                display: flex;
+                flex-direction: column;
+                width: 360px;
+            }
+
+            .problem {
+                color: #c00;
+            }
+        </style>
+        <link href="https://fonts.googleapis.com/css?family=Lato:400" rel="stylesheet" type="text/css">
+    </head>
+    <body>
+        <main>
+            <nav>
+                <a href="https://npandl.com">
+                    <img class="logo" src="data:image/png;base64," />
+                </a>
+            </nav>
+            <div class="content">
+                <p>Choose a new password for your account.</p>
+                {{range .Problems}}<p class="problem">{{.}}</p>
+                {{end}}
+                <form method="post" action="/users/resetpassword">
+                    <input type="hidden" name="conf" value="{{.Token}}" />
+                    <label for="password">New password</label>
+                    <input type="password" id="password" name="password" autocomplete="new-password" required />
+                    <label for="confirm">Confirm new password</label>
+                    <input type="password" id="confirm" name="confirm" autocomplete="new-password" required />
+                    <button type="submit">Reset password</button>
+                </form>
+            </div>
+        </main>
+    </body>
+</html>
+`))
@@ -0,0 +1,346 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/db"
+	"github.com/kmhebb/serverExample/log"
+	"github.com/kmhebb/serverExample/pg"
+	"github.com/pborman/uuid"
+)
+
+// MaxImportUsers is the most users a single import can create.
+const MaxImportUsers = 1000
+
+// MaxImportSize is the largest import file accepted, in bytes. It leaves room
+// for MaxImportUsers rows with a generous number of columns.
+const MaxImportSize = 4 << 20
+
+// Import modes. ImportAll creates every user in one transaction, or none of
+// them if any row has a problem. ImportSkip creates the rows it can and skips
+// the rest.
+const (
+	ImportAll  = "all"
+	ImportSkip = "skip"
+)
+
+// The outcomes of an imported row.
+const (
+	RowCreated   = "created"
+	RowDuplicate = "duplicate"
+	RowInvalid   = "invalid"
+	RowFailed    = "failed"
+	RowSkipped   = "skipped"
+)
+
+// importColumns maps the headers accepted in an import, in lower case, to the
+// field they hold.
+var importColumns = map[string]string{
+	"email":      "email",
+	"first":      "first",
+	"firstname":  "first",
+	"first name": "first",
+	"first_name": "first",
+	"last":       "last",
+	"lastname":   "last",
+	"last name":  "last",
+	"last_name":  "last",
+	"role":       "role",
+}
+
+// exportHeader is the header of an export. Its first columns are the ones an
+// import reads, so that an export can be imported elsewhere.
+var exportHeader = []string{"email", "first", "last", "role", "status", "created", "lastActivity"}
+
+// ImportUsersRequest holds an uploaded CSV, starting with its header. The
+// email, first and last columns are required, and users are given the default
+// role if there is no role column.
+type ImportUsersRequest struct {
+	Records [][]string
+	Mode    string
+}
+
+// ImportUserResult is the outcome of a single row. Row is its line in the
+// file, counting the header as line 1.
+type ImportUserResult struct {
+	Row     int           `json:"row"`
+	Email   string        `json:"email"`
+	Outcome string        `json:"outcome"`
+	UserID  string        `json:"userId,omitempty"`
+	Errors  []*FieldError `json:"errors,omitempty"`
+
+	// Invited is set once the user's invite has been sent. A failed invite
+	// does not undo the user, and can be sent again through ResendInvite.
+	Invited     bool   `json:"invited"`
+	InviteError string `json:"inviteError,omitempty"`
+}
+
+type ImportUsersResponse struct {
+	Created int                 `json:"created"`
+	Skipped int                 `json:"skipped"`
+	Rows    []*ImportUserResult `json:"rows"`
+}
+
+type ExportUsersRequest struct {
+	// Search and Status select the users as they do for ListUsers.
+	Search string           `json:"search"`
+	Status cloud.UserStatus `json:"status"`
+}
+
+// ImportUsers creates invited users from the rows of a CSV, and sends each of
+// them an invite. Every row is checked before any user is created, and the
+// outcome of each row is reported. Emails that already belong to a user, or
+// appear earlier in the file, are duplicates.
+func (svc UserService) ImportUsers(ctx cloud.Context, req ImportUsersRequest) (*ImportUsersResponse, *cloud.Error) {
+	if req.Mode == "" {
+		req.Mode = ImportAll
+	}
+	if req.Mode != ImportAll && req.Mode != ImportSkip {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "mode must be all or skip",
+		})
+	}
+	if len(req.Records) < 2 {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "import csv did not contain data",
+		})
+	}
+	if len(req.Records)-1 > MaxImportUsers {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: fmt.Sprintf("an import can create at most %d users", MaxImportUsers),
+		})
+	}
+	cols, e := importHeader(req.Records[0])
+	if e != nil {
+		return nil, e
+	}
+
+	var resp ImportUsersResponse
+	var users []*cloud.User
+	var emails []string
+	seen := make(map[string]bool)
+	for i, rec := range req.Records[1:] {
+		field := func(name string) string {
+			if j, ok := cols[name]; ok && j < len(rec) {
+				return strings.TrimSpace(rec[j])
+			}
+			return ""
+		}
+		u, fes := importUser(field("email"), field("first"), field("last"), cloud.Role(strings.ToLower(field("role"))))
+		res := &ImportUserResult{Row: i + 2, Email: strings.ToLower(field("email")), Errors: fes}
+		switch {
+		case len(fes) > 0:
+			res.Outcome = RowInvalid
+		case seen[u.Email]:
+			res.Outcome = RowDuplicate
+		default:
+			seen[u.Email] = true
+			emails = append(emails, u.Email)
+		}
+		resp.Rows = append(resp.Rows, res)
+		users = append(users, u)
+	}
+
+	var existing map[string]bool
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		var dbErr error
+		existing, dbErr = db.FindExistingEmails(ctx, tx, emails)
+		return dbErr
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service find existing emails db transaction failed",
+			Cause:   err,
+		})
+	}
+	var problems int
+	for _, res := range resp.Rows {
+		if res.Outcome == "" && existing[res.Email] {
+			res.Outcome = RowDuplicate
+		}
+		if res.Outcome != "" {
+			problems++
+		}
+	}
+
+	if req.Mode == ImportAll {
+		if problems > 0 {
+			for _, res := range resp.Rows {
+				if res.Outcome == "" {
+					res.Outcome = RowSkipped
+				}
+			}
+			return nil, cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindInvalid,
+				Message: fmt.Sprintf("no users were imported, %d rows are invalid or duplicates", problems),
+				Details: resp.Rows,
+			})
+		}
+		err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+			for _, u := range users {
+				if err := db.CreateUser(ctx, tx, u); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindInternal,
+				Message: "user service import users db transaction failed",
+				Cause:   err,
+			})
+		}
+		for _, res := range resp.Rows {
+			res.Outcome = RowCreated
+		}
+	} else {
+		for i, res := range resp.Rows {
+			if res.Outcome != "" {
+				continue
+			}
+			err = svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+				return db.CreateUser(ctx, tx, users[i])
+			})
+			if err != nil {
+				svc.L.Info(ctx.Ctx, "Failed to import user", log.Fields{"email": res.Email, "row": res.Row, "err": err})
+				res.Outcome = RowFailed
+				continue
+			}
+			res.Outcome = RowCreated
+		}
+	}
+
+	for i, res := range resp.Rows {
+		if res.Outcome != RowCreated {
+			resp.Skipped++
+			continue
+		}
+		resp.Created++
+		u := users[i]
+		res.UserID = u.ID
+		audit(svc.Au, ctx, cloud.NewAuditEntry(ctx, cloud.ActionImportUsers, cloud.AuditTargetUser, u.ID).Diff(nil, u))
+		if e := svc.invite(ctx, u); e != nil {
+			res.InviteError = e.Message()
+			continue
+		}
+		res.Invited = true
+	}
+
+	svc.L.Info(ctx.Ctx, "Imported users", log.Fields{"created": resp.Created, "skipped": resp.Skipped, "mode": req.Mode, "by": ctx.UserKey})
+	return &resp, nil
+}
+
+// importHeader returns the index of each column in the header of an import.
+// Unknown columns are ignored.
+func importHeader(header []string) (map[string]int, *cloud.Error) {
+	cols := make(map[string]int)
+	for i, h := range header {
+		// Spreadsheets often save a byte order mark at the start of the file.
+		h = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))
+		if name, ok := importColumns[h]; ok {
+			if _, dup := cols[name]; dup {
+				return nil, cloud.NewError(cloud.ErrOpts{
+					Kind:    cloud.ErrKindBadRequest,
+					Message: fmt.Sprintf("import csv has more than one %s column", name),
+				})
+			}
+			cols[name] = i
+		}
+	}
+	var missing []string
+	for _, name := range []string{"email", "first", "last"} {
+		if _, ok := cols[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "import csv is missing the columns " + strings.Join(missing, ", "),
+		})
+	}
+	return cols, nil
+}
+
+// importUser returns the invited user a row describes, or the problems with
+// its fields.
+func importUser(email, fn, ln string, role cloud.Role) (*cloud.User, []*FieldError) {
+	fes := newUserErrors(email, fn, ln)
+	if role == "" {
+		role = cloud.DefaultRole
+	}
+	if !role.Valid() {
+		fes = append(fes, NewFieldError("Role", "Must be one of admin, operator or viewer"))
+	}
+	if len(fes) > 0 {
+		return nil, fes
+	}
+
+	u, err := NewUser(email, fn, ln)
+	if err != nil {
+		return nil, []*FieldError{NewFieldError("Email", err.Error())}
+	}
+	// There is no password to log in with until the user accepts their
+	// invite.
+	u.ID = uuid.New()
+	u.MustChange = true
+	u.Role = role
+	u.Status = cloud.StatusInvited
+	return u, nil
+}
+
+// ExportUsers returns the users as the records of a CSV, starting with its
+// header. Deleted users are only exported when asked for.
+func (svc UserService) ExportUsers(ctx cloud.Context, req ExportUsersRequest) ([][]string, *cloud.Error) {
+	if req.Status != "" && !req.Status.Valid() {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "status must be one of invited, active, disabled, locked or deleted",
+		})
+	}
+
+	records := [][]string{exportHeader}
+	f := db.UserFilter{
+		Search: strings.TrimSpace(req.Search),
+		Status: req.Status,
+		Sort:   "email",
+		Limit:  cloud.MaxPageLimit,
+	}
+	err := svc.DB.RunInTransaction(ctx, func(ctx cloud.Context, tx pg.Tx) error {
+		for {
+			users, next, err := db.GetUserList(ctx, tx, f)
+			if err != nil {
+				return fmt.Errorf("service/db.GetUserList failed: %w", err)
+			}
+			for _, u := range users {
+				var active string
+				if u.LastActivity != nil {
+					active = u.LastActivity.UTC().Format(time.RFC3339)
+				}
+				records = append(records, []string{u.Email, u.FirstName, u.LastName, string(u.Role), string(u.Status), u.DateCreated.UTC().Format(time.RFC3339), active})
+			}
+			if next == nil {
+				return nil
+			}
+			f.After = next
+		}
+	})
+	if err != nil {
+		return nil, cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindInternal,
+			Message: "user service export users db transaction failed",
+			Cause:   err,
+		})
+	}
+
+	svc.L.Info(ctx.Ctx, "Exported users", log.Fields{"users": len(records) - 1, "by": ctx.UserKey})
+	return records, nil
+}
@@ -0,0 +1,29 @@
+package service_test
+
+import (
+	"testing"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/assert"
+	"github.com/kmhebb/serverExample/internal/service"
+)
+
+func TestImportUsersRejectsFile(t *testing.T) {
+	assert := assert.New(t)
+	row := []string{"ann@example.com", "Ann", "Lee"}
+
+	for _, tc := range []struct {
+		req  service.ImportUsersRequest
+		want string
+	}{
+		{service.ImportUsersRequest{Records: [][]string{{"email", "first", "last"}, row}, Mode: "some"}, "mode must be all or skip"},
+		{service.ImportUsersRequest{Records: [][]string{{"email", "first", "last"}}}, "import csv did not contain data"},
+		{service.ImportUsersRequest{Records: [][]string{{"email", "name", "surname"}, row}}, "import csv is missing the columns first, last"},
+		{service.ImportUsersRequest{Records: [][]string{{"Email", "First Name", "firstname"}, row}}, "import csv has more than one first column"},
+	} {
+		_, e := service.UserService{}.ImportUsers(cloud.Context{}, tc.req)
+		assert.True(e != nil)
+		assert.Equals(e.Kind(), cloud.ErrKindBadRequest)
+		assert.Equals(e.Message(), tc.want)
+	}
+}
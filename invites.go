@@ -0,0 +1,24 @@
+package cloud
+
+import "time"
+
+// Invite is an invitation for a new user to choose their password and start
+// using their account. The invite link carries a random token, of which only
+// the hash is stored. An invite is pending until it is accepted, revoked or
+// expires, and resending it replaces it with a new one.
+type Invite struct {
+	ID         string     `json:"id" db:"id"`
+	UserID     string     `json:"userId" db:"user_id"`
+	Email      string     `json:"email" db:"email"`
+	Hash       string     `json:"-" db:"token_hash"`
+	InvitedBy  string     `json:"invitedBy" db:"invited_by"`
+	CreatedAt  time.Time  `json:"createdAt" db:"created_at"`
+	ExpiresAt  time.Time  `json:"expiresAt" db:"expires_at"`
+	AcceptedAt *time.Time `json:"acceptedAt" db:"accepted_at"`
+	RevokedAt  *time.Time `json:"revokedAt" db:"revoked_at"`
+}
+
+// Pending reports whether the invite can still be accepted at the given time.
+func (inv *Invite) Pending(at time.Time) bool {
+	return inv.AcceptedAt == nil && inv.RevokedAt == nil && at.Before(inv.ExpiresAt)
+}
@@ -2,15 +2,20 @@
 package email
 
 import (
+	"time"
+
 	cloud "github.com/kmhebb/serverExample"
 )
 
 type Service interface {
 	//NewCustomerAsync(ctx cloud.Context)
-	NewUserAsync(ctx cloud.Context, name, to, pass string)
+	InviteAsync(ctx cloud.Context, name, to, token string, expires time.Time)
 	ResetPasswordAsync(ctx cloud.Context, name, to, token string)
 	NewPasswordAsync(ctx cloud.Context, name, to, pass string)
 	ValidateEmailAsync(ctx cloud.Context, to, code string)
+	EmailChangeAsync(ctx cloud.Context, name, to, newEmail string)
+	AccountLockedAsync(ctx cloud.Context, name, to string, until time.Time)
+	MagicLinkAsync(ctx cloud.Context, name, to, token string)
 	Close() chan int
 	TestConnection() error
 }
@@ -21,11 +26,14 @@ func NewNoOpService() Service {
 
 type noOpService struct{}
 
-func (s noOpService) NewCustomerAsync(ctx cloud.Context)                                 {}
-func (s noOpService) NewPasswordAsync(ctx cloud.Context, name, email, passphrase string) {}
-func (s noOpService) NewUserAsync(ctx cloud.Context, name, email, passphrase string)     {}
-func (s noOpService) ResetPasswordAsync(ctx cloud.Context, name, email, token string)    {}
-func (s noOpService) ValidateEmailAsync(ctx cloud.Context, to, code string)              {}
+func (s noOpService) NewCustomerAsync(ctx cloud.Context)                                       {}
+func (s noOpService) NewPasswordAsync(ctx cloud.Context, name, email, passphrase string)       {}
+func (s noOpService) InviteAsync(ctx cloud.Context, name, to, token string, expires time.Time) {}
+func (s noOpService) ResetPasswordAsync(ctx cloud.Context, name, email, token string)          {}
+func (s noOpService) ValidateEmailAsync(ctx cloud.Context, to, code string)                    {}
+func (s noOpService) EmailChangeAsync(ctx cloud.Context, name, to, newEmail string)            {}
+func (s noOpService) AccountLockedAsync(ctx cloud.Context, name, to string, until time.Time)   {}
+func (s noOpService) MagicLinkAsync(ctx cloud.Context, name, to, token string)                 {}
 func (s noOpService) TestConnection() error {
 	return nil
 }
@@ -2,6 +2,8 @@ package slack
 
 import (
 	"fmt"
+	"net/url"
+	"time"
 
 	cloud "github.com/kmhebb/serverExample"
 	"github.com/slack-go/slack"
@@ -11,17 +13,51 @@ import (
 
 const ChannelID = "C02H8BU6A9X"
 
-func New(token string, logger log.Logger) *Service {
+// The pages of the app that invite, reset and magic links open, relative to
+// its URL.
+const (
+	InvitePath        = "/invite/accept"
+	ResetPasswordPath = "/password/reset"
+	MagicLinkPath     = "/login/magic"
+)
+
+// New returns a Service that posts to ChannelID. Links that log a user in are
+// sent to the user directly instead, as links to pages of the app at appURL.
+func New(token, appURL string, logger log.Logger) *Service {
 	c := slack.New(token, slack.OptionDebug(true))
 	return &Service{
-		c: c,
-		l: logger,
+		c:      c,
+		appURL: appURL,
+		l:      logger,
 	}
 }
 
 type Service struct {
-	c *slack.Client
-	l log.Logger
+	c      *slack.Client
+	appURL string
+	l      log.Logger
+}
+
+// link returns the link to the page of the app at path, carrying the token.
+func (s Service) link(path, token string) string {
+	return s.appURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// direct sends a message to the Slack user with the email address, and to no
+// one else. Messages that carry a credential are only ever sent this way, as
+// anyone in ChannelID could use them.
+func (s Service) direct(ctx cloud.Context, to, text string, attachment slack.Attachment) error {
+	u, err := s.c.GetUserByEmailContext(ctx.Ctx, to)
+	if err != nil {
+		return fmt.Errorf("slack user lookup failed: %w", err)
+	}
+	_, _, err = s.c.PostMessageContext(
+		ctx.Ctx,
+		u.ID,
+		slack.MsgOptionText(text, false),
+		slack.MsgOptionAttachments(attachment),
+	)
+	return err
 }
 
 func (s Service) TestConnection() error {
@@ -60,7 +96,26 @@ func (s Service) TestConnection() error {
 // 	}
 // }
 
-func (s Service) NewUserAsync(ctx cloud.Context, name, to, pass string) {
+// InviteAsync sends the invitee the link to accept their invite. The channel
+// is only told that they were invited.
+func (s Service) InviteAsync(ctx cloud.Context, name, to, token string, expires time.Time) {
+	invite := slack.Attachment{
+		Fields: []slack.AttachmentField{
+			slack.AttachmentField{
+				Title: "Accept Invite:",
+				Value: s.link(InvitePath, token),
+			},
+			slack.AttachmentField{
+				Title: "Expires:",
+				Value: expires.Format(time.RFC1123),
+			},
+		},
+	}
+	if err := s.direct(ctx, to, "You have been invited", invite); err != nil {
+		s.l.Error(ctx.Ctx, err, "slack message for new user invite failed", nil)
+		return
+	}
+
 	attachment := slack.Attachment{
 		Fields: []slack.AttachmentField{
 			slack.AttachmentField{
@@ -68,43 +123,53 @@ func (s Service) NewUserAsync(ctx cloud.Context, name, to, pass string) {
 				Value: fmt.Sprintf("<%s>%s", to, name),
 			},
 			slack.AttachmentField{
-				Title: "Password:",
-				Value: pass,
+				Title: "Expires:",
+				Value: expires.Format(time.RFC1123),
 			},
 		},
 	}
 	_, _, err := s.c.PostMessageContext(
 		ctx.Ctx,
 		ChannelID,
-		slack.MsgOptionText("New User", false),
+		slack.MsgOptionText("New User Invite", false),
 		slack.MsgOptionAttachments(attachment),
 	)
 	if err != nil {
-		fmt.Errorf("slack message for new user failed: %w", err)
-		//s.l.Log(ctx, log.Error, "Slack message failed", "err", err)
+		s.l.Error(ctx.Ctx, err, "slack message for new user invite failed", nil)
 	}
 }
 
+// ResetPasswordAsync sends the user the link to choose a new password. The
+// channel is only told that a reset was requested.
 func (s Service) ResetPasswordAsync(ctx cloud.Context, name, to, token string) {
+	reset := slack.Attachment{
+		Fields: []slack.AttachmentField{
+			slack.AttachmentField{
+				Title: "Reset Password:",
+				Value: s.link(ResetPasswordPath, token),
+			},
+		},
+	}
+	if err := s.direct(ctx, to, "Reset Password", reset); err != nil {
+		s.l.Error(ctx.Ctx, err, "slack message for password reset failed", nil)
+		return
+	}
+
 	attachment := slack.Attachment{
 		Fields: []slack.AttachmentField{
 			slack.AttachmentField{
 				Title: "To:",
 				Value: fmt.Sprintf("<%s>%s", to, name),
 			},
-			slack.AttachmentField{
-				Title: "Token:",
-				Value: token,
-			},
 		},
 	}
 	if _, _, err := s.c.PostMessageContext(
 		ctx.Ctx,
 		ChannelID,
-		slack.MsgOptionText("Reset Password", false),
+		slack.MsgOptionText("Password Reset Requested", false),
 		slack.MsgOptionAttachments(attachment),
 	); err != nil {
-		//s.l.Log(ctx, log.Error, "Slack message failed", "err", err)
+		s.l.Error(ctx.Ctx, err, "slack message for password reset failed", nil)
 	}
 }
 
@@ -131,26 +196,81 @@ func (s Service) NewPasswordAsync(ctx cloud.Context, name, to, pass string) {
 	}
 }
 
+// ValidateEmailAsync sends the code that confirms an email change to the new
+// address only. It is never posted to the channel.
 func (s Service) ValidateEmailAsync(ctx cloud.Context, to, code string) {
+	attachment := slack.Attachment{
+		Fields: []slack.AttachmentField{
+			slack.AttachmentField{
+				Title: "Code:",
+				Value: code,
+			},
+		},
+	}
+	if err := s.direct(ctx, to, "Validate Email", attachment); err != nil {
+		s.l.Error(ctx.Ctx, err, "slack message for email validation failed", nil)
+	}
+}
+
+func (s Service) EmailChangeAsync(ctx cloud.Context, name, to, newEmail string) {
 	attachment := slack.Attachment{
 		Fields: []slack.AttachmentField{
 			slack.AttachmentField{
 				Title: "To:",
-				Value: fmt.Sprintf("<%s>", to),
+				Value: fmt.Sprintf("<%s>%s", to, name),
 			},
 			slack.AttachmentField{
-				Title: "Code:",
-				Value: code,
+				Title: "New Email:",
+				Value: newEmail,
 			},
 		},
 	}
 	if _, _, err := s.c.PostMessageContext(
 		ctx.Ctx,
 		ChannelID,
-		slack.MsgOptionText("Validate Email", false),
+		slack.MsgOptionText("Email Change Requested", false),
 		slack.MsgOptionAttachments(attachment),
 	); err != nil {
-		//s.l.Log(ctx, log.Error, "Slack message failed", "err", err)
+		s.l.Error(ctx.Ctx, err, "slack message for email change failed", nil)
+	}
+}
+
+func (s Service) AccountLockedAsync(ctx cloud.Context, name, to string, until time.Time) {
+	attachment := slack.Attachment{
+		Fields: []slack.AttachmentField{
+			slack.AttachmentField{
+				Title: "To:",
+				Value: fmt.Sprintf("<%s>%s", to, name),
+			},
+			slack.AttachmentField{
+				Title: "Locked Until:",
+				Value: until.Format(time.RFC1123),
+			},
+		},
+	}
+	if _, _, err := s.c.PostMessageContext(
+		ctx.Ctx,
+		ChannelID,
+		slack.MsgOptionText("Account Locked", false),
+		slack.MsgOptionAttachments(attachment),
+	); err != nil {
+		s.l.Error(ctx.Ctx, err, "slack message for locked account failed", nil)
+	}
+}
+
+// MagicLinkAsync sends the user the link that logs them in. It is never
+// posted to the channel.
+func (s Service) MagicLinkAsync(ctx cloud.Context, name, to, token string) {
+	attachment := slack.Attachment{
+		Fields: []slack.AttachmentField{
+			slack.AttachmentField{
+				Title: "Log In:",
+				Value: s.link(MagicLinkPath, token),
+			},
+		},
+	}
+	if err := s.direct(ctx, to, "Magic Link Login", attachment); err != nil {
+		s.l.Error(ctx.Ctx, err, "slack message for magic link failed", nil)
 	}
 }
 
@@ -7,9 +7,10 @@ import (
 func TestService(t *testing.T) {
 	// ctx := context.Background()
 	// token := os.Getenv("SLACK_BOT_TOKEN")
-	// s := New(token, log.NewContextLogger())
-	// s.NewUserAsync(cloud.Context, "Test Name", "t@a.c", "abc123")
+	// s := New(token, "http://localhost:3000", log.NewContextLogger())
+	// s.InviteAsync(cloud.Context, "Test Name", "t@a.c", "abc123", time.Now())
 	// s.ResetPasswordAsync(cloud.Context, "Test Name", "t@a.c", "23lkasdflkj23sd")
 	// s.NewPasswordAsync(cloud.Context, "Test Name", "t@a.c", "abc123")
 	// s.ValidateEmailAsync(cloud.Context, "t@a.c", "123456")
+	// s.EmailChangeAsync(cloud.Context, "Test Name", "t@a.c", "n@a.c")
 }
@@ -0,0 +1,25 @@
+package flag
+
+import "time"
+
+type durationFlag struct {
+	defaultValue time.Duration
+	description  string
+	dest         *time.Duration
+	long         string
+	longVal      time.Duration
+	short        string
+	shortVal     time.Duration
+}
+
+func (f *durationFlag) Reconcile() {
+	if f.longVal != 0 {
+		*f.dest = f.longVal
+		return
+	}
+	if f.shortVal != 0 {
+		*f.dest = f.shortVal
+		return
+	}
+	*f.dest = f.defaultValue
+}
@@ -2,6 +2,7 @@ package flag
 
 import (
 	"flag"
+	"time"
 )
 
 func NewFlagSet(name string) FlagSet {
@@ -40,8 +41,12 @@ func (fs *FlagSet) IntVar(dest *int, short, long string, defaultValue int, descr
 		defaultValue: defaultValue,
 		description:  description,
 	}
-	fs.fs.IntVar(&intf.shortVal, intf.short, 0, intf.description)
-	fs.fs.IntVar(&intf.longVal, intf.long, 0, intf.description)
+	if intf.short != "" {
+		fs.fs.IntVar(&intf.shortVal, intf.short, 0, intf.description)
+	}
+	if intf.long != "" {
+		fs.fs.IntVar(&intf.longVal, intf.long, 0, intf.description)
+	}
 	fs.flags = append(fs.flags, intf)
 }
 
@@ -53,11 +58,32 @@ func (fs *FlagSet) StringVar(dest *string, short, long string, defaultValue stri
 		defaultValue: defaultValue,
 		description:  description,
 	}
-	fs.fs.StringVar(&stringf.shortVal, stringf.short, "", stringf.description)
-	fs.fs.StringVar(&stringf.longVal, stringf.long, "", stringf.description)
+	if stringf.short != "" {
+		fs.fs.StringVar(&stringf.shortVal, stringf.short, "", stringf.description)
+	}
+	if stringf.long != "" {
+		fs.fs.StringVar(&stringf.longVal, stringf.long, "", stringf.description)
+	}
 	fs.flags = append(fs.flags, stringf)
 }
 
+func (fs *FlagSet) DurationVar(dest *time.Duration, short, long string, defaultValue time.Duration, description string) {
+	durationf := &durationFlag{
+		dest:         dest,
+		short:        short,
+		long:         long,
+		defaultValue: defaultValue,
+		description:  description,
+	}
+	if durationf.short != "" {
+		fs.fs.DurationVar(&durationf.shortVal, durationf.short, 0, durationf.description)
+	}
+	if durationf.long != "" {
+		fs.fs.DurationVar(&durationf.longVal, durationf.long, 0, durationf.description)
+	}
+	fs.flags = append(fs.flags, durationf)
+}
+
 func (fs *FlagSet) Parse(args []string) {
 	fs.fs.Parse(args)
 	for _, f := range fs.flags {
@@ -2,6 +2,7 @@ package flag_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/kmhebb/serverExample/lib/flag"
 )
@@ -131,3 +132,57 @@ func TestStringVar(t *testing.T) {
 		})
 	}
 }
+
+func TestDurationVar(t *testing.T) {
+	defaultValue := time.Hour
+
+	for name, tc := range map[string]struct {
+		input []string
+		want  time.Duration
+	}{
+		"short": {
+			input: []string{"-g", "30m"},
+			want:  30 * time.Minute,
+		},
+		"long": {
+			input: []string{"-grace", "2h"},
+			want:  2 * time.Hour,
+		},
+		"default": {
+			input: []string{""},
+			want:  defaultValue,
+		},
+		"long and short": {
+			input: []string{"-g", "30m", "-grace", "2h"},
+			want:  2 * time.Hour,
+		},
+		"long equals": {
+			input: []string{"--grace=45s"},
+			want:  45 * time.Second,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var d time.Duration
+			fs := flag.NewFlagSet("test")
+			fs.DurationVar(&d, "g", "grace", defaultValue, "The grace period")
+			fs.Parse(tc.input)
+			if d != tc.want {
+				t.Errorf("expected d=%s, but got d=%s", tc.want, d)
+			}
+		})
+	}
+}
+
+func TestLongOnly(t *testing.T) {
+	var s1, s2 string
+	var i1, i2 int
+	fs := flag.NewFlagSet("test")
+	fs.StringVar(&s1, "", "first", "", "The first string")
+	fs.StringVar(&s2, "", "second", "", "The second string")
+	fs.IntVar(&i1, "", "one", 0, "The first integer")
+	fs.IntVar(&i2, "", "two", 0, "The second integer")
+	fs.Parse([]string{"-first", "a", "-second", "b", "-one", "1", "-two", "2"})
+	if s1 != "a" || s2 != "b" || i1 != 1 || i2 != 2 {
+		t.Errorf("expected a, b, 1, 2, but got %s, %s, %d, %d", s1, s2, i1, i2)
+	}
+}
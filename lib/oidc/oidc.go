@@ -0,0 +1,210 @@
+// Package oidc implements the relying party side of an OpenID Connect login,
+// using the authorization code flow with PKCE. A Provider is set up through
+// discovery, sends users to the provider with AuthCodeURL, and turns the code
+// they come back with into a verified IDToken with Exchange.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// DiscoveryPath is where providers publish their configuration, relative to
+// the issuer.
+const DiscoveryPath = "/.well-known/openid-configuration"
+
+// DefaultScopes are requested when Config.Scopes is empty.
+var DefaultScopes = []string{"openid", "email", "profile"}
+
+var (
+	// ErrInvalidToken is returned, wrapped, when an ID token fails
+	// verification.
+	ErrInvalidToken = errors.New("oidc: invalid id token")
+
+	// ErrUnknownKey is returned, wrapped, when an ID token is signed with a
+	// key the provider does not publish.
+	ErrUnknownKey = errors.New("oidc: unknown signing key")
+)
+
+// Config identifies the provider and this application as a client of it.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+
+	// Client makes requests to the provider. http.DefaultClient is used if it
+	// is nil.
+	Client *http.Client
+}
+
+// Provider is an OpenID Connect provider, as found through discovery.
+type Provider struct {
+	cfg Config
+
+	AuthURL  string
+	TokenURL string
+	JWKSURL  string
+
+	mu   sync.Mutex
+	keys map[string]interface{}
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Discover fetches the provider's configuration from its discovery document.
+// The issuer in the document must match the configured one exactly.
+func Discover(ctx context.Context, cfg Config) (*Provider, error) {
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = DefaultScopes
+	}
+
+	var d discovery
+	if err := getJSON(ctx, cfg.Client, strings.TrimSuffix(cfg.Issuer, "/")+DiscoveryPath, &d); err != nil {
+		return nil, fmt.Errorf("oidc: discovery failed: %w", err)
+	}
+	if d.Issuer != cfg.Issuer {
+		return nil, fmt.Errorf("oidc: discovery issuer %q does not match %q", d.Issuer, cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, fmt.Errorf("oidc: discovery document is missing endpoints")
+	}
+
+	return &Provider{
+		cfg:      cfg,
+		AuthURL:  d.AuthorizationEndpoint,
+		TokenURL: d.TokenEndpoint,
+		JWKSURL:  d.JWKSURI,
+	}, nil
+}
+
+// AuthCodeURL returns the URL to send the user to. state comes back with the
+// user and ties the callback to this request, nonce comes back in the ID token,
+// and challenge is the PKCE challenge for the verifier Exchange is called with.
+func (p *Provider) AuthCodeURL(state, nonce, challenge string) string {
+	v := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.cfg.ClientID},
+		"redirect_uri":          {p.cfg.RedirectURL},
+		"scope":                 {strings.Join(p.cfg.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.AuthURL + sep + v.Encode()
+}
+
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange redeems the authorization code the user came back with, and
+// verifies the ID token it is exchanged for.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*IDToken, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.RedirectURL},
+		"client_id":     {p.cfg.ClientID},
+		"code_verifier": {verifier},
+	}
+	if p.cfg.ClientSecret != "" {
+		form.Set("client_secret", p.cfg.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token request failed: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.cfg.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var tr tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("oidc: token response could not be decoded: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK || tr.Error != "" {
+		return nil, fmt.Errorf("oidc: token request refused with status %d: %s %s", resp.StatusCode, tr.Error, tr.ErrorDescription)
+	}
+	if tr.IDToken == "" {
+		return nil, fmt.Errorf("oidc: token response has no id token")
+	}
+
+	return p.Verify(ctx, tr.IDToken, nonce)
+}
+
+// NewPKCE returns a new PKCE code verifier along with its S256 challenge.
+func NewPKCE() (verifier string, challenge string, err error) {
+	verifier, err = Random()
+	if err != nil {
+		return "", "", err
+	}
+	return verifier, Challenge(verifier), nil
+}
+
+// Challenge returns the S256 PKCE challenge for the verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Random returns a new random value suitable for a state, nonce or PKCE
+// verifier.
+func Random() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("oidc: could not generate random value: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func getJSON(ctx context.Context, c *http.Client, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,258 @@
+package oidc_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/kmhebb/serverExample/internal/assert"
+	"github.com/kmhebb/serverExample/lib/oidc"
+)
+
+// provider is an in-process stand-in for an OpenID Connect provider. It
+// authorizes every request as the same user.
+type provider struct {
+	*httptest.Server
+	t *testing.T
+
+	mu     sync.Mutex
+	kid    string
+	key    *rsa.PrivateKey
+	codes  map[string]url.Values
+	claims func(jwt.MapClaims)
+}
+
+func newProvider(t *testing.T) *provider {
+	p := &provider{t: t, codes: map[string]url.Values{}}
+	p.rotate("key-1")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(oidc.DiscoveryPath, func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"kid": p.kid,
+				"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+			}},
+		})
+	})
+	// Authorization succeeds at once, sending the user back with a code.
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code := "code-" + q.Get("state")
+		p.mu.Lock()
+		p.codes[code] = q
+		p.mu.Unlock()
+
+		back, _ := url.Parse(q.Get("redirect_uri"))
+		back.RawQuery = url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+		http.Redirect(w, r, back.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.mu.Lock()
+		auth, ok := p.codes[r.PostForm.Get("code")]
+		delete(p.codes, r.PostForm.Get("code"))
+		p.mu.Unlock()
+
+		if !ok || oidc.Challenge(r.PostForm.Get("code_verifier")) != auth.Get("code_challenge") {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token": p.idToken(auth.Get("client_id"), auth.Get("nonce")),
+		})
+	})
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *provider) rotate(kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.mu.Lock()
+	p.kid, p.key = kid, key
+	p.mu.Unlock()
+}
+
+func (p *provider) idToken(aud, nonce string) string {
+	cm := jwt.MapClaims{
+		"iss":            p.URL,
+		"sub":            "subject-1",
+		"aud":            aud,
+		"exp":            time.Now().Add(time.Minute).Unix(),
+		"iat":            time.Now().Unix(),
+		"nonce":          nonce,
+		"email":          "staff@example.com",
+		"email_verified": true,
+		"given_name":     "Sam",
+		"family_name":    "Staff",
+	}
+	if p.claims != nil {
+		p.claims(cm)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	t := jwt.NewWithClaims(jwt.SigningMethodRS256, cm)
+	t.Header["kid"] = p.kid
+	s, err := t.SignedString(p.key)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return s
+}
+
+func discover(t *testing.T, p *provider) *oidc.Provider {
+	rp, err := oidc.Discover(context.Background(), oidc.Config{
+		Issuer:      p.URL,
+		ClientID:    "client-1",
+		RedirectURL: "https://app.example.com/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rp
+}
+
+// login runs the whole flow: the user follows the auth URL, comes back with a
+// code, and the code is exchanged.
+func login(t *testing.T, rp *oidc.Provider, verifier, challenge string) (*oidc.IDToken, error) {
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(rp.AuthCodeURL("state-1", "nonce-1", challenge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if back.Query().Get("state") != "state-1" {
+		t.Fatalf("state was not returned: %s", back)
+	}
+	return rp.Exchange(context.Background(), back.Query().Get("code"), verifier, "nonce-1")
+}
+
+func TestLogin(t *testing.T) {
+	assert := assert.New(t)
+	p := newProvider(t)
+	rp := discover(t, p)
+
+	assert.Equals(rp.TokenURL, p.URL+"/token")
+
+	verifier, challenge, err := oidc.NewPKCE()
+	assert.OK(err)
+	id, err := login(t, rp, verifier, challenge)
+	assert.OK(err)
+	assert.Equals(id.Subject, "subject-1")
+	assert.Equals(id.Email, "staff@example.com")
+	assert.True(id.EmailVerified)
+	assert.Equals(id.GivenName, "Sam")
+	assert.Equals(id.FamilyName, "Staff")
+}
+
+func TestLoginWrongVerifier(t *testing.T) {
+	p := newProvider(t)
+	rp := discover(t, p)
+
+	_, challenge, err := oidc.NewPKCE()
+	assert.New(t).OK(err)
+	_, err = login(t, rp, "not-the-verifier", challenge)
+	assert.New(t).NotNil(err)
+}
+
+func TestDiscoverIssuerMismatch(t *testing.T) {
+	p := newProvider(t)
+	_, err := oidc.Discover(context.Background(), oidc.Config{Issuer: p.URL + "/other"})
+	assert.New(t).NotNil(err)
+}
+
+func TestVerifyClaims(t *testing.T) {
+	for name, tc := range map[string]struct {
+		claims func(jwt.MapClaims)
+		nonce  string
+	}{
+		"wrong issuer":   {claims: func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }},
+		"wrong audience": {claims: func(c jwt.MapClaims) { c["aud"] = "client-2" }},
+		"expired":        {claims: func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }},
+		"no expiry":      {claims: func(c jwt.MapClaims) { delete(c, "exp") }},
+		"no subject":     {claims: func(c jwt.MapClaims) { delete(c, "sub") }},
+		"wrong nonce":    {nonce: "nonce-2"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			p := newProvider(t)
+			rp := discover(t, p)
+
+			p.claims = tc.claims
+			nonce := tc.nonce
+			if nonce == "" {
+				nonce = "nonce-1"
+			}
+			_, err := rp.Verify(context.Background(), p.idToken("client-1", "nonce-1"), nonce)
+			assert.True(errors.Is(err, oidc.ErrInvalidToken))
+		})
+	}
+}
+
+func TestVerifyAudienceList(t *testing.T) {
+	p := newProvider(t)
+	rp := discover(t, p)
+
+	p.claims = func(c jwt.MapClaims) { c["aud"] = []string{"client-2", "client-1"} }
+	_, err := rp.Verify(context.Background(), p.idToken("", "nonce-1"), "nonce-1")
+	assert.New(t).OK(err)
+}
+
+func TestVerifyKeyRotation(t *testing.T) {
+	assert := assert.New(t)
+	p := newProvider(t)
+	rp := discover(t, p)
+
+	_, err := rp.Verify(context.Background(), p.idToken("client-1", "n"), "n")
+	assert.OK(err)
+
+	// Tokens signed with a new key cause the keys to be fetched again.
+	p.rotate("key-2")
+	_, err = rp.Verify(context.Background(), p.idToken("client-1", "n"), "n")
+	assert.OK(err)
+
+	// Tokens signed with a key the provider doesn't publish are rejected.
+	other := newProvider(t)
+	other.claims = func(c jwt.MapClaims) { c["iss"] = p.URL }
+	_, err = rp.Verify(context.Background(), other.idToken("client-1", "n"), "n")
+	assert.True(errors.Is(err, oidc.ErrInvalidToken))
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"time"
 )
 
 func GetStringEnv(key string) string {
@@ -24,6 +25,18 @@ func GetIntEnv(key string) int {
 	return ival
 }
 
+func GetDurationEnv(key string) time.Duration {
+	val, set := os.LookupEnv(key)
+	if !set {
+		return 0
+	}
+	dval, err := time.ParseDuration(val)
+	if err != nil {
+		panic(err)
+	}
+	return dval
+}
+
 func Exit(code int) {
 	os.Exit(code)
 }
@@ -3,6 +3,7 @@ package os_test
 import (
 	goos "os"
 	"testing"
+	"time"
 
 	"github.com/pborman/uuid"
 
@@ -44,3 +45,28 @@ func TestGetIntEnv(t *testing.T) {
 	}()
 	assert.True(panicked)
 }
+
+func TestGetDurationEnv(t *testing.T) {
+	assert := assert.New(t)
+	key := uuid.New()
+
+	// Not set -> 0
+	assert.Equals(os.GetDurationEnv(key), time.Duration(0))
+
+	// Set to duration -> duration
+	goos.Setenv(key, "90m")
+	assert.Equals(os.GetDurationEnv(key), 90*time.Minute)
+
+	// Set to otherval -> panic
+	goos.Setenv(key, "ninety")
+	panicked := false
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panicked = true
+			}
+		}()
+		os.GetDurationEnv(key)
+	}()
+	assert.True(panicked)
+}
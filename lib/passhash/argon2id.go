@@ -0,0 +1,111 @@
+package passhash
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Default Argon2id parameters, as recommended by OWASP.
+const (
+	DefaultArgon2Memory  = 19 * 1024 // KiB
+	DefaultArgon2Time    = 2
+	DefaultArgon2Threads = 1
+	DefaultArgon2SaltLen = 16
+	DefaultArgon2KeyLen  = 32
+)
+
+// Argon2id hashes passwords with Argon2id. Zero fields take the default
+// parameters.
+type Argon2id struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+func (a Argon2id) params() Argon2id {
+	if a.Memory == 0 {
+		a.Memory = DefaultArgon2Memory
+	}
+	if a.Time == 0 {
+		a.Time = DefaultArgon2Time
+	}
+	if a.Threads == 0 {
+		a.Threads = DefaultArgon2Threads
+	}
+	return a
+}
+
+var b64 = base64.RawStdEncoding
+
+// Hash implements Hasher.
+func (a Argon2id) Hash(password string) (string, error) {
+	p := a.params()
+	salt := make([]byte, DefaultArgon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("passhash: could not generate salt: %w", err)
+	}
+	key := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, DefaultArgon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Time, p.Threads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+// Verify implements Hasher.
+func (a Argon2id) Verify(hash, password string) (bool, error) {
+	p, salt, key, err := decodeArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+// Handles implements Hasher.
+func (a Argon2id) Handles(hash string) bool {
+	return strings.HasPrefix(hash, "$argon2id$")
+}
+
+// NeedsRehash implements Hasher. Hashes made with cheaper parameters than a's
+// need rehashing.
+func (a Argon2id) NeedsRehash(hash string) bool {
+	p, _, _, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+	want := a.params()
+	return p.Memory < want.Memory || p.Time < want.Time || p.Threads < want.Threads
+}
+
+func decodeArgon2id(hash string) (Argon2id, []byte, []byte, error) {
+	var p Argon2id
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, fmt.Errorf("passhash: malformed argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, nil, nil, fmt.Errorf("passhash: malformed argon2id version: %w", err)
+	}
+	if version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("passhash: unsupported argon2id version %d", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, fmt.Errorf("passhash: malformed argon2id parameters: %w", err)
+	}
+
+	salt, err := b64.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("passhash: malformed argon2id salt: %w", err)
+	}
+	key, err := b64.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("passhash: malformed argon2id key: %w", err)
+	}
+	return p, salt, key, nil
+}
@@ -0,0 +1,83 @@
+// Package passhash hashes and verifies passwords. Hashes are self-describing
+// strings in PHC format, such as
+//
+//	$argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>
+//
+// so that hashes made with an older scheme, or older parameters, can still be
+// verified and then replaced with a hash made by the default Hasher.
+package passhash
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrUnknownScheme is returned when no registered Hasher handles a hash.
+var ErrUnknownScheme = errors.New("passhash: unknown hash scheme")
+
+// Hasher is a password hashing scheme.
+type Hasher interface {
+	// Hash returns the hash of the password.
+	Hash(password string) (string, error)
+
+	// Verify reports whether the password matches the hash. A mismatch is not
+	// an error.
+	Verify(hash, password string) (bool, error)
+
+	// Handles reports whether the hash was made by this scheme.
+	Handles(hash string) bool
+
+	// NeedsRehash reports whether the hash was made by this scheme, but with
+	// weaker parameters than it would use now.
+	NeedsRehash(hash string) bool
+}
+
+var (
+	mu       sync.RWMutex
+	def      Hasher   = Argon2id{}
+	registry []Hasher = []Hasher{Bcrypt{}}
+)
+
+// SetDefault makes h the Hasher used for new hashes. Hashes made by the
+// previous default can still be verified.
+func SetDefault(h Hasher) {
+	mu.Lock()
+	defer mu.Unlock()
+	registry = append(registry, def)
+	def = h
+}
+
+// Register adds a Hasher that can verify existing hashes, but is not used for
+// new ones.
+func Register(h Hasher) {
+	mu.Lock()
+	defer mu.Unlock()
+	registry = append(registry, h)
+}
+
+// Hash returns the hash of the password made by the default Hasher.
+func Hash(password string) (string, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	return def.Hash(password)
+}
+
+// Verify reports whether the password matches the hash. If it does, rehash
+// reports whether the hash should be replaced by a new one from Hash, because
+// it was made by another scheme or with outdated parameters.
+func Verify(hash, password string) (ok bool, rehash bool, err error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if def.Handles(hash) {
+		ok, err = def.Verify(hash, password)
+		return ok, ok && def.NeedsRehash(hash), err
+	}
+	for _, h := range registry {
+		if h.Handles(hash) {
+			ok, err = h.Verify(hash, password)
+			return ok, ok, err
+		}
+	}
+	return false, false, ErrUnknownScheme
+}
@@ -0,0 +1,73 @@
+package passhash_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kmhebb/serverExample/internal/assert"
+	"github.com/kmhebb/serverExample/lib/passhash"
+)
+
+func TestArgon2id(t *testing.T) {
+	assert := assert.New(t)
+
+	h, err := passhash.Hash("correct horse")
+	assert.OK(err)
+	assert.True(strings.HasPrefix(h, "$argon2id$v=19$m=19456,t=2,p=1$"))
+
+	ok, rehash, err := passhash.Verify(h, "correct horse")
+	assert.OK(err)
+	assert.True(ok)
+	assert.False(rehash)
+
+	ok, rehash, err = passhash.Verify(h, "battery staple")
+	assert.OK(err)
+	assert.False(ok)
+	assert.False(rehash)
+
+	// The same password hashes differently every time.
+	other, err := passhash.Hash("correct horse")
+	assert.OK(err)
+	assert.True(h != other)
+}
+
+func TestArgon2idNeedsRehash(t *testing.T) {
+	assert := assert.New(t)
+
+	weak, err := passhash.Argon2id{Memory: 1024, Time: 1}.Hash("pw")
+	assert.OK(err)
+
+	ok, rehash, err := passhash.Verify(weak, "pw")
+	assert.OK(err)
+	assert.True(ok)
+	assert.True(rehash)
+}
+
+func TestBcryptMigration(t *testing.T) {
+	assert := assert.New(t)
+
+	legacy, err := passhash.Bcrypt{Cost: 4}.Hash("pw")
+	assert.OK(err)
+
+	// Legacy hashes verify, and always need replacing by the default.
+	ok, rehash, err := passhash.Verify(legacy, "pw")
+	assert.OK(err)
+	assert.True(ok)
+	assert.True(rehash)
+
+	// But are never replaced when the password is wrong.
+	ok, rehash, err = passhash.Verify(legacy, "wrong")
+	assert.OK(err)
+	assert.False(ok)
+	assert.False(rehash)
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	assert := assert.New(t)
+
+	_, _, err := passhash.Verify("", "pw")
+	assert.NotNil(err)
+
+	_, _, err = passhash.Verify("$argon2id$v=19$m=x$salt$key", "pw")
+	assert.NotNil(err)
+}
@@ -1,12 +1,26 @@
 package random
 
-import "math/rand"
+import (
+	"crypto/rand"
+	"math/big"
+)
 
+// GenerateCode returns a code of n characters for users to type in, such as
+// the one confirming an email change. Characters that are easily mistaken for
+// one another are left out. The code is drawn from crypto/rand, since it
+// proves who the user is.
 func GenerateCode(n int) string {
 	chars := "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+	max := big.NewInt(int64(len(chars)))
 	var code []byte
 	for i := 0; i < n; i++ {
-		code = append(code, chars[rand.Intn(len(chars))])
+		j, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			// crypto/rand only fails if the system's source of randomness
+			// does, and nothing can be done about that here.
+			panic(err)
+		}
+		code = append(code, chars[j.Int64()])
 	}
 	return string(code)
 }
@@ -6,8 +6,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/kmhebb/serverExample/lib/passhash"
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type PasswordGenerator func() (string, string, error)
@@ -58,7 +58,7 @@ func String(s int) (string, error) {
 }
 
 // Password creates a random, temporary password and returns the plaintext
-// password, as well as the bcrypt hashed version.
+// password, as well as its hash from passhash.Hash.
 //
 // This function returns an error if one occurs, but this should never really
 // happen in practice.
@@ -69,12 +69,12 @@ func Password() (string, string, error) {
 	}
 
 	newPass := base64.URLEncoding.EncodeToString(newPassBytes)
-	hash, err := bcrypt.GenerateFromPassword([]byte(newPass), bcrypt.DefaultCost)
+	hash, err := passhash.Hash(newPass)
 	if err != nil {
 		return "", "", errors.Wrap(err, "could not hash password")
 	}
 
-	return newPass, string(hash), nil
+	return newPass, hash, nil
 }
 
 // Words creates a string of n words from a hand-checked list concatenated
@@ -94,10 +94,10 @@ func Words(n int) string {
 // Passphrase return both a generated passphrase and its hash.
 func Passphrase() (string, string, error) {
 	p := Words(PhraseLength)
-	h, err := bcrypt.GenerateFromPassword([]byte(p), bcrypt.DefaultCost)
+	h, err := passhash.Hash(p)
 	if err != nil {
 		return "", "", errors.Wrap(err, "could not hash password")
 	}
 
-	return p, string(h), nil
+	return p, h, nil
 }
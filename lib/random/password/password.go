@@ -1,8 +1,7 @@
 package password
 
 import (
-	"golang.org/x/crypto/bcrypt"
-
+	"github.com/kmhebb/serverExample/lib/passhash"
 	"github.com/kmhebb/serverExample/lib/random"
 )
 
@@ -18,9 +17,9 @@ func Generate() (string, string, error) {
 
 func constant() (string, string, error) {
 	p := "test"
-	hash, err := bcrypt.GenerateFromPassword([]byte(p), bcrypt.DefaultCost)
+	hash, err := passhash.Hash(p)
 	if err != nil {
 		return "", "", err
 	}
-	return p, string(hash), nil
+	return p, hash, nil
 }
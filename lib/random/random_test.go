@@ -3,6 +3,7 @@
 package random_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/kmhebb/serverExample/lib/random"
@@ -20,3 +21,15 @@ func TestWords(t *testing.T) {
 		}
 	}
 }
+
+func TestGenerateCode(t *testing.T) {
+	code := random.GenerateCode(6)
+	if len(code) != 6 {
+		t.Fatalf("code %q is not 6 characters long", code)
+	}
+	for _, c := range code {
+		if !strings.ContainsRune("ABCDEFGHJKMNPQRSTUVWXYZ23456789", c) {
+			t.Errorf("code %q contains unexpected character %q", code, c)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package token
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+)
+
+// DefaultKeyID is the key ID used by SetSigningKey.
+const DefaultKeyID = "default"
+
+// MinRSAKeyBits is the smallest RSA key accepted for signing tokens.
+const MinRSAKeyBits = 2048
+
+// Key is a secret used to sign and verify tokens. The ID is sent in the kid
+// header of every token signed with the key, so that the key can be found
+// again when the token is parsed.
+//
+// Tokens are signed with HS256 using Secret, unless Private is set. Private is
+// either an *rsa.PrivateKey, which signs with RS256, or an ed25519.PrivateKey,
+// which signs with EdDSA. The public half of those keys is published by JWKS,
+// so that other services can verify tokens without sharing a secret.
+type Key struct {
+	ID      string
+	Secret  string
+	Private crypto.Signer
+}
+
+func (k Key) method() jwt.SigningMethod {
+	switch k.Private.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256
+	case ed25519.PrivateKey:
+		return SigningMethodEdDSA
+	}
+	return jwt.SigningMethodHS256
+}
+
+func (k Key) signingKey() interface{} {
+	if k.Private != nil {
+		return k.Private
+	}
+	return []byte(k.Secret)
+}
+
+func (k Key) verifyingKey() interface{} {
+	if k.Private != nil {
+		return k.Private.Public()
+	}
+	return []byte(k.Secret)
+}
+
+// NewKey returns the key with the given ID. If value starts with "@", the rest
+// is the path of a PEM encoded RSA or Ed25519 private key. Otherwise value is
+// an HS256 secret.
+func NewKey(id, value string) (Key, error) {
+	if !strings.HasPrefix(value, "@") {
+		return Key{ID: id, Secret: value}, nil
+	}
+
+	b, err := ioutil.ReadFile(value[1:])
+	if err != nil {
+		return Key{}, errors.Wrapf(err, "could not read key %s", id)
+	}
+	priv, err := ParsePrivateKey(b)
+	if err != nil {
+		return Key{}, errors.Wrapf(err, "could not parse key %s", id)
+	}
+	return Key{ID: id, Private: priv}, nil
+}
+
+// ParsePrivateKey parses a PEM encoded RSA or Ed25519 private key, in either
+// PKCS #8 or, for RSA, PKCS #1 form.
+func ParsePrivateKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var priv interface{}
+	var err error
+	if block.Type == "RSA PRIVATE KEY" {
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	} else {
+		priv, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch priv := priv.(type) {
+	case *rsa.PrivateKey:
+		if priv.N.BitLen() < MinRSAKeyBits {
+			return nil, errors.Errorf("RSA key must be at least %d bits", MinRSAKeyBits)
+		}
+		return priv, nil
+	case ed25519.PrivateKey:
+		return priv, nil
+	}
+	return nil, errors.Errorf("unsupported key type: %T", priv)
+}
+
+// ParseKeys parses a comma separated list of keys in the form
+// "kid:secret,kid:@path". See NewKey.
+func ParseKeys(s string) ([]Key, error) {
+	var keys []Key
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.Index(pair, ":")
+		if i <= 0 || i == len(pair)-1 {
+			return nil, errors.Errorf("key must be in the form kid:secret")
+		}
+		k, err := NewKey(pair[:i], pair[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// Keyring holds the active key, which signs new tokens, and the retired keys,
+// which are still accepted when verifying tokens until their grace period
+// ends. A Keyring is safe for concurrent use.
+type Keyring struct {
+	mu      sync.RWMutex
+	active  Key
+	retired map[string]retiredKey
+}
+
+type retiredKey struct {
+	Key
+	until time.Time
+}
+
+// NewKeyring returns a keyring that signs with the active key.
+func NewKeyring(active Key) *Keyring {
+	return &Keyring{
+		active:  active,
+		retired: make(map[string]retiredKey),
+	}
+}
+
+// Retire adds a key that can no longer sign tokens, but still verifies them
+// until the given time.
+func (kr *Keyring) Retire(k Key, until time.Time) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.retired[k.ID] = retiredKey{Key: k, until: until}
+}
+
+// Rotate makes k the active key. The previously active key is retired and
+// keeps verifying tokens for the grace period, which should be at least as
+// long as the longest lived token.
+func (kr *Keyring) Rotate(k Key, grace time.Duration) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if kr.active.ID != "" && kr.active.ID != k.ID {
+		kr.retired[kr.active.ID] = retiredKey{Key: kr.active, until: time.Now().Add(grace)}
+	}
+	delete(kr.retired, k.ID)
+	kr.active = k
+}
+
+// Active returns the key used to sign new tokens.
+func (kr *Keyring) Active() Key {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.active
+}
+
+// Lookup returns the key with the given ID if it may be used to verify a
+// token. Retired keys are not returned once their grace period has ended.
+func (kr *Keyring) Lookup(kid string) (Key, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	if kid == kr.active.ID {
+		return kr.active, true
+	}
+	rk, ok := kr.retired[kid]
+	if !ok || time.Now().After(rk.until) {
+		return Key{}, false
+	}
+	return rk.Key, true
+}
+
+// JWK is the JSON Web Key representation of a public key, as defined by
+// RFC 7517.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+
+	// RSA keys.
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// Ed25519 keys.
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKSet is a set of JSON Web Keys.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys that tokens can currently be verified with: the
+// active key, followed by the retired keys still within their grace period.
+// HS256 keys are secret and never included.
+func (kr *Keyring) JWKS() JWKSet {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	set := JWKSet{Keys: []JWK{}}
+	if jwk, ok := publicJWK(kr.active); ok {
+		set.Keys = append(set.Keys, jwk)
+	}
+
+	var retired []JWK
+	now := time.Now()
+	for _, rk := range kr.retired {
+		if now.After(rk.until) {
+			continue
+		}
+		if jwk, ok := publicJWK(rk.Key); ok {
+			retired = append(retired, jwk)
+		}
+	}
+	sort.Slice(retired, func(i, j int) bool { return retired[i].Kid < retired[j].Kid })
+
+	set.Keys = append(set.Keys, retired...)
+	return set
+}
+
+func publicJWK(k Key) (JWK, bool) {
+	jwk := JWK{Use: "sig", Alg: k.method().Alg(), Kid: k.ID}
+	switch pub := k.verifyingKey().(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	default:
+		return JWK{}, false
+	}
+	return jwk, true
+}
+
+var keys = NewKeyring(Key{ID: DefaultKeyID, Secret: time.Now().Format("20060102150405")})
+
+// SetKeyring replaces the keyring used to sign and verify tokens.
+func SetKeyring(kr *Keyring) {
+	keys = kr
+}
+
+// SetSigningKey signs and verifies tokens with a single key, discarding any
+// other keys.
+func SetSigningKey(k string) {
+	SetKeyring(NewKeyring(Key{ID: DefaultKeyID, Secret: k}))
+}
+
+// PublicKeys returns the JWKS of the keyring used to sign and verify tokens.
+// Purpose tokens verify against it too: only tokens with the TypeAccess typ
+// claim are access tokens.
+func PublicKeys() JWKSet {
+	return keys.JWKS()
+}
@@ -1,11 +1,16 @@
 package token
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"strings"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
 )
 
@@ -13,10 +18,32 @@ type Claims struct {
 	// UID is the database ID of the user and identifies a single user of the
 	// application.
 	UID string
+
+	// ID uniquely identifies the token so that it can be revoked on its own.
+	ID string
+
+	// Generation is the user's token generation at the time the token was
+	// issued. Bumping the generation stored with the user invalidates every
+	// token issued before.
+	Generation int
+
+	// ExpiresAt is when the token stops being valid.
+	ExpiresAt time.Time
+
+	// Impersonator is the database ID of the admin acting as the user, if the
+	// token was issued for impersonation. It is carried in the ovr claim.
+	Impersonator string
+
+	// Purpose is empty for access tokens. Tokens issued for a single step of
+	// a flow, such as the second factor of a login, name that step instead.
+	Purpose string
 }
 
 // String implements fmt.Stringer.
 func (c *Claims) String() string {
+	if c.Impersonator != "" {
+		return fmt.Sprintf("<type=Claims,uid=%s,impersonator=%s>", c.UID, c.Impersonator)
+	}
 	return fmt.Sprintf("<type=Claims,uid=%s>", c.UID)
 }
 
@@ -37,35 +64,112 @@ func (e *InvalidTokenError) Error() string {
 	return e.Cause.Error()
 }
 
-var key = []byte(time.Now().Format("20060102150405"))
-
-func SetSigningKey(k string) {
-	key = []byte(k)
-}
-
-var ErrInvalidSigningMethod = errors.New("invalid signing method")
+var (
+	ErrInvalidSigningMethod = errors.New("invalid signing method")
+	ErrUnknownKey           = errors.New("unknown or expired signing key")
+)
 
 var (
-	// TokenExpiration is set to twenty four hours.
-	TokenExpiration = time.Hour * 24
+	// TokenExpiration is set to fifteen minutes. Clients are expected to use
+	// their refresh token to get a new access token.
+	TokenExpiration = time.Minute * 15
 
-	// OverrideExpiration is set to one day for troubleshooting.
+	// OverrideExpiration is set to four hours for troubleshooting.
 	OverrideExpiration = time.Hour * 4
+
+	// RefreshExpiration is how long a refresh token can be used for.
+	RefreshExpiration = time.Hour * 24 * 30
+
+	// ChallengeExpiration is how long a user has to provide their second
+	// factor after their password was accepted.
+	ChallengeExpiration = time.Minute * 5
+
+	// ResetExpiration is how long a password reset link can be used for.
+	ResetExpiration = time.Hour
+
+	// MagicLinkExpiration is how long a magic login link can be used for.
+	MagicLinkExpiration = time.Minute * 15
+
+	// InviteExpiration is how long a new user has to accept their invitation.
+	InviteExpiration = time.Hour * 24 * 7
+)
+
+// TypeAccess is the typ claim of access tokens. Purpose tokens are signed with
+// the same published keys, so services verifying tokens against the JWKS must
+// require this claim, or they would accept an MFA challenge or a magic link as
+// an access token.
+const TypeAccess = "access"
+
+// PurposeMFA marks the challenge token returned when the password step of a
+// login succeeds and a second factor is still required.
+const PurposeMFA = "mfa"
+
+// PurposeMagicLink marks the token sent in a magic login link, which can be
+// exchanged once for an access token.
+const PurposeMagicLink = "magiclink"
+
+const (
+	// RefreshTokenLength is the number of random bytes in a refresh token.
+	RefreshTokenLength = 32
+
+	// ResetTokenLength is the number of random bytes in a password reset
+	// token.
+	ResetTokenLength = 32
+
+	// InviteTokenLength is the number of random bytes in an invite token.
+	InviteTokenLength = 32
+
+	// APIKeyLength is the number of random bytes in an API key.
+	APIKeyLength = 32
+
+	// APIKeyPrefix starts every API key, so that leaked keys are easy to spot.
+	APIKeyPrefix = "npk_"
 )
 
-// New creates a new JWT with the given claims, passed as key/value pairs. It
-// also sets an expiration time, at present this is 24 hours from issue.
-func New(uid string, override string) (string, error) {
-	cm := jwt.MapClaims{"sub": uid}
+// New creates a new JWT for the user with the given token generation. It also
+// sets an expiration time, at present this is 15 minutes from issue. If
+// override is set, it is the ID of an admin impersonating the user, and the
+// token lasts for OverrideExpiration instead.
+func New(uid string, override string, gen int) (string, error) {
+	cm := jwt.MapClaims{
+		"sub": uid,
+		"jti": uuid.New(),
+		"gen": gen,
+		"typ": TypeAccess,
+		"iat": time.Now().Unix(),
+	}
 	if override != "" {
 		cm["ovr"] = override
 		cm["exp"] = int64(time.Now().Add(OverrideExpiration).Unix())
 	} else {
 		cm["exp"] = int64(time.Now().Add(TokenExpiration).Unix())
 	}
-	t := jwt.NewWithClaims(jwt.SigningMethodHS256, cm)
+	return sign(cm)
+}
+
+// NewPurpose creates a short-lived JWT that can only be used for the given
+// purpose. It has no typ claim and is rejected by Parse, so it can never be
+// used as an access token.
+func NewPurpose(uid string, purpose string, gen int, ttl time.Duration) (string, error) {
+	if purpose == "" {
+		return "", errors.New("purpose is required")
+	}
+	return sign(jwt.MapClaims{
+		"sub": uid,
+		"jti": uuid.New(),
+		"gen": gen,
+		"pur": purpose,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(ttl).Unix(),
+	})
+}
+
+func sign(cm jwt.MapClaims) (string, error) {
+	k := keys.Active()
+	t := jwt.NewWithClaims(k.method(), cm)
+	t.Header["kid"] = k.ID
 
-	tok, err := t.SignedString(key)
+	tok, err := t.SignedString(k.signingKey())
 	if err != nil {
 		return "", &TokenError{Cause: err, Claims: cm}
 	}
@@ -74,18 +178,40 @@ func New(uid string, override string) (string, error) {
 }
 
 // Parse takes a JWT string and returns the claims existing on the JWT. The
-// token must be valid and signed with the correct key.
+// token must be valid and signed with the key named by its kid header, which
+// must be the active key or a retired key within its grace period. Only access
+// tokens, which carry the TypeAccess typ claim, are accepted, see ParsePurpose.
 func Parse(h string) (*Claims, error) {
+	return parse(h, "")
+}
+
+// ParsePurpose is like Parse, but only accepts tokens created by NewPurpose for
+// the given purpose.
+func ParsePurpose(h string, purpose string) (*Claims, error) {
+	if purpose == "" {
+		return nil, &InvalidTokenError{errors.New("purpose is required")}
+	}
+	return parse(h, purpose)
+}
+
+func parse(h string, purpose string) (*Claims, error) {
 	enc := strings.TrimPrefix(h, "Bearer ")
 
 	// jwt.Parse takes the string representation of the token and a function
 	// returning our signing key if the token is valid, or an error otherwise.
 	t, err := jwt.Parse(enc, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, ErrInvalidSigningMethod
+		kid, _ := t.Header["kid"].(string)
+		k, ok := keys.Lookup(kid)
+		if !ok {
+			return nil, ErrUnknownKey
 		}
 
-		return key, nil
+		// The algorithm is fixed by the key, never by the token, so that a
+		// public key can't be used as an HMAC secret.
+		if t.Method.Alg() != k.method().Alg() {
+			return nil, ErrInvalidSigningMethod
+		}
+		return k.verifyingKey(), nil
 	})
 
 	if err != nil {
@@ -107,10 +233,87 @@ func Parse(h string) (*Claims, error) {
 	if c.UID, err = getStringClaim(claims, "sub"); err != nil {
 		return nil, &InvalidTokenError{err}
 	}
+	if c.ID, err = getStringClaim(claims, "jti"); err != nil {
+		return nil, &InvalidTokenError{err}
+	}
+	// Numbers are decoded as float64 by encoding/json.
+	gen, ok := claims["gen"].(float64)
+	if !ok {
+		return nil, &InvalidTokenError{errors.Errorf("claim missing or of invalid type: gen")}
+	}
+	c.Generation = int(gen)
+	if exp, ok := claims["exp"].(float64); ok {
+		c.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+	c.Impersonator, _ = claims["ovr"].(string)
+	c.Purpose, _ = claims["pur"].(string)
+	if typ, _ := claims["typ"].(string); purpose == "" && typ != TypeAccess {
+		return nil, &InvalidTokenError{errors.Errorf("token type %q is not %q", typ, TypeAccess)}
+	}
+	if c.Purpose != purpose {
+		return nil, &InvalidTokenError{errors.Errorf("token purpose %q is not %q", c.Purpose, purpose)}
+	}
 
 	return &c, nil
 }
 
+// NewRefresh returns a new opaque refresh token along with its hash. Only the
+// hash should be stored, the token itself is handed to the client.
+func NewRefresh() (string, string, error) {
+	t, err := opaque(RefreshTokenLength)
+	if err != nil {
+		return "", "", errors.Wrap(err, "could not generate refresh token")
+	}
+	return t, Hash(t), nil
+}
+
+// NewAPIKey returns a new API key along with its hash. As with refresh tokens,
+// only the hash should be stored.
+func NewAPIKey() (string, string, error) {
+	t, err := opaque(APIKeyLength)
+	if err != nil {
+		return "", "", errors.Wrap(err, "could not generate api key")
+	}
+	t = APIKeyPrefix + t
+	return t, Hash(t), nil
+}
+
+// NewReset returns a new password reset token along with its hash. Only the
+// hash is stored, the token itself is sent to the user.
+func NewReset() (string, string, error) {
+	t, err := opaque(ResetTokenLength)
+	if err != nil {
+		return "", "", errors.Wrap(err, "could not generate reset token")
+	}
+	return t, Hash(t), nil
+}
+
+// NewInvite returns a new invite token along with its hash. Only the hash is
+// stored, the token itself is sent to the invitee. Invites outlive the signing
+// keys, so unlike the tokens that log a user in they are not signed.
+func NewInvite() (string, string, error) {
+	t, err := opaque(InviteTokenLength)
+	if err != nil {
+		return "", "", errors.Wrap(err, "could not generate invite token")
+	}
+	return t, Hash(t), nil
+}
+
+func opaque(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Hash returns the hex encoded SHA-256 hash of an opaque token. Opaque tokens
+// carry enough entropy that a fast hash is sufficient to store them safely.
+func Hash(t string) string {
+	sum := sha256.Sum256([]byte(t))
+	return hex.EncodeToString(sum[:])
+}
+
 func getStringClaim(claims jwt.MapClaims, claim string) (string, error) {
 	s, ok := claims[claim].(string)
 	if !ok {
@@ -0,0 +1,298 @@
+package token_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/kmhebb/serverExample/internal/assert"
+	"github.com/kmhebb/serverExample/lib/token"
+)
+
+func TestNewParse(t *testing.T) {
+	assert := assert.New(t)
+	token.SetSigningKey("test")
+
+	a, err := token.New("uid", "", 3)
+	assert.OK(err)
+	b, err := token.New("uid", "", 3)
+	assert.OK(err)
+
+	ca, err := token.Parse(a)
+	assert.OK(err)
+	cb, err := token.Parse(b)
+	assert.OK(err)
+
+	assert.Equals(ca.UID, "uid")
+	assert.Equals(ca.Generation, 3)
+	assert.NotEmpty(ca.ID)
+	assert.True(ca.ID != cb.ID)
+	assert.False(ca.ExpiresAt.IsZero())
+	assert.Equals(ca.Impersonator, "")
+}
+
+func TestImpersonation(t *testing.T) {
+	assert := assert.New(t)
+	token.SetSigningKey("test")
+
+	tok, err := token.New("uid", "admin", 0)
+	assert.OK(err)
+
+	c, err := token.Parse(tok)
+	assert.OK(err)
+	assert.Equals(c.UID, "uid")
+	assert.Equals(c.Impersonator, "admin")
+	assert.True(time.Until(c.ExpiresAt) > token.TokenExpiration)
+}
+
+func TestNewRefresh(t *testing.T) {
+	assert := assert.New(t)
+
+	tok, hash, err := token.NewRefresh()
+	assert.OK(err)
+	assert.Equals(token.Hash(tok), hash)
+	assert.True(tok != hash)
+
+	other, _, err := token.NewRefresh()
+	assert.OK(err)
+	assert.True(tok != other)
+}
+
+func TestNewReset(t *testing.T) {
+	assert := assert.New(t)
+
+	tok, hash, err := token.NewReset()
+	assert.OK(err)
+	assert.Equals(token.Hash(tok), hash)
+
+	other, otherHash, err := token.NewReset()
+	assert.OK(err)
+	assert.True(tok != other)
+	assert.True(hash != otherHash)
+}
+
+func TestNewInvite(t *testing.T) {
+	assert := assert.New(t)
+
+	tok, hash, err := token.NewInvite()
+	assert.OK(err)
+	assert.Equals(token.Hash(tok), hash)
+
+	// Invite tokens are opaque, so they can't be parsed as a signed token.
+	_, err = token.ParsePurpose(tok, token.PurposeMagicLink)
+	assert.NotNil(err)
+}
+
+func TestKeyRotation(t *testing.T) {
+	assert := assert.New(t)
+
+	kr := token.NewKeyring(token.Key{ID: "old", Secret: "old-secret"})
+	token.SetKeyring(kr)
+	defer token.SetSigningKey("test")
+
+	old, err := token.New("uid", "", 0)
+	assert.OK(err)
+
+	// Tokens signed with a retired key are accepted during the grace period.
+	kr.Rotate(token.Key{ID: "new", Secret: "new-secret"}, time.Hour)
+	_, err = token.Parse(old)
+	assert.OK(err)
+
+	current, err := token.New("uid", "", 0)
+	assert.OK(err)
+	_, err = token.Parse(current)
+	assert.OK(err)
+
+	// And rejected once it has ended.
+	kr.Retire(token.Key{ID: "old", Secret: "old-secret"}, time.Now().Add(-time.Second))
+	_, err = token.Parse(old)
+	assert.NotNil(err)
+
+	// Tokens naming a key we have never had are rejected.
+	token.SetKeyring(token.NewKeyring(token.Key{ID: "other", Secret: "new-secret"}))
+	_, err = token.Parse(current)
+	assert.NotNil(err)
+}
+
+func TestParseKeys(t *testing.T) {
+	assert := assert.New(t)
+
+	keys, err := token.ParseKeys("a:one, b:two:three,")
+	assert.OK(err)
+	assert.Equals(keys, []token.Key{{ID: "a", Secret: "one"}, {ID: "b", Secret: "two:three"}})
+
+	keys, err = token.ParseKeys("")
+	assert.OK(err)
+	assert.Equals(len(keys), 0)
+
+	_, err = token.ParseKeys("nosecret")
+	assert.NotNil(err)
+}
+
+func TestAsymmetricKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer token.SetSigningKey("test")
+
+	for name, tc := range map[string]struct {
+		key token.Key
+		alg string
+		kty string
+	}{
+		"RS256": {
+			key: token.Key{ID: "rsa", Private: rsaKey},
+			alg: "RS256",
+			kty: "RSA",
+		},
+		"EdDSA": {
+			key: token.Key{ID: "ed", Private: edKey},
+			alg: "EdDSA",
+			kty: "OKP",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			token.SetKeyring(token.NewKeyring(tc.key))
+
+			tok, err := token.New("uid", "", 0)
+			assert.OK(err)
+			c, err := token.Parse(tok)
+			assert.OK(err)
+			assert.Equals(c.UID, "uid")
+
+			jwks := token.PublicKeys()
+			assert.Equals(len(jwks.Keys), 1)
+			assert.Equals(jwks.Keys[0].Kid, tc.key.ID)
+			assert.Equals(jwks.Keys[0].Alg, tc.alg)
+			assert.Equals(jwks.Keys[0].Kty, tc.kty)
+		})
+	}
+}
+
+func TestParseRejectsAlgorithmMismatch(t *testing.T) {
+	assert := assert.New(t)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.OK(err)
+	token.SetKeyring(token.NewKeyring(token.Key{ID: "ed", Private: edKey}))
+	defer token.SetSigningKey("test")
+
+	// A token signed with HS256 using the public key as the secret must not
+	// verify against the asymmetric key.
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": "uid",
+		"jti": "id",
+		"gen": 0,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	forged.Header["kid"] = "ed"
+	tok, err := forged.SignedString([]byte(edKey.Public().(ed25519.PublicKey)))
+	assert.OK(err)
+
+	_, err = token.Parse(tok)
+	assert.NotNil(err)
+}
+
+func TestNewKeyFromFile(t *testing.T) {
+	assert := assert.New(t)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.OK(err)
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	assert.OK(err)
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	assert.OK(ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	k, err := token.NewKey("ed", "@"+path)
+	assert.OK(err)
+	assert.Equals(k.Private, edKey)
+
+	k, err = token.NewKey("hs", "secret")
+	assert.OK(err)
+	assert.Equals(k.Secret, "secret")
+
+	_, err = token.NewKey("missing", "@"+path+".missing")
+	assert.NotNil(err)
+}
+
+func TestPurpose(t *testing.T) {
+	assert := assert.New(t)
+	token.SetSigningKey("test")
+
+	challenge, err := token.NewPurpose("uid", token.PurposeMFA, 2, time.Minute)
+	assert.OK(err)
+	access, err := token.New("uid", "", 2)
+	assert.OK(err)
+
+	c, err := token.ParsePurpose(challenge, token.PurposeMFA)
+	assert.OK(err)
+	assert.Equals(c.UID, "uid")
+	assert.Equals(c.Generation, 2)
+	assert.Equals(c.Purpose, token.PurposeMFA)
+
+	// Purpose tokens are not access tokens, and the other way around.
+	_, err = token.Parse(challenge)
+	assert.NotNil(err)
+	_, err = token.ParsePurpose(access, token.PurposeMFA)
+	assert.NotNil(err)
+	_, err = token.ParsePurpose(challenge, "other")
+	assert.NotNil(err)
+
+	// A magic link can't stand in for a second factor challenge.
+	link, err := token.NewPurpose("uid", token.PurposeMagicLink, 2, token.MagicLinkExpiration)
+	assert.OK(err)
+	_, err = token.ParsePurpose(link, token.PurposeMFA)
+	assert.NotNil(err)
+	c, err = token.ParsePurpose(link, token.PurposeMagicLink)
+	assert.OK(err)
+	assert.True(c.ID != "")
+
+	// Nor can a challenge be used to log in through a magic link.
+	_, err = token.ParsePurpose(challenge, token.PurposeMagicLink)
+	assert.NotNil(err)
+
+	expired, err := token.NewPurpose("uid", token.PurposeMFA, 2, -time.Minute)
+	assert.OK(err)
+	_, err = token.ParsePurpose(expired, token.PurposeMFA)
+	assert.NotNil(err)
+}
+
+func TestParseRequiresAccessType(t *testing.T) {
+	assert := assert.New(t)
+	token.SetKeyring(token.NewKeyring(token.Key{ID: "hs", Secret: "test"}))
+	defer token.SetSigningKey("test")
+
+	claims := jwt.MapClaims{
+		"sub": "uid",
+		"jti": "id",
+		"gen": 0,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	untyped := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	untyped.Header["kid"] = "hs"
+	tok, err := untyped.SignedString([]byte("test"))
+	assert.OK(err)
+	_, err = token.Parse(tok)
+	assert.NotNil(err)
+
+	claims["typ"] = token.TypeAccess
+	typed := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	typed.Header["kid"] = "hs"
+	tok, err = typed.SignedString([]byte("test"))
+	assert.OK(err)
+	_, err = token.Parse(tok)
+	assert.OK(err)
+}
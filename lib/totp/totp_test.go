@@ -0,0 +1,82 @@
+package totp_test
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/kmhebb/serverExample/internal/assert"
+	"github.com/kmhebb/serverExample/lib/totp"
+)
+
+// The test key from RFC 4226 and RFC 6238.
+var key = []byte("12345678901234567890")
+
+func TestHOTP(t *testing.T) {
+	assert := assert.New(t)
+
+	// RFC 4226 appendix D.
+	for counter, want := range []string{
+		"755224", "287082", "359152", "969429", "338314",
+		"254676", "287922", "162583", "399871", "520489",
+	} {
+		assert.Equals(totp.HOTP(key, uint64(counter), 6), want)
+	}
+}
+
+func TestRFC6238(t *testing.T) {
+	assert := assert.New(t)
+
+	// RFC 6238 appendix B, SHA1 only.
+	for unix, want := range map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	} {
+		step := totp.Step(time.Unix(unix, 0))
+		assert.Equals(totp.HOTP(key, uint64(step), 8), want)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+	secret, err := totp.NewSecret()
+	assert.OK(err)
+
+	now := time.Now()
+	code, err := totp.Code(secret, now)
+	assert.OK(err)
+
+	step, ok, err := totp.Validate(secret, code, now)
+	assert.OK(err)
+	assert.True(ok)
+	assert.Equals(step, totp.Step(now))
+
+	// Codes from the neighbouring periods are accepted to allow for drift.
+	_, ok, err = totp.Validate(secret, code, now.Add(totp.Period))
+	assert.OK(err)
+	assert.True(ok)
+
+	// But not from further away.
+	_, ok, err = totp.Validate(secret, code, now.Add(3*totp.Period))
+	assert.OK(err)
+	assert.False(ok)
+
+	_, _, err = totp.Validate("not base32!", code, now)
+	assert.NotNil(err)
+}
+
+func TestProvisioningURI(t *testing.T) {
+	assert := assert.New(t)
+
+	u, err := url.Parse(totp.ProvisioningURI("JBSWY3DPEHPK3PXP", "Cloud", "a@b.c"))
+	assert.OK(err)
+	assert.Equals(u.Scheme, "otpauth")
+	assert.Equals(u.Host, "totp")
+	assert.Equals(u.Path, "/Cloud:a@b.c")
+	assert.Equals(u.Query().Get("secret"), "JBSWY3DPEHPK3PXP")
+	assert.Equals(u.Query().Get("issuer"), "Cloud")
+}
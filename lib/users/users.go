@@ -10,7 +10,7 @@ import (
 func NewUser(email string, firstName string, lastName string) (*cloud.User, error) {
 	var user cloud.User
 
-	user.DateCreated = string(time.Now().Format("1/2/2006"))
+	user.DateCreated = time.Now()
 	user.Email = email
 	user.FirstName = firstName
 	user.LastName = lastName
@@ -26,8 +26,6 @@ func ResetPassword(u cloud.User) (string, error) {
 
 	u.MustChange = true
 	u.PasswordHash = hash
-	u.ResetToken = ""
-	u.ResetTokenExpiration = ""
 
 	return password, nil
 }
@@ -0,0 +1,8 @@
+-- Roles determine which actions a user may perform. Every user that existed
+-- before roles were introduced could perform every action, so they start out
+-- as admins and should be demoted as appropriate. New users default to viewer.
+ALTER TABLE users.profile ADD COLUMN IF NOT EXISTS role text;
+UPDATE users.profile SET role = 'admin' WHERE role IS NULL;
+ALTER TABLE users.profile ALTER COLUMN role SET DEFAULT 'viewer';
+ALTER TABLE users.profile ALTER COLUMN role SET NOT NULL;
+ALTER TABLE users.profile ADD CONSTRAINT profile_role_check CHECK (role IN ('admin', 'operator', 'viewer'));
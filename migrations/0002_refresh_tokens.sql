@@ -0,0 +1,24 @@
+-- Every access token carries the user's token generation at issue. Bumping the
+-- generation invalidates all outstanding access tokens for the user.
+ALTER TABLE users.profile ADD COLUMN IF NOT EXISTS token_generation integer NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS users.refresh_token (
+	id uuid PRIMARY KEY,
+	user_id uuid NOT NULL REFERENCES users.profile (id) ON DELETE CASCADE,
+	token_hash text NOT NULL UNIQUE,
+	family_id uuid NOT NULL,
+	expires_at timestamptz NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT NOW(),
+	used_at timestamptz,
+	revoked_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS refresh_token_user_id_idx ON users.refresh_token (user_id);
+CREATE INDEX IF NOT EXISTS refresh_token_family_id_idx ON users.refresh_token (family_id);
+
+-- Individually revoked access tokens, e.g. on logout. Rows can be deleted once
+-- the token has expired.
+CREATE TABLE IF NOT EXISTS users.revoked_token (
+	jti text PRIMARY KEY,
+	user_id uuid NOT NULL,
+	expires_at timestamptz NOT NULL
+);
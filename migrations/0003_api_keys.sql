@@ -0,0 +1,12 @@
+-- API keys for machine clients. Only a hash of each key is stored.
+CREATE TABLE IF NOT EXISTS users.api_key (
+	id uuid PRIMARY KEY,
+	name text NOT NULL,
+	key_prefix text NOT NULL,
+	key_hash text NOT NULL UNIQUE,
+	scopes text[] NOT NULL DEFAULT '{}',
+	created_by uuid NOT NULL REFERENCES users.profile (id),
+	created_at timestamptz NOT NULL DEFAULT NOW(),
+	last_used_at timestamptz,
+	revoked_at timestamptz
+);
@@ -0,0 +1,5 @@
+-- Failed login tracking. A user is locked out until locked_until after too
+-- many failed attempts in a row.
+ALTER TABLE users.profile ADD COLUMN IF NOT EXISTS failed_logins integer NOT NULL DEFAULT 0;
+ALTER TABLE users.profile ADD COLUMN IF NOT EXISTS last_failed_login timestamptz;
+ALTER TABLE users.profile ADD COLUMN IF NOT EXISTS locked_until timestamptz;
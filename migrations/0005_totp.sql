@@ -0,0 +1,14 @@
+-- TOTP second factor. totp_last_step is the time step of the last accepted
+-- code, so that a code can't be used twice.
+ALTER TABLE users.profile ADD COLUMN IF NOT EXISTS totp_secret text NOT NULL DEFAULT '';
+ALTER TABLE users.profile ADD COLUMN IF NOT EXISTS totp_enabled boolean NOT NULL DEFAULT false;
+ALTER TABLE users.profile ADD COLUMN IF NOT EXISTS totp_last_step bigint NOT NULL DEFAULT 0;
+
+-- Single-use recovery codes for users who lose their authenticator. Only a
+-- hash of each code is stored.
+CREATE TABLE IF NOT EXISTS users.recovery_code (
+	user_id uuid NOT NULL REFERENCES users.profile (id) ON DELETE CASCADE,
+	code_hash text NOT NULL,
+	used_at timestamptz,
+	PRIMARY KEY (user_id, code_hash)
+);
@@ -0,0 +1,9 @@
+-- Hashes of users' earlier passwords, so that the password policy can refuse
+-- reuse. Only as many as the policy needs are kept.
+CREATE TABLE IF NOT EXISTS users.password_history (
+	id bigserial PRIMARY KEY,
+	user_id uuid NOT NULL REFERENCES users.profile (id) ON DELETE CASCADE,
+	passhash text NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS password_history_user_id_idx ON users.password_history (user_id, id);
@@ -0,0 +1,14 @@
+-- Password reset tokens are stored hashed, and can only be used once before
+-- they expire. Issuing a new token replaces any unused one.
+CREATE TABLE IF NOT EXISTS users.password_reset (
+	token_hash text PRIMARY KEY,
+	user_id uuid NOT NULL REFERENCES users.profile (id) ON DELETE CASCADE,
+	expires_at timestamptz NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT NOW(),
+	used_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS password_reset_user_id_idx ON users.password_reset (user_id);
+
+-- Reset tokens used to be stored in the clear on the profile. Those are no
+-- longer accepted, so they are cleared rather than left lying around.
+UPDATE users.profile SET resettoken = '', resettokenexpiration = '' WHERE resettoken <> '';
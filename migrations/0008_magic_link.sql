@@ -0,0 +1,4 @@
+-- Users opt in to logging in through magic links sent to their email. The
+-- links are single-use, and used links are kept in users.revoked_token until
+-- they expire.
+ALTER TABLE users.profile ADD COLUMN IF NOT EXISTS magic_link_enabled boolean NOT NULL DEFAULT false;
@@ -0,0 +1,9 @@
+-- Logins through the OpenID Connect provider that have been started but not
+-- finished. Each state can be used once, and only until it expires.
+CREATE TABLE IF NOT EXISTS users.oidc_state (
+	state text PRIMARY KEY,
+	nonce text NOT NULL,
+	verifier text NOT NULL,
+	expires_at timestamptz NOT NULL,
+	created_at timestamptz NOT NULL DEFAULT NOW()
+);
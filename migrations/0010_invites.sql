@@ -0,0 +1,13 @@
+-- Invitations for new users to choose their password. They replace the
+-- temporary passwords new users used to be sent.
+CREATE TABLE IF NOT EXISTS users.invite (
+	id uuid PRIMARY KEY,
+	user_id uuid NOT NULL REFERENCES users.profile (id) ON DELETE CASCADE,
+	token_hash text NOT NULL UNIQUE,
+	invited_by uuid,
+	created_at timestamptz NOT NULL DEFAULT NOW(),
+	expires_at timestamptz NOT NULL,
+	accepted_at timestamptz,
+	revoked_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS invite_user_id_idx ON users.invite (user_id);
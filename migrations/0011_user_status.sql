@@ -0,0 +1,8 @@
+-- Where each user is in their lifecycle. Only active users can log in.
+-- Existing users are active, except those who have not yet accepted their
+-- invite.
+ALTER TABLE users.profile ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'active'
+	CHECK (status IN ('invited', 'active', 'disabled', 'locked', 'deleted'));
+UPDATE users.profile p SET status = 'invited'
+	WHERE p.passhash = '' AND EXISTS (SELECT 1 FROM users.invite i WHERE i.user_id = p.id AND i.accepted_at IS NULL);
+CREATE INDEX IF NOT EXISTS profile_status_idx ON users.profile (status);
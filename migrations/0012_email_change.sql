@@ -0,0 +1,12 @@
+-- Email changes waiting to be confirmed with the code sent to the new address.
+-- Each user has at most one, and it only applies until it expires. They
+-- replace cache.validation.
+CREATE TABLE IF NOT EXISTS users.email_change (
+	user_id uuid PRIMARY KEY REFERENCES users.profile (id) ON DELETE CASCADE,
+	new_email text NOT NULL,
+	code_hash text NOT NULL,
+	attempts integer NOT NULL DEFAULT 0,
+	created_at timestamptz NOT NULL DEFAULT NOW(),
+	expires_at timestamptz NOT NULL
+);
+DROP TABLE IF EXISTS cache.validation;
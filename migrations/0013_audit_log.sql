@@ -0,0 +1,22 @@
+-- Every action that changed a user or the billing data: who performed it, on
+-- what, what changed and whether it succeeded. IDs are kept as text, since
+-- targets such as customer numbers are not uuids, and entries outlive the
+-- users and keys they name.
+CREATE SCHEMA IF NOT EXISTS audit;
+CREATE TABLE IF NOT EXISTS audit.entry (
+	id uuid PRIMARY KEY,
+	at timestamptz NOT NULL DEFAULT NOW(),
+	actor_id text NOT NULL DEFAULT '',
+	impersonator_id text NOT NULL DEFAULT '',
+	api_key_id text NOT NULL DEFAULT '',
+	action text NOT NULL,
+	target_type text NOT NULL,
+	target_id text NOT NULL DEFAULT '',
+	request_id text NOT NULL DEFAULT '',
+	changes jsonb,
+	outcome text NOT NULL CHECK (outcome IN ('succeeded', 'failed')),
+	error text NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS entry_at_idx ON audit.entry (at, id);
+CREATE INDEX IF NOT EXISTS entry_actor_idx ON audit.entry (actor_id, at);
+CREATE INDEX IF NOT EXISTS entry_target_idx ON audit.entry (target_type, target_id, at);
@@ -0,0 +1,33 @@
+-- User dates used to be text formatted as 1/2/2006, some with a 15:04 time,
+-- which could not be sorted or compared. They become timestamps, read in the
+-- database's time zone as the server wrote them. Blank dates are unknown:
+-- users with no activity have never been active, and profiles with no creation
+-- date take the time of this migration.
+ALTER TABLE users.profile
+	ALTER COLUMN datecreated DROP DEFAULT,
+	ALTER COLUMN datemodified DROP DEFAULT,
+	ALTER COLUMN lastactivity DROP DEFAULT,
+	ALTER COLUMN resettokenexpiration DROP DEFAULT;
+ALTER TABLE users.profile
+	ALTER COLUMN datecreated TYPE timestamptz USING CASE
+		WHEN btrim(datecreated) = '' THEN NULL
+		WHEN datecreated LIKE '% %' THEN to_timestamp(datecreated, 'MM/DD/YYYY HH24:MI')
+		ELSE to_timestamp(datecreated, 'MM/DD/YYYY') END,
+	ALTER COLUMN datemodified TYPE timestamptz USING CASE
+		WHEN btrim(datemodified) = '' THEN NULL
+		WHEN datemodified LIKE '% %' THEN to_timestamp(datemodified, 'MM/DD/YYYY HH24:MI')
+		ELSE to_timestamp(datemodified, 'MM/DD/YYYY') END,
+	ALTER COLUMN lastactivity TYPE timestamptz USING CASE
+		WHEN btrim(lastactivity) = '' THEN NULL
+		WHEN lastactivity LIKE '% %' THEN to_timestamp(lastactivity, 'MM/DD/YYYY HH24:MI')
+		ELSE to_timestamp(lastactivity, 'MM/DD/YYYY') END,
+	-- Reset tokens moved to users.password_reset, and were all cleared.
+	ALTER COLUMN resettokenexpiration TYPE timestamptz USING NULL;
+UPDATE users.profile SET datecreated = COALESCE(datemodified, NOW()) WHERE datecreated IS NULL;
+UPDATE users.profile SET datemodified = datecreated WHERE datemodified IS NULL;
+ALTER TABLE users.profile
+	ALTER COLUMN datecreated SET DEFAULT NOW(),
+	ALTER COLUMN datecreated SET NOT NULL,
+	ALTER COLUMN datemodified SET DEFAULT NOW(),
+	ALTER COLUMN datemodified SET NOT NULL;
+CREATE INDEX IF NOT EXISTS profile_lastactivity_idx ON users.profile (COALESCE(lastactivity, 'epoch'), id);
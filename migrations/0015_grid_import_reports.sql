@@ -0,0 +1,18 @@
+-- The report of every grid data import, kept with its batch, and the rows it
+-- set aside. Quarantined rows are kept as they were read, along with the
+-- header of their file, so that they can be corrected and imported again.
+CREATE SCHEMA IF NOT EXISTS customer;
+CREATE TABLE IF NOT EXISTS customer.grid_import (
+	upload_id uuid PRIMARY KEY,
+	upload_date timestamptz NOT NULL DEFAULT NOW(),
+	layout text NOT NULL,
+	rule text NOT NULL CHECK (rule IN ('reject', 'quarantine')),
+	header text[] NOT NULL,
+	report jsonb NOT NULL
+);
+CREATE TABLE IF NOT EXISTS customer.grid_quarantine (
+	upload_id uuid NOT NULL REFERENCES customer.grid_import (upload_id) ON DELETE CASCADE,
+	row_number integer NOT NULL,
+	data text[] NOT NULL,
+	PRIMARY KEY (upload_id, row_number)
+);
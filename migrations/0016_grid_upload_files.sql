@@ -0,0 +1,7 @@
+-- Grid data files are kept on disk for traceability once they are imported.
+-- The import records the name the file was uploaded with, where it is kept
+-- and its size.
+ALTER TABLE customer.grid_import
+	ADD COLUMN IF NOT EXISTS file_name text NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS file_path text NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS file_size bigint NOT NULL DEFAULT 0;
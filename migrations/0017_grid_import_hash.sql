@@ -0,0 +1,5 @@
+-- Grid data imports are fingerprinted by the SHA-256 of their file, so that a
+-- file uploaded again is found rather than imported twice.
+ALTER TABLE customer.grid_import
+	ADD COLUMN IF NOT EXISTS file_hash text NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS grid_import_file_hash_idx ON customer.grid_import (file_hash);
@@ -0,0 +1,5 @@
+-- Reset tokens are kept in users.password_reset, so the columns they used to
+-- be stored in on the profile are dropped.
+ALTER TABLE users.profile
+	DROP COLUMN IF EXISTS resettoken,
+	DROP COLUMN IF EXISTS resettokenexpiration;
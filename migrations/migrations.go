@@ -0,0 +1,10 @@
+// Package migrations embeds the SQL migrations that bring the database schema
+// up to date. Files are named with a zero-padded sequence number so that they
+// sort in the order they must be applied, and pg.Database.Migrate applies each
+// file exactly once.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
@@ -0,0 +1,20 @@
+package cloud
+
+const (
+	// DefaultPageLimit is the number of items in a page when the request
+	// doesn't say.
+	DefaultPageLimit = 50
+
+	// MaxPageLimit is the most items a single page can hold.
+	MaxPageLimit = 200
+)
+
+// Paging is the envelope sent alongside every page of a paginated list. Lists
+// are paginated with cursors: NextCursor is sent back to get the page after
+// this one, and is empty on the last page.
+type Paging struct {
+	// Total is the number of items in the whole list, across every page.
+	Total      int    `json:"total"`
+	Limit      int    `json:"limit"`
+	NextCursor string `json:"nextCursor,omitempty"`
+}
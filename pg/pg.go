@@ -3,7 +3,8 @@ package pg
 import (
 	"context"
 	"fmt"
-	"os"
+	"io/fs"
+	"sort"
 
 	"github.com/jackc/pgx/v4"
 
@@ -15,6 +16,7 @@ type Tx interface {
 	Exec(ctx context.Context, query string, args ...interface{}) error
 	Query(ctx context.Context, query string, args ...interface{}) (pgx.Rows, error)
 	QueryRow(ctx context.Context, query string, args ...interface{}) pgx.Row
+	CopyFrom(ctx context.Context, table pgx.Identifier, columns []string, src pgx.CopyFromSource) (int64, error)
 	Commit(ctx context.Context) error
 }
 
@@ -40,7 +42,13 @@ func (tx tx) Query(ctx context.Context, query string, args ...interface{}) (pgx.
 }
 
 func (tx tx) QueryRow(ctx context.Context, query string, args ...interface{}) pgx.Row {
-	return tx.tx.QueryRow(ctx, query, args)
+	return tx.tx.QueryRow(ctx, query, args...)
+}
+
+// CopyFrom bulk loads the rows from src into the table with the COPY protocol.
+// It returns the number of rows copied.
+func (tx tx) CopyFrom(ctx context.Context, table pgx.Identifier, columns []string, src pgx.CopyFromSource) (int64, error) {
+	return tx.tx.CopyFrom(ctx, table, columns, src)
 }
 
 func NewDatabase(ctx context.Context, url string) (*Database, error) {
@@ -59,21 +67,64 @@ type Database struct {
 	conn *pgx.Conn
 }
 
-func (db Database) execFile(ctx context.Context, path string) error {
+func (db Database) execFile(ctx context.Context, tx pgx.Tx, fsys fs.FS, path string) error {
 	log.Debug("running migration", log.Fields{"path": path})
 
-	migration, err := os.ReadFile(path)
+	migration, err := fs.ReadFile(fsys, path)
 	if err != nil {
 		return fmt.Errorf("pg/Database.ExecFile: %w", err)
 	}
 
-	if _, err := db.conn.Exec(ctx, string(migration)); err != nil {
+	if _, err := tx.Exec(ctx, string(migration)); err != nil {
 		return fmt.Errorf("pg/Database.ExecFile: %w", err)
 	}
 
 	return nil
 }
 
+// Migrate applies every .sql file in fsys that has not been applied yet, in
+// lexical order. Each file runs in its own transaction together with the
+// bookkeeping insert, so a failed migration leaves no trace and is retried on
+// the next start.
+func (db *Database) Migrate(ctx context.Context, fsys fs.FS) error {
+	q := `CREATE TABLE IF NOT EXISTS public.schema_migrations (
+		version text PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT NOW()
+	)`
+	if _, err := db.conn.Exec(ctx, q); err != nil {
+		return fmt.Errorf("pg/Database.Migrate: %w", err)
+	}
+
+	paths, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return fmt.Errorf("pg/Database.Migrate: %w", err)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		err := db.conn.BeginFunc(ctx, func(tx pgx.Tx) error {
+			var applied bool
+			q := `SELECT EXISTS (SELECT 1 FROM public.schema_migrations WHERE version = $1)`
+			if err := tx.QueryRow(ctx, q, path).Scan(&applied); err != nil {
+				return err
+			}
+			if applied {
+				return nil
+			}
+			if err := db.execFile(ctx, tx, fsys, path); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `INSERT INTO public.schema_migrations (version) VALUES ($1)`, path)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("pg/Database.Migrate: %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
 func (db *Database) Close(ctx context.Context) error {
 	if err := db.conn.Close(ctx); err != nil {
 		return fmt.Errorf("pg/Database.Close: %w", err)
@@ -1,15 +1,139 @@
 package cloud
 
+import "time"
+
+// Role determines which Actions a user is allowed to perform.
+type Role string
+
+const (
+	RoleAdmin    Role = "admin"
+	RoleOperator Role = "operator"
+	RoleViewer   Role = "viewer"
+
+	// DefaultRole is assigned to new users unless another role is requested.
+	DefaultRole = RoleViewer
+)
+
+// Valid reports whether r is one of the known roles.
+func (r Role) Valid() bool {
+	switch r {
+	case RoleAdmin, RoleOperator, RoleViewer:
+		return true
+	}
+	return false
+}
+
+// UserStatus is where a user is in their lifecycle. Only active users can log
+// in.
+type UserStatus string
+
+const (
+	// StatusInvited users have been created by an admin but have not accepted
+	// their invite, so they have no password yet.
+	StatusInvited  UserStatus = "invited"
+	StatusActive   UserStatus = "active"
+	StatusDisabled UserStatus = "disabled"
+
+	// StatusLocked users have been locked by an admin until they are
+	// unlocked. It is separate from the lockout after failed logins, which
+	// ends on its own.
+	StatusLocked UserStatus = "locked"
+
+	// StatusDeleted users are kept for their history, but can't be used again.
+	StatusDeleted UserStatus = "deleted"
+)
+
+// statusTransitions lists the statuses a user can be moved to from each status.
+var statusTransitions = map[UserStatus][]UserStatus{
+	StatusInvited:  {StatusActive, StatusDeleted},
+	StatusActive:   {StatusDisabled, StatusLocked, StatusDeleted},
+	StatusDisabled: {StatusActive, StatusDeleted},
+	StatusLocked:   {StatusActive, StatusDisabled, StatusDeleted},
+}
+
+// Valid reports whether s is one of the known statuses.
+func (s UserStatus) Valid() bool {
+	switch s {
+	case StatusInvited, StatusActive, StatusDisabled, StatusLocked, StatusDeleted:
+		return true
+	}
+	return false
+}
+
+// CanBecome reports whether a user can be moved from status s to status to.
+func (s UserStatus) CanBecome(to UserStatus) bool {
+	for _, next := range statusTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
 type User struct {
-	ID                   string `json:"id" db:"id"`
-	Email                string `json:"email" db:"email"`
-	FirstName            string `json:"firstName" db:"firstname"`
-	LastName             string `json:"lastName" db:"lastname"`
-	PasswordHash         string `json:"-" db:"passhash"`
-	MustChange           bool   `json:"mustChange" db:"mustchange"`
-	DateCreated          string `json:"dateCreated" db:"datecreated"`
-	DateModified         string `json:"dateModified" db:"datemodified"`
-	LastActivity         string `json:"lastActivity" db:"lastactivity"`
-	ResetToken           string `json:"-" db:"resettoken"`
-	ResetTokenExpiration string `json:"-" db:"resettokenexpiration"`
+	ID              string `json:"id" db:"id"`
+	Email           string `json:"email" db:"email"`
+	FirstName       string `json:"firstName" db:"firstname"`
+	LastName        string `json:"lastName" db:"lastname"`
+	PasswordHash    string `json:"-" db:"passhash"`
+	MustChange      bool   `json:"mustChange" db:"mustchange"`
+	Role            Role   `json:"role" db:"role"`
+	TokenGeneration int    `json:"-" db:"token_generation"`
+
+	// Timestamps are encoded in JSON as RFC 3339. LastActivity is nil for
+	// users who have never been active.
+	DateCreated  time.Time  `json:"dateCreated" db:"datecreated"`
+	DateModified time.Time  `json:"dateModified" db:"datemodified"`
+	LastActivity *time.Time `json:"lastActivity" db:"lastactivity"`
+
+	// FailedLogins counts the failed login attempts since the last successful
+	// login. Once it reaches the lockout threshold, the user can't log in
+	// until LockedUntil.
+	FailedLogins int        `json:"failedLogins" db:"failed_logins"`
+	LockedUntil  *time.Time `json:"lockedUntil" db:"locked_until"`
+
+	// Users with TOTPEnabled need a code from their authenticator, as well as
+	// their password, to log in.
+	TOTPSecret   string `json:"-" db:"totp_secret"`
+	TOTPEnabled  bool   `json:"totpEnabled" db:"totp_enabled"`
+	TOTPLastStep int64  `json:"-" db:"totp_last_step"`
+
+	// Users with MagicLinkEnabled can log in through a link sent to their
+	// email, instead of with their password.
+	MagicLinkEnabled bool `json:"magicLinkEnabled" db:"magic_link_enabled"`
+
+	// Status is where the user is in their lifecycle.
+	Status UserStatus `json:"status" db:"status"`
+}
+
+// Locked reports whether the user is locked out at the given time.
+func (u *User) Locked(at time.Time) bool {
+	return u.LockedUntil != nil && at.Before(*u.LockedUntil)
+}
+
+// RefreshToken is a long-lived, single-use credential that can be exchanged for
+// a new access token. Only the hash of the token is stored. Every refresh
+// token issued by rotating another one shares its FamilyID, so that reuse of a
+// rotated token can revoke the whole chain.
+type RefreshToken struct {
+	ID        string     `db:"id"`
+	UserID    string     `db:"user_id"`
+	Hash      string     `db:"token_hash"`
+	FamilyID  string     `db:"family_id"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	CreatedAt time.Time  `db:"created_at"`
+	UsedAt    *time.Time `db:"used_at"`
+	RevokedAt *time.Time `db:"revoked_at"`
+}
+
+// EmailChange is a change of a user's email that is waiting for the user to
+// confirm the new address, with the code sent to it, before it expires. Only
+// the hash of the code is stored.
+type EmailChange struct {
+	UserID    string    `db:"user_id"`
+	Email     string    `db:"new_email"`
+	Hash      string    `db:"code_hash"`
+	Attempts  int       `db:"attempts"`
+	CreatedAt time.Time `db:"created_at"`
+	ExpiresAt time.Time `db:"expires_at"`
 }
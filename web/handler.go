@@ -11,7 +11,24 @@ import (
 	"github.com/kmhebb/serverExample/log"
 )
 
+// TokenValidator checks the claims of a well-formed, correctly signed token
+// against state kept by the server, such as revoked tokens, that cannot be
+// verified from the token alone.
+type TokenValidator interface {
+	ValidateToken(ctx cloud.Context, claims *token.Claims) error
+}
+
+// APIKeyAuthenticator returns the API key matching the key sent in the
+// cloud.APIKeyHeader, or an error if there is none or it was revoked.
+type APIKeyAuthenticator interface {
+	AuthenticateAPIKey(ctx cloud.Context, key string) (*cloud.APIKey, error)
+}
+
 type Handler struct {
+	act           cloud.Action
+	az            cloud.AuthorizationService
+	tv            TokenValidator
+	ka            APIKeyAuthenticator
 	e             EndpointFunc
 	dec           DecodeFunc
 	enc           EncodeFunc
@@ -20,6 +37,24 @@ type Handler struct {
 }
 
 type HandlerOpts struct {
+	// Action is the action performed by the route. It is required. Unless the
+	// action is public, a bearer token is required and the Authorizer must
+	// allow the requesting user to perform the action before the endpoint is
+	// called.
+	Action cloud.Action
+
+	// Authorizer decides whether the requesting user may perform Action. It is
+	// required unless Action is public.
+	Authorizer cloud.AuthorizationService
+
+	// Validator checks bearer tokens against revocations. If nil, any
+	// correctly signed, unexpired token is accepted.
+	Validator TokenValidator
+
+	// KeyAuthenticator authenticates API keys sent instead of a bearer token.
+	// If nil, API keys are not accepted.
+	KeyAuthenticator APIKeyAuthenticator
+
 	// Decoder is the decode function to be used by the handler.
 	Decoder DecodeFunc
 
@@ -40,6 +75,14 @@ type HandlerOpts struct {
 }
 
 func NewHandler(opts HandlerOpts) *Handler {
+	// A route without an action or a way to authorize it is a programming
+	// error, and we would rather refuse to start than serve it unprotected.
+	if opts.Action == "" {
+		panic("web.NewHandler: HandlerOpts.Action is required")
+	}
+	if opts.Authorizer == nil && !opts.Action.Public() {
+		panic(fmt.Sprintf("web.NewHandler: HandlerOpts.Authorizer is required for action %q", opts.Action))
+	}
 	if opts.Encoder == nil {
 		opts.Encoder = EncodeJSON
 	}
@@ -51,6 +94,10 @@ func NewHandler(opts HandlerOpts) *Handler {
 	}
 
 	return &Handler{
+		act:           opts.Action,
+		az:            opts.Authorizer,
+		tv:            opts.Validator,
+		ka:            opts.KeyAuthenticator,
 		dec:           opts.Decoder,
 		e:             opts.Endpoint,
 		enc:           opts.Encoder,
@@ -102,6 +149,11 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	l.Debug(ctx.Ctx, "decoded request", log.Fields{"req": request})
 
+	// Only public actions can be performed anonymously.
+	if !h.act.Public() {
+		ctx.TokenRequired = true
+	}
+
 	err = h.authenticate(&ctx)
 	if err != nil {
 		h.errorFunc(ctx, err)
@@ -109,6 +161,15 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Everything done while impersonating a user is logged against both users.
+	if ctx.ImpersonatorKey != "" {
+		l.Info(ctx.Ctx, "Impersonated request", log.Fields{
+			"action":          h.act,
+			"user_id":         ctx.UserKey,
+			"impersonator_id": ctx.ImpersonatorKey,
+		})
+	}
+
 	if ctx.ConfTokenReqired {
 		err = h.checkConfirmation(ctx)
 		if err != nil {
@@ -118,6 +179,13 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	err = h.authorize(ctx)
+	if err != nil {
+		h.errorFunc(ctx, err)
+		h.errEncodeFunc(ctx, w, DefaultResponse, err)
+		return
+	}
+
 	response, err := h.e(ctx, request)
 	if err != nil {
 		h.errorFunc(ctx, err)
@@ -158,6 +226,10 @@ func (h *Handler) authenticate(ctx *cloud.Context) *cloud.Error {
 		return nil
 	}
 
+	if hdr == "" && ctx.APIKey != "" {
+		return h.authenticateAPIKey(ctx)
+	}
+
 	if hdr == "" && ctx.TokenRequired {
 		return cloud.NewError(cloud.ErrOpts{
 			Kind:    cloud.ErrKindBadRequest,
@@ -192,16 +264,78 @@ func (h *Handler) authenticate(ctx *cloud.Context) *cloud.Error {
 			Cause:   err,
 		}) //fmt.Errorf("token error: %s", err)
 	}
-	l.Info(ctx.Ctx, "Parsed bearer token", log.Fields{"user_id": claims.UID})
+	l.Info(ctx.Ctx, "Parsed bearer token", log.Fields{"user_id": claims.UID, "impersonator_id": claims.Impersonator})
+
+	if h.tv != nil {
+		if err := h.tv.ValidateToken(*ctx, claims); err != nil {
+			if e, ok := err.(*cloud.Error); ok {
+				return e
+			}
+			return cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindAuthenticate,
+				Message: "token is no longer valid",
+				Cause:   err,
+			})
+		}
+	}
 
 	// Evaluation of the claims will take place in the service logic as it pertains to the specific request.
 	ctx.Token = t
 	ctx.UserKey = claims.UID
+	ctx.ImpersonatorKey = claims.Impersonator
+	ctx.TokenID = claims.ID
+	ctx.TokenExpiry = claims.ExpiresAt
 
 	return nil
 
 }
 
+func (h *Handler) authenticateAPIKey(ctx *cloud.Context) *cloud.Error {
+	if h.ka == nil {
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "api keys are not accepted for this request",
+		})
+	}
+
+	k, err := h.ka.AuthenticateAPIKey(*ctx, ctx.APIKey)
+	if err != nil {
+		if e, ok := err.(*cloud.Error); ok {
+			return e
+		}
+		return cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindAuthenticate,
+			Message: "api key is invalid",
+			Cause:   err,
+		})
+	}
+	log.NewLogger().Info(ctx.Ctx, "Authenticated api key", log.Fields{"key_id": k.ID, "name": k.Name})
+
+	ctx.APIKeyID = k.ID
+	ctx.APIKeyScopes = k.Scopes
+
+	return nil
+}
+
+func (h *Handler) authorize(ctx cloud.Context) *cloud.Error {
+	if h.act.Public() {
+		return nil
+	}
+
+	err := h.az.Authorize(ctx, h.act)
+	if err == nil {
+		return nil
+	}
+	if e, ok := err.(*cloud.Error); ok {
+		return e
+	}
+	return cloud.NewError(cloud.ErrOpts{
+		Kind:    cloud.ErrKindForbidden,
+		Message: "user not allowed to perform this action",
+		Cause:   err,
+	})
+}
+
 func (h *Handler) checkConfirmation(ctx cloud.Context) *cloud.Error {
 	if ctx.ConfirmationToken == "" {
 		return cloud.NewError(cloud.ErrOpts{
@@ -220,11 +354,15 @@ func (h *Handler) checkConfirmation(ctx cloud.Context) *cloud.Error {
 func EncodeError(ctx cloud.Context, w http.ResponseWriter, data interface{}, e *cloud.Error) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(e.Code())
+	body := map[string]interface{}{
+		"kind":    e.Kind(),
+		"message": e.Message(),
+	}
+	if d := e.Details(); d != nil {
+		body["details"] = d
+	}
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error": map[string]interface{}{
-			"kind":    e.Kind(),
-			"message": e.Message(),
-		},
+		"error": body,
 	})
 }
 
@@ -232,5 +370,5 @@ func EncodeErrorHTML(ctx cloud.Context, w http.ResponseWriter, data interface{},
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(e.Code())
 	response := fmt.Sprintf("%v\n  kind - %v,\n message: %v", data, e.Kind(), e.Message())
-	fmt.Fprintf(w, response)
+	fmt.Fprint(w, response)
 }
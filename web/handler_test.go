@@ -0,0 +1,330 @@
+package web_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/internal/assert"
+	"github.com/kmhebb/serverExample/lib/token"
+	"github.com/kmhebb/serverExample/web"
+)
+
+func TestHandlerAuthorization(t *testing.T) {
+	token.SetSigningKey("test")
+	tok, err := token.New("admin-id", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only admin-id is allowed to import grid data.
+	az := cloud.AuthorizationFunc(func(ctx cloud.Context, act cloud.Action) error {
+		if ctx.UserKey == "admin-id" && act == cloud.ActionImportGridData {
+			return nil
+		}
+		return cloud.NewError(cloud.ErrOpts{Kind: cloud.ErrKindForbidden})
+	})
+
+	for name, tc := range map[string]struct {
+		action cloud.Action
+		token  string
+		called bool
+		kind   cloud.ErrorKind
+	}{
+		"public without token": {
+			action: cloud.ActionLogin,
+			called: true,
+		},
+		"protected without token": {
+			action: cloud.ActionImportGridData,
+			kind:   cloud.ErrKindBadRequest,
+		},
+		"protected and allowed": {
+			action: cloud.ActionImportGridData,
+			token:  tok,
+			called: true,
+		},
+		"protected and denied": {
+			action: cloud.ActionDeleteGridBatch,
+			token:  tok,
+			kind:   cloud.ErrKindForbidden,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			var called bool
+			h := web.NewHandler(web.HandlerOpts{
+				Action:     tc.action,
+				Authorizer: az,
+				Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+					return nil, nil
+				},
+				Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+					called = true
+					return nil, nil
+				},
+			})
+
+			r := httptest.NewRequest(http.MethodPost, "/api/test", nil)
+			if tc.token != "" {
+				r.Header.Set("Authorization", "Bearer Authorization:"+tc.token)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			assert.Equals(called, tc.called)
+			if tc.kind != "" {
+				var resp struct {
+					Error struct {
+						Kind cloud.ErrorKind `json:"kind"`
+					} `json:"error"`
+				}
+				assert.OK(json.NewDecoder(w.Body).Decode(&resp))
+				assert.Equals(resp.Error.Kind, tc.kind)
+			}
+		})
+	}
+}
+
+func TestNewHandlerRequiresAction(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected NewHandler to panic without an action")
+		}
+	}()
+	web.NewHandler(web.HandlerOpts{})
+}
+
+type keyAuthenticator map[string]*cloud.APIKey
+
+func (ka keyAuthenticator) AuthenticateAPIKey(ctx cloud.Context, key string) (*cloud.APIKey, error) {
+	if k, ok := ka[key]; ok {
+		return k, nil
+	}
+	return nil, cloud.NewError(cloud.ErrOpts{Kind: cloud.ErrKindAuthenticate})
+}
+
+func TestHandlerAPIKey(t *testing.T) {
+	ka := keyAuthenticator{
+		"cron": {ID: "cron-id", Scopes: []cloud.Action{cloud.ActionSyncInvoices}},
+	}
+	az := cloud.AuthorizationFunc(func(ctx cloud.Context, act cloud.Action) error {
+		for _, scope := range ctx.APIKeyScopes {
+			if scope == act {
+				return nil
+			}
+		}
+		return cloud.NewError(cloud.ErrOpts{Kind: cloud.ErrKindForbidden})
+	})
+
+	for name, tc := range map[string]struct {
+		key    string
+		noKeys bool
+		called bool
+		kind   cloud.ErrorKind
+	}{
+		"scoped key": {
+			key:    "cron",
+			called: true,
+		},
+		"unknown key": {
+			key:  "nope",
+			kind: cloud.ErrKindAuthenticate,
+		},
+		"keys not accepted": {
+			key:    "cron",
+			noKeys: true,
+			kind:   cloud.ErrKindBadRequest,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+
+			opts := web.HandlerOpts{
+				Action:           cloud.ActionSyncInvoices,
+				Authorizer:       az,
+				KeyAuthenticator: ka,
+				Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+					return nil, nil
+				},
+				Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+					assert.Equals(ctx.APIKeyID, "cron-id")
+					assert.Equals(ctx.UserKey, "")
+					return nil, nil
+				},
+			}
+			if tc.noKeys {
+				opts.KeyAuthenticator = nil
+			}
+			var called bool
+			e := opts.Endpoint
+			opts.Endpoint = func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+				called = true
+				return e(ctx, request)
+			}
+			h := web.NewHandler(opts)
+
+			r := httptest.NewRequest(http.MethodPost, "/api/test", nil)
+			r.Header.Set(cloud.APIKeyHeader, tc.key)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			assert.Equals(called, tc.called)
+			if tc.kind != "" {
+				var resp struct {
+					Error struct {
+						Kind cloud.ErrorKind `json:"kind"`
+					} `json:"error"`
+				}
+				assert.OK(json.NewDecoder(w.Body).Decode(&resp))
+				assert.Equals(resp.Error.Kind, tc.kind)
+			}
+		})
+	}
+}
+
+func TestHandlerImpersonation(t *testing.T) {
+	assert := assert.New(t)
+	token.SetSigningKey("test")
+	tok, err := token.New("user-id", "admin-id", 0)
+	assert.OK(err)
+
+	// Requests are authorized as the impersonated user.
+	var authorized string
+	az := cloud.AuthorizationFunc(func(ctx cloud.Context, act cloud.Action) error {
+		authorized = ctx.UserKey
+		return nil
+	})
+
+	var got cloud.Context
+	h := web.NewHandler(web.HandlerOpts{
+		Action:     cloud.ActionListCustomers,
+		Authorizer: az,
+		Decoder: func(ctx *cloud.Context, r *http.Request) (interface{}, *cloud.Error) {
+			return nil, nil
+		},
+		Endpoint: func(ctx cloud.Context, request interface{}) (interface{}, *cloud.Error) {
+			got = ctx
+			return nil, nil
+		},
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/api/test", nil)
+	r.Header.Set("Authorization", "Bearer Authorization:"+tok)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	assert.Equals(authorized, "user-id")
+	assert.Equals(got.UserKey, "user-id")
+	assert.Equals(got.ImpersonatorKey, "admin-id")
+}
+
+func TestEncodeErrorDetails(t *testing.T) {
+	assert := assert.New(t)
+
+	w := httptest.NewRecorder()
+	web.EncodeError(cloud.Context{}, w, nil, cloud.NewError(cloud.ErrOpts{
+		Kind:    cloud.ErrKindInvalid,
+		Message: "invalid",
+		Details: []string{"one", "two"},
+	}))
+	assert.Equals(w.Code, http.StatusBadRequest)
+
+	var body struct {
+		Error struct {
+			Kind    string   `json:"kind"`
+			Details []string `json:"details"`
+		} `json:"error"`
+	}
+	assert.OK(json.NewDecoder(w.Body).Decode(&body))
+	assert.Equals(body.Error.Kind, "invalid")
+	assert.Equals(body.Error.Details, []string{"one", "two"})
+}
+
+func TestEncodeCSV(t *testing.T) {
+	assert := assert.New(t)
+
+	w := httptest.NewRecorder()
+	e := web.EncodeCSV(cloud.Context{}, w, web.CSV{
+		Filename: "users.csv",
+		Records:  [][]string{{"email", "first"}, {"ann@example.com", "Ann, Jr"}},
+	})
+	assert.True(e == nil)
+	assert.Equals(w.Code, http.StatusOK)
+	assert.Equals(w.Header().Get("Content-Type"), web.ContentTypeCSV)
+	assert.Equals(w.Header().Get("Content-Disposition"), `attachment; filename="users.csv"`)
+	assert.Equals(w.Body.String(), "email,first\nann@example.com,\"Ann, Jr\"\n")
+
+	assert.True(web.EncodeCSV(cloud.Context{}, httptest.NewRecorder(), []string{"not", "csv"}) != nil)
+}
+
+func TestUploadedFile(t *testing.T) {
+	assert := assert.New(t)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	assert.OK(mw.WriteField("note", "first"))
+	fw, err := mw.CreateFormFile("file", "grid.csv")
+	assert.OK(err)
+	fw.Write([]byte("host_acct\n101\n"))
+	assert.OK(mw.Close())
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	f, name, e := web.UploadedFile(r, "file", 1<<20)
+	assert.True(e == nil)
+	assert.Equals(name, "grid.csv")
+	b, err := ioutil.ReadAll(f)
+	assert.OK(err)
+	assert.Equals(string(b), "host_acct\n101\n")
+
+	r = httptest.NewRequest(http.MethodPost, "/upload?filename=raw.csv", strings.NewReader("host_acct\n"))
+	r.Header.Set("Content-Type", "text/csv")
+	f, name, e = web.UploadedFile(r, "file", 1<<20)
+	assert.True(e == nil)
+	assert.Equals(name, "raw.csv")
+	b, err = ioutil.ReadAll(f)
+	assert.OK(err)
+	assert.Equals(string(b), "host_acct\n")
+}
+
+func TestUploadedFileMissingPart(t *testing.T) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("note", "first")
+	mw.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	_, _, e := web.UploadedFile(r, "file", 1<<20)
+	assert := assert.New(t)
+	assert.True(e != nil).Fatal()
+	assert.Equals(e.Message(), "multipart upload has no file part")
+}
+
+func TestUploadedFileLimit(t *testing.T) {
+	assert := assert.New(t)
+
+	// The body is cut off even when it is a field before the file that is
+	// too large.
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	assert.OK(mw.WriteField("note", strings.Repeat("x", 3<<20)))
+	fw, err := mw.CreateFormFile("file", "grid.csv")
+	assert.OK(err)
+	fw.Write([]byte("host_acct\n101\n"))
+	assert.OK(mw.Close())
+
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	_, _, e := web.UploadedFile(r, "file", 1<<20)
+	assert.True(e != nil).Fatal()
+	assert.Equals(e.Kind(), cloud.ErrKindBadRequest)
+	assert.Equals(e.Message(), "failed to read multipart upload")
+}
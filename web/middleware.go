@@ -16,14 +16,19 @@ func LoggingMiddleware(next EndpointFunc) EndpointFunc {
 	return func(ctx cloud.Context, request interface{}) (response interface{}, err *cloud.Error) {
 		defer func(begin time.Time) {
 			l := log.NewLogger()
-			l.Info(ctx.Ctx, "completed request", log.Fields{
+			fields := log.Fields{
 				"took":   time.Since(begin).Seconds(),
 				"path":   ctx.Request.URL.Path,
 				"method": ctx.Request.Method,
 				"host":   ctx.Request.Host,
 				"proto":  ctx.Request.Proto,
 				"ua":     ctx.Request.UserAgent(),
-			})
+			}
+			if ctx.ImpersonatorKey != "" {
+				fields["user_id"] = ctx.UserKey
+				fields["impersonator_id"] = ctx.ImpersonatorKey
+			}
+			l.Info(ctx.Ctx, "completed request", fields)
 		}(time.Now())
 		return next(ctx, request)
 	}
@@ -10,6 +10,7 @@ import (
 	"github.com/gorilla/mux"
 
 	cloud "github.com/kmhebb/serverExample"
+	"github.com/kmhebb/serverExample/lib/token"
 	"github.com/kmhebb/serverExample/log"
 )
 
@@ -18,6 +19,11 @@ const (
 	DefaultCircuitBreakerWait      time.Duration = 20 * time.Second
 )
 
+// JWKSPath is where the server publishes the public keys tokens are signed
+// with. Services verifying access tokens with them must also check the typ
+// claim, see token.TypeAccess.
+const JWKSPath = "/.well-known/jwks.json"
+
 type CircuitBreaker func() error
 
 type ServerState string
@@ -109,6 +115,14 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The public keys tokens are signed with, for services verifying them
+	// offline.
+	if r.URL.Path == JWKSPath {
+		w.Header().Set("Content-Type", ContentTypeJSON)
+		json.NewEncoder(w).Encode(token.PublicKeys())
+		return
+	}
+
 	if srv.state != ReadyState {
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
@@ -1,12 +1,18 @@
 package web_test
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"net/http/httputil"
 	"testing"
 	"time"
 
+	"github.com/kmhebb/serverExample/internal/assert"
+	"github.com/kmhebb/serverExample/lib/token"
 	"github.com/kmhebb/serverExample/web"
 )
 
@@ -61,6 +67,26 @@ func TestServer(t *testing.T) {
 	srv.Stop()
 }
 
+func TestServerJWKS(t *testing.T) {
+	assert := assert.New(t)
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.OK(err)
+	token.SetKeyring(token.NewKeyring(token.Key{ID: "ed", Private: key}))
+	defer token.SetSigningKey("test")
+
+	// The keys are published even before the server is ready for API requests.
+	srv := web.NewUnstartedServer(":0")
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest(http.MethodGet, web.JWKSPath, nil))
+
+	assert.Equals(w.Code, http.StatusOK)
+	var jwks token.JWKSet
+	assert.OK(json.NewDecoder(w.Body).Decode(&jwks))
+	assert.Equals(len(jwks.Keys), 1)
+	assert.Equals(jwks.Keys[0].Kid, "ed")
+	assert.Equals(jwks.Keys[0].Crv, "Ed25519")
+}
+
 func curl(t *testing.T, code int, url string) {
 	resp, err := http.Get(url)
 	if err != nil {
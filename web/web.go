@@ -1,9 +1,11 @@
 package web
 
 import (
+	"encoding/csv"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"io"
 	"net/http"
 
 	cloud "github.com/kmhebb/serverExample"
@@ -36,6 +38,7 @@ type ErrorEncodeFunc func(ctx cloud.Context, w http.ResponseWriter, data interfa
 const ContentTypeJSON = "application/json; charset=utf-8"
 const ContentTypeXML = "application/xml; charset=utf-8"
 const ContentTypeHTML = "text/html; charset=utf-8"
+const ContentTypeCSV = "text/csv; charset=utf-8"
 
 // EncodeJSON is an EncodeFunc that responds with a 200 OK status code and a
 // body that contains the response value marshaled to JSON.
@@ -57,10 +60,83 @@ func EncodeXML(ctx cloud.Context, w http.ResponseWriter, response interface{}) e
 func EncodeHTML(ctx cloud.Context, w http.ResponseWriter, data interface{}) *cloud.Error {
 	w.Header().Set("Content-Type", ContentTypeHTML)
 	response := fmt.Sprint(data)
-	fmt.Fprintf(w, response)
+	fmt.Fprint(w, response)
 	return nil
 }
 
+// CSV is a response encoded by EncodeCSV. Filename is the name the client is
+// told to save it under.
+type CSV struct {
+	Filename string
+	Records  [][]string
+}
+
+// EncodeCSV is an EncodeFunc that responds with a 200 OK status code and a CSV
+// attachment. The response must be a CSV.
+func EncodeCSV(ctx cloud.Context, w http.ResponseWriter, response interface{}) *cloud.Error {
+	c, ok := response.(CSV)
+	if !ok {
+		return cloud.NewError(cloud.ErrOpts{Message: fmt.Sprintf("cannot encode %T as csv", response)})
+	}
+	w.Header().Set("Content-Type", ContentTypeCSV)
+	if c.Filename != "" {
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", c.Filename))
+	}
+	w.WriteHeader(http.StatusOK)
+	cw := csv.NewWriter(w)
+	if err := cw.WriteAll(c.Records); err != nil {
+		return cloud.NewError(cloud.ErrOpts{Cause: err})
+	}
+	return nil
+}
+
+// uploadSlack is the room an upload is given beyond the size of its file, for
+// the framing and other fields of a multipart request.
+const uploadSlack = 1 << 20
+
+// UploadedFile returns the file uploaded with the request, to be streamed as
+// it is read. For multipart requests it is the part named field, and for any
+// other request it is the body, named by the filename query parameter. The
+// file is never read into memory or spooled to disk, so its parts must be
+// read in order. The body is cut off once it is uploadSlack larger than limit,
+// however many parts come before the file.
+//
+// As it reads the body, UploadedFile should only be called once the request
+// has been authorized, from the Endpoint rather than the Decoder.
+func UploadedFile(r *http.Request, field string, limit int64) (io.Reader, string, *cloud.Error) {
+	r.Body = http.MaxBytesReader(nil, r.Body, limit+uploadSlack)
+	mr, err := r.MultipartReader()
+	if err == http.ErrNotMultipart {
+		return r.Body, r.URL.Query().Get("filename"), nil
+	}
+	if err != nil {
+		return nil, "", cloud.NewError(cloud.ErrOpts{
+			Kind:    cloud.ErrKindBadRequest,
+			Message: "failed to read multipart upload",
+			Cause:   err,
+		})
+	}
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, "", cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindBadRequest,
+				Message: fmt.Sprintf("multipart upload has no %s part", field),
+			})
+		}
+		if err != nil {
+			return nil, "", cloud.NewError(cloud.ErrOpts{
+				Kind:    cloud.ErrKindBadRequest,
+				Message: "failed to read multipart upload",
+				Cause:   err,
+			})
+		}
+		if p.FormName() == field {
+			return p, p.FileName(), nil
+		}
+	}
+}
+
 // LogError is an ErrorFunc that simply logs the error.
 func LogError(ctx cloud.Context, e *cloud.Error) {
 	l := log.NewLogger()